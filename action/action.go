@@ -6,4 +6,9 @@ const (
 	GoBack   = "GO_BACK"
 	EditBack = "EDIT_BACK"
 	Save     = "SAVE"
+
+	// Group quiz buttons, followed by ':' and the card ID
+	GroupShowBack = "GROUP_SHOW_BACK"
+	GroupAnswer   = "GROUP_ANSWER"
+	GroupNext     = "GROUP_NEXT"
 )
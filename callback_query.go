@@ -1,7 +1,12 @@
 package main
 
 import (
+	"github.com/sirupsen/logrus"
 	"gopkg.in/telegram-bot-api.v4"
 )
 
-func HandleCallbackQuery(callback *tgbotapi.CallbackQuery) {}
+func HandleCallbackQuery(m Messenger, log *logrus.Entry, callback *tgbotapi.CallbackQuery) {
+	if callback.Message != nil && !callback.Message.Chat.IsPrivate() {
+		HandleGroupCallbackQuery(m, log, callback)
+	}
+}
@@ -7,12 +7,16 @@ import (
 	"github.com/bouk/memorizationbot/sm"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
 )
 
 type Card struct {
 	ID     int `db:"id"`
 	DeckID int `db:"deck_id"`
 
+	// The member whose progress is loaded into the card
+	UserID int `db:"user_id"`
+
 	// []Message
 	Front types.JSONText `db:"front"`
 	// []Message
@@ -23,15 +27,33 @@ type Card struct {
 	Repetition       int16 `db:"repetition"`
 	RepetitionToday  int16 `db:"repetition_today"`
 	RandomOrder      int32 `db:"random_order"`
+	LearningStep     int16 `db:"learning_step"`
+	// Days since the card was last reviewed
+	ElapsedDays int16 `db:"elapsed_days"`
+	// Whether the user has never reviewed the card
+	IsNew bool `db:"is_new"`
+	// How many times the card was forgotten after it was learned
+	Lapses    int16 `db:"lapses"`
+	Leech     bool  `db:"leech"`
+	Suspended bool  `db:"suspended"`
+	// The card is skipped in reviews until then
+	BuriedUntil pq.NullTime `db:"buried_until"`
 
 	NextRepetition time.Time `db:"next_repetition"`
 	CreatedAt      time.Time `db:"created_at"`
 	UpdatedAt      time.Time `db:"updated_at"`
 }
 
-func GetCard(tx *sqlx.Tx, id int) (*Card, error) {
+// GetCardContent loads a card without anyone's progress
+func GetCardContent(tx *sqlx.Tx, id int) (*Card, error) {
 	var card Card
-	err := tx.Get(&card, "SELECT * FROM cards WHERE id=$1", id)
+	err := tx.Get(&card, "SELECT id, deck_id, front, back, created_at, updated_at FROM cards WHERE id=$1", id)
+	return &card, err
+}
+
+func GetCard(tx *sqlx.Tx, userID int, id int) (*Card, error) {
+	var card Card
+	err := tx.Get(&card, "SELECT * FROM member_cards WHERE user_id=$1 AND id=$2", userID, id)
 	return &card, err
 }
 
@@ -41,7 +63,7 @@ func (c *Card) SetFront(tx *sqlx.Tx, messages []Message) error {
 		return err
 	}
 	c.Front, err = json.Marshal(messages)
-	return tx.Get(c, "UPDATE cards SET front=$1 WHERE id=$2 RETURNING *", c.Front, c.ID)
+	return tx.Get(c, "UPDATE cards SET front=$1 WHERE id=$2 RETURNING front, updated_at", c.Front, c.ID)
 }
 
 func (c *Card) SetBack(tx *sqlx.Tx, messages []Message) error {
@@ -50,7 +72,7 @@ func (c *Card) SetBack(tx *sqlx.Tx, messages []Message) error {
 	if err != nil {
 		return err
 	}
-	return tx.Get(c, "UPDATE cards SET back=$1 WHERE id=$2 RETURNING *", c.Back, c.ID)
+	return tx.Get(c, "UPDATE cards SET back=$1 WHERE id=$2 RETURNING back, updated_at", c.Back, c.ID)
 }
 
 func (c *Card) Delete(tx *sqlx.Tx) error {
@@ -58,6 +80,28 @@ func (c *Card) Delete(tx *sqlx.Tx) error {
 	return err
 }
 
+// ResetLeech gives a leech a fresh start, for example after it was rewritten
+func (c *Card) ResetLeech(tx *sqlx.Tx) error {
+	return tx.Get(c, "UPDATE card_progress SET lapses=0, leech=FALSE, suspended=FALSE WHERE user_id=$1 AND card_id=$2 RETURNING lapses, leech, suspended", c.UserID, c.ID)
+}
+
+// SetSuspended takes the card out of the reviews of the member until it's unsuspended
+func (c *Card) SetSuspended(tx *sqlx.Tx, suspended bool) error {
+	return tx.Get(c, `INSERT INTO card_progress (user_id, card_id, suspended) VALUES ($1, $2, $3)
+ON CONFLICT (user_id, card_id) DO UPDATE
+SET suspended=EXCLUDED.suspended
+RETURNING suspended`, c.UserID, c.ID, suspended)
+}
+
+// Bury skips the card for the rest of the day without rating it
+func (c *Card) Bury(context *Context) error {
+	return context.tx.Get(c, `INSERT INTO card_progress (user_id, card_id, buried_until)
+VALUES ($1, $2, start_of_day_in_time_zone(date_in_time_zone($3) + 1, $3))
+ON CONFLICT (user_id, card_id) DO UPDATE
+SET buried_until=EXCLUDED.buried_until
+RETURNING buried_until`, c.UserID, c.ID, context.u.TimeZone)
+}
+
 func (c *Card) GetFront() (messages []Message, err error) {
 	err = c.Front.Unmarshal(&messages)
 	return
@@ -69,36 +113,183 @@ func (c *Card) GetBack() (messages []Message, err error) {
 }
 
 func (c *Card) Respond(context *Context, quality int16) error {
-	repetition, easinessFactor, interval := sm.SM2Mod.Calc(quality, c.Repetition, c.EasinessFactor, c.PreviousInterval)
+	var member struct {
+		LearningSteps  pq.Int64Array `db:"learning_steps"`
+		LeechThreshold int16         `db:"leech_threshold"`
+		LeechAction    string        `db:"leech_action"`
+	}
+	err := context.tx.Get(&member, "SELECT learning_steps, leech_threshold, leech_action FROM deck_members WHERE deck_id=$1 AND user_id=$2", c.DeckID, context.u.ID)
+	if err != nil {
+		return err
+	}
+	steps := member.LearningSteps
+
+	// Forgetting a card that's still being learned doesn't count as a lapse
+	lapses := c.Lapses
+	if !c.IsNew && c.LearningStep == 0 && sm.SM2Mod.Lapsed(quality) {
+		lapses++
+	}
+	leech := c.Leech || lapses >= member.LeechThreshold
+	suspended := c.Suspended || (leech && !c.Leech && member.LeechAction == LeechSuspend)
+
+	repetition, easinessFactor, interval := sm.SM2Mod.Calc(quality, c.Repetition, c.EasinessFactor, c.PreviousInterval, c.ElapsedDays)
+
+	// New and failed cards go through the learning steps before they're scheduled in days
+	learningStep := c.LearningStep
+	if c.IsNew {
+		learningStep = 1
+	}
+	learning := false
+	var delay int64
+	if len(steps) > 0 && (learningStep > 0 || interval == 0) {
+		var graduated bool
+		learningStep, graduated = sm.SM2Mod.NextStep(quality, learningStep, len(steps))
+		if !graduated {
+			learning = true
+			delay = steps[learningStep-1]
+			if interval != 0 {
+				// Passing a step doesn't count as a repetition until the card graduates
+				repetition, easinessFactor, interval = c.Repetition, c.EasinessFactor, c.PreviousInterval
+			}
+		}
+	} else {
+		learningStep = 0
+	}
+
+	if !learning && interval > 0 {
+		interval, err = c.balanceInterval(context, interval)
+		if err != nil {
+			return err
+		}
+	}
+
 	var repetitionToday int16
-	if interval == 0 {
+	if interval == 0 || learning {
 		repetitionToday = c.RepetitionToday + 1
 	} else {
 		repetitionToday = 0
 	}
 
-	return context.tx.Get(c, `UPDATE cards
+	// Failed cards that are repeated on the same day don't count as another review.
+	// RepetitionToday comes from member_cards, which only counts the repetitions
+	// since midnight in the user's time zone.
+	if c.IsNew || c.RepetitionToday == 0 {
+		_, err = context.tx.Exec(`INSERT INTO daily_reviews (user_id, deck_id, day, new_cards, reviews)
+VALUES ($1, $2, date_in_time_zone($3), $4, $5)
+ON CONFLICT (user_id, deck_id, day) DO UPDATE
+SET
+ new_cards=daily_reviews.new_cards + EXCLUDED.new_cards,
+ reviews=daily_reviews.reviews + EXCLUDED.reviews`,
+			context.u.ID,
+			c.DeckID,
+			context.u.TimeZone,
+			boolToInt(c.IsNew),
+			boolToInt(!c.IsNew),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	c.IsNew = false
+	c.ElapsedDays = 0
+
+	err = context.tx.Get(c, `INSERT INTO card_progress (
+ user_id,
+ card_id,
+ easiness_factor,
+ previous_interval,
+ repetition,
+ repetition_today,
+ learning_step,
+ last_review,
+ last_quality,
+ next_repetition,
+ lapses,
+ leech,
+ suspended
+) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), $14, CASE
+ WHEN $9::BOOLEAN THEN NOW() + $10::INTEGER * INTERVAL '1 second'
+ ELSE start_of_day_in_time_zone(date_in_time_zone($8) + ($4)::INTEGER, $8)
+END, $11, $12, $13)
+ON CONFLICT (user_id, card_id) DO UPDATE
 SET
- easiness_factor=$1,
- previous_interval=$2,
- repetition=$3,
- repetition_today=$4,
+ easiness_factor=EXCLUDED.easiness_factor,
+ previous_interval=EXCLUDED.previous_interval,
+ repetition=EXCLUDED.repetition,
+ repetition_today=EXCLUDED.repetition_today,
+ learning_step=EXCLUDED.learning_step,
+ last_review=EXCLUDED.last_review,
+ last_quality=EXCLUDED.last_quality,
  random_order=TRUNC(RANDOM() * 2147483647)::INTEGER,
- next_repetition=date_in_time_zone($5) + ($6)::INTEGER
-WHERE
- id=$7
-RETURNING *`,
+ next_repetition=EXCLUDED.next_repetition,
+ lapses=EXCLUDED.lapses,
+ leech=EXCLUDED.leech,
+ suspended=EXCLUDED.suspended
+RETURNING
+ easiness_factor,
+ previous_interval,
+ repetition,
+ repetition_today,
+ learning_step,
+ random_order,
+ next_repetition,
+ lapses,
+ leech,
+ suspended`,
+		context.u.ID,
+		c.ID,
 		easinessFactor,
 		interval,
 		repetition,
 		repetitionToday,
+		learningStep,
 		context.u.TimeZone,
-		interval,
-		c.ID,
+		learning,
+		delay,
+		lapses,
+		leech,
+		suspended,
+		quality,
 	)
+	if err != nil {
+		return err
+	}
+	observeReview(quality, "review")
+	return nil
+}
+
+// balanceInterval moves the interval to a nearby day that doesn't have as many
+// cards due yet, so reviews get spread out evenly.
+func (c *Card) balanceInterval(context *Context, interval int16) (int16, error) {
+	min, max := sm.FuzzRange(interval)
+	if min == max {
+		return interval, nil
+	}
+	var days []struct {
+		Interval int16 `db:"interval"`
+		Due      int   `db:"due"`
+	}
+	err := context.tx.Select(&days, `SELECT
+ d AS interval,
+ (SELECT COUNT(*)
+  FROM card_progress
+  WHERE
+   user_id=$1 AND
+   next_repetition >= start_of_day_in_time_zone(date_in_time_zone($2) + d, $2) AND
+   next_repetition < start_of_day_in_time_zone(date_in_time_zone($2) + d + 1, $2)
+ ) AS due
+FROM generate_series($3::INTEGER, $4::INTEGER) d`, context.u.ID, context.u.TimeZone, min, max)
+	if err != nil {
+		return 0, err
+	}
+	due := make(map[int16]int, len(days))
+	for _, day := range days {
+		due[day.Interval] = day.Due
+	}
+	return sm.Balance(interval, due), nil
 }
 
-func (c *Card) SendFront(userID int, keyboard interface{}) error {
+func (c *Card) SendFront(m Messenger, chatID int64, keyboard interface{}) error {
 	messages, err := c.GetFront()
 	if err != nil {
 		return err
@@ -106,16 +297,16 @@ func (c *Card) SendFront(userID int, keyboard interface{}) error {
 
 	for i, message := range messages {
 		if i == len(messages)-1 {
-			Send(message.ToMessageConfig(int64(userID), keyboard))
+			m.Send(message.ToMessageConfig(chatID, keyboard))
 		} else {
-			Send(message.ToMessageConfig(int64(userID), nil))
+			m.Send(message.ToMessageConfig(chatID, nil))
 		}
 	}
 
 	return nil
 }
 
-func (c *Card) SendBack(userID int, keyboard interface{}) error {
+func (c *Card) SendBack(m Messenger, chatID int64, keyboard interface{}) error {
 	messages, err := c.GetBack()
 	if err != nil {
 		return err
@@ -123,11 +314,19 @@ func (c *Card) SendBack(userID int, keyboard interface{}) error {
 
 	for i, message := range messages {
 		if i == len(messages)-1 {
-			Send(message.ToMessageConfig(int64(userID), keyboard))
+			m.Send(message.ToMessageConfig(chatID, keyboard))
 		} else {
-			Send(message.ToMessageConfig(int64(userID), nil))
+			m.Send(message.ToMessageConfig(chatID, nil))
 		}
 	}
 
 	return nil
 }
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	} else {
+		return 0
+	}
+}
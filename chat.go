@@ -1,21 +1,31 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/getsentry/raven-go"
 	"github.com/jmoiron/sqlx"
-	"golang.org/x/net/context"
-	"googlemaps.github.io/maps"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/telegram-bot-api.v4"
 )
 
-func HandleMessage(msg *tgbotapi.Message) {
-	log.Printf("%+v", msg)
+// HandleMessageWith handles a message from a user, sending everything through m.
+func HandleMessageWith(m Messenger, log *logrus.Entry, msg *tgbotapi.Message) {
+	log = log.WithFields(describeMessage(msg))
+	log.Info("message")
 
-	if err := WithUser(msg.From.ID, func(u *User, tx *sqlx.Tx) error {
+	if msg.Chat.IsGroup() || msg.Chat.IsSuperGroup() {
+		HandleGroupMessage(m, log, msg)
+		return
+	}
+
+	start := time.Now()
+	var state State
+	if err := WithUser(log, msg.From.ID, func(u *User, tx *sqlx.Tx) error {
+		state = u.State
 		var data Data
 		if err := u.Data.Unmarshal(&data); err != nil {
 			return err
@@ -25,18 +35,37 @@ func HandleMessage(msg *tgbotapi.Message) {
 			from: int64(msg.From.ID),
 			tx:   tx,
 			u:    u,
+			m:    m,
+			log:  log.WithField("state", u.State),
 		}
 
 		reply := c.reply
-		createReply := c.createReply
 		if strings.HasPrefix(msg.Text, "/decks") {
 			return u.SetAndShowState(c, DeckList, nil)
 		} else if strings.HasPrefix(msg.Text, "/help") {
 			return u.State.Show(c)
 		} else if strings.HasPrefix(msg.Text, "/start") {
+			if code := strings.TrimSpace(strings.TrimPrefix(msg.Text, "/start")); code != "" {
+				if _, err := joinDeck(c, code); err != nil {
+					return err
+				}
+			}
 			return u.SetAndShowState(c, UserSetup, nil)
+		} else if strings.HasPrefix(msg.Text, "/join") {
+			deck, err := joinDeck(c, strings.TrimSpace(strings.TrimPrefix(msg.Text, "/join")))
+			if err != nil {
+				return err
+			}
+			if deck == nil {
+				return u.State.Show(c)
+			}
+			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
 		} else if strings.HasPrefix(msg.Text, "/settings") {
 			return u.SetAndShowState(c, Settings, nil)
+		} else if strings.HasPrefix(msg.Text, "/vacation") {
+			return u.SetAndShowState(c, VacationEdit, nil)
+		} else if strings.HasPrefix(msg.Text, "/review") {
+			return u.SetAndShowState(c, SessionSetup, nil)
 		}
 
 		switch u.State {
@@ -44,13 +73,13 @@ func HandleMessage(msg *tgbotapi.Message) {
 			if msg.Text == AddDeck {
 				return u.SetAndShowState(c, DeckCreate, nil)
 			} else if msg.Text == Help {
-				HelpUser(int64(u.ID))
+				HelpUser(c.m, int64(u.ID))
 				DeckList.Show(c)
 				return nil
 			} else if msg.Text == EditSettings {
 				return u.SetAndShowState(c, Settings, nil)
 			}
-			deck, err := u.GetDeckByName(tx, msg.Text)
+			deck, err := u.GetDeckByLabel(tx, msg.Text)
 			if err != nil {
 				return err
 			}
@@ -94,11 +123,26 @@ func HandleMessage(msg *tgbotapi.Message) {
 
 			switch msg.Text {
 			case Back:
+				if data.InSession() {
+					return finishSession(c, DeckList, nil)
+				}
 				return u.SetAndShowState(c, DeckList, nil)
 			case EditCard:
-				return u.SetAndShowState(c, CardEdit, &Data{CardID: card.ID})
+				return editCard(c, card.ID, Rehearsing)
 			case ShowReverseOfCard:
-				return u.SetAndShowState(c, RehearsingCardReview, nil)
+				return u.SetAndShowState(c, RehearsingCardReview, &data)
+			case BuryCard:
+				if err = card.Bury(c); err != nil {
+					return err
+				}
+				reply("Skipped until tomorrow")
+				return Rehearsing.Show(c)
+			case SuspendCard:
+				if err = card.SetSuspended(tx, true); err != nil {
+					return err
+				}
+				reply("Suspended, you can find it under '%s' in its deck", SuspendedCards)
+				return Rehearsing.Show(c)
 			default:
 				return Rehearsing.Show(c)
 			}
@@ -109,8 +153,18 @@ func HandleMessage(msg *tgbotapi.Message) {
 			}
 			switch msg.Text {
 			case Back:
+				if data.InSession() {
+					return finishSession(c, DeckList, nil)
+				}
 				return u.SetAndShowState(c, DeckList, nil)
+			case StartSession:
+				return u.SetAndShowState(c, SessionSetup, &Data{DeckID: deck.ID})
+			case CramDeck:
+				return u.SetAndShowState(c, CramSetup, &Data{DeckID: deck.ID})
 			case AddCard:
+				if !deck.Role.CanEditCards() {
+					return DeckDetails.Show(c)
+				}
 				return u.SetAndShowState(c, CardCreate, &Data{DeckID: data.DeckID})
 			case EditDeck:
 				return u.SetAndShowState(c, DeckEdit, &data)
@@ -119,10 +173,39 @@ func HandleMessage(msg *tgbotapi.Message) {
 				if err != nil {
 					return err
 				}
-				return u.SetAndShowState(c, CardEdit, &Data{CardID: card.ID})
+				if card == nil {
+					reply("No card to edit")
+					return DeckDetails.Show(c)
+				}
+				return editCard(c, card.ID, DeckDetails)
 			case ShowReverseOfCard:
 				return u.SetAndShowState(c, CardReview, &data)
+			case BuryCard, SuspendCard:
+				card, err := deck.GetCardForReview(c)
+				if err != nil {
+					return err
+				}
+				if card == nil {
+					reply("No card to skip")
+					return DeckDetails.Show(c)
+				}
+				if msg.Text == BuryCard {
+					err = card.Bury(c)
+					reply("Skipped until tomorrow")
+				} else {
+					err = card.SetSuspended(tx, true)
+					reply("Suspended, you can find it under '%s'", SuspendedCards)
+				}
+				if err != nil {
+					return err
+				}
+				return DeckDetails.Show(c)
 			default:
+				if strings.HasPrefix(msg.Text, Leeches) {
+					return u.SetAndShowState(c, DeckLeeches, &Data{DeckID: deck.ID})
+				} else if strings.HasPrefix(msg.Text, SuspendedCards) {
+					return u.SetAndShowState(c, DeckSuspended, &Data{DeckID: deck.ID})
+				}
 				return DeckDetails.Show(c)
 			}
 		case DeckEdit:
@@ -134,9 +217,29 @@ func HandleMessage(msg *tgbotapi.Message) {
 			case Back:
 				return u.SetAndShowState(c, DeckDetails, &data)
 			case EditName:
+				if !deck.Role.CanEditDeck() {
+					return DeckEdit.Show(c)
+				}
 				return u.SetAndShowState(c, DeckNameEdit, &data)
 			case DeleteDeck:
+				if !deck.Role.CanEditDeck() {
+					return DeckEdit.Show(c)
+				}
 				return u.SetAndShowState(c, DeckDelete, &data)
+			case ShareDeck:
+				if !deck.Role.CanEditDeck() {
+					return DeckEdit.Show(c)
+				}
+				return u.SetAndShowState(c, DeckShare, &data)
+			case LeaveDeck:
+				if deck.Role == Owner {
+					return DeckEdit.Show(c)
+				}
+				if err = deck.Leave(tx); err != nil {
+					return err
+				}
+				reply("You left '%s'", deck.Name)
+				return u.SetAndShowState(c, DeckList, nil)
 			case EnableScheduling:
 				err = deck.SetScheduled(tx, true)
 				if err != nil {
@@ -149,9 +252,214 @@ func HandleMessage(msg *tgbotapi.Message) {
 					return err
 				}
 				return DeckEdit.Show(c)
+			case EditOrder:
+				return u.SetAndShowState(c, DeckOrderEdit, &data)
 			default:
+				if strings.HasPrefix(msg.Text, NewCardsPerDay) {
+					return u.SetAndShowState(c, DeckNewCardsPerDayEdit, &data)
+				} else if strings.HasPrefix(msg.Text, MaxReviewsPerDay) {
+					return u.SetAndShowState(c, DeckMaxReviewsPerDayEdit, &data)
+				} else if strings.HasPrefix(msg.Text, LearningSteps) {
+					return u.SetAndShowState(c, DeckLearningStepsEdit, &data)
+				} else if strings.HasPrefix(msg.Text, LeechThreshold) {
+					return u.SetAndShowState(c, DeckLeechThresholdEdit, &data)
+				}
 				return DeckEdit.Show(c)
 			}
+		case DeckNewCardsPerDayEdit, DeckMaxReviewsPerDayEdit:
+			if msg.Text == Back {
+				return u.SetAndShowState(c, DeckEdit, &data)
+			}
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(msg.Text), 10, 16)
+			if err != nil || n < 0 {
+				reply("I don't understand what you mean, please try again.")
+				return u.State.Show(c)
+			}
+			if u.State == DeckNewCardsPerDayEdit {
+				err = deck.SetNewCardsPerDay(tx, int16(n))
+			} else {
+				err = deck.SetMaxReviewsPerDay(tx, int16(n))
+			}
+			if err != nil {
+				return err
+			}
+			reply("Limit changed to %d", n)
+			return u.SetAndShowState(c, DeckEdit, &data)
+		case DeckOrderEdit:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckEdit, &data)
+			case OrderByDue:
+				err = deck.SetReviewOrder(tx, OrderDue)
+			case OrderRandomly:
+				err = deck.SetReviewOrder(tx, OrderRandom)
+			case OrderByEase:
+				err = deck.SetReviewOrder(tx, OrderEase)
+			case NewCardsMixedIn:
+				err = deck.SetNewCardPosition(tx, NewCardsMixed)
+			case NewCardsBefore:
+				err = deck.SetNewCardPosition(tx, NewCardsFirst)
+			case NewCardsAfter:
+				err = deck.SetNewCardPosition(tx, NewCardsLast)
+			}
+			if err != nil {
+				return err
+			}
+			return DeckOrderEdit.Show(c)
+		case DeckLearningStepsEdit:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			if msg.Text == Back {
+				return u.SetAndShowState(c, DeckEdit, &data)
+			}
+			steps, err := parseSteps(msg.Text)
+			if err != nil {
+				reply("I don't understand what you mean, please try again.")
+				return DeckLearningStepsEdit.Show(c)
+			}
+			if err = deck.SetLearningSteps(tx, steps); err != nil {
+				return err
+			}
+			reply("Learning steps changed to '%s'", formatSteps(steps))
+			return u.SetAndShowState(c, DeckEdit, &data)
+		case DeckLeechThresholdEdit:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckEdit, &data)
+			case SuspendLeeches:
+				if err = deck.SetLeechAction(tx, LeechSuspend); err != nil {
+					return err
+				}
+				return DeckLeechThresholdEdit.Show(c)
+			case TagLeeches:
+				if err = deck.SetLeechAction(tx, LeechTag); err != nil {
+					return err
+				}
+				return DeckLeechThresholdEdit.Show(c)
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(msg.Text), 10, 16)
+			if err != nil || n < 1 {
+				reply("I don't understand what you mean, please try again.")
+				return DeckLeechThresholdEdit.Show(c)
+			}
+			if err = deck.SetLeechThreshold(tx, int16(n)); err != nil {
+				return err
+			}
+			reply("Cards now become leeches after %d lapses", n)
+			return u.SetAndShowState(c, DeckEdit, &data)
+		case DeckSuspended:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			card, err := deck.GetSuspended(tx, data.CardID)
+			if err != nil {
+				return err
+			}
+			if card == nil {
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+			}
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+			case UnsuspendCard:
+				if err = card.SetSuspended(tx, false); err != nil {
+					return err
+				}
+				reply("The card is back in your rehearsals.")
+				data.CardID = card.ID + 1
+				return u.SetAndShowState(c, DeckSuspended, &data)
+			case Next:
+				data.CardID = card.ID + 1
+				return u.SetAndShowState(c, DeckSuspended, &data)
+			default:
+				return DeckSuspended.Show(c)
+			}
+		case DeckLeeches:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			card, err := deck.GetLeech(tx, data.CardID)
+			if err != nil {
+				return err
+			}
+			if card == nil {
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+			}
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+			case EditCard:
+				return editCard(c, card.ID, DeckLeeches)
+			case NotALeech:
+				if err = card.ResetLeech(tx); err != nil {
+					return err
+				}
+				reply("The card is back in your rehearsals.")
+				data.CardID = card.ID + 1
+				return u.SetAndShowState(c, DeckLeeches, &data)
+			case Next:
+				data.CardID = card.ID + 1
+				return u.SetAndShowState(c, DeckLeeches, &data)
+			default:
+				return DeckLeeches.Show(c)
+			}
+		case DeckShare:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			var role Role
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckEdit, &data)
+			case ShareReadOnly:
+				role = Viewer
+			case ShareEditable:
+				role = Editor
+			case RevokeInvites:
+				if !deck.Role.CanEditDeck() {
+					return u.SetAndShowState(c, DeckEdit, &data)
+				}
+				count, err := deck.RevokeInvites(tx)
+				if err != nil {
+					return err
+				}
+				if count == 0 {
+					reply("There were no links to '%s' to revoke.", deck.Name)
+				} else {
+					reply("Revoked %d links to '%s'. People that already joined can still use it.", count, deck.Name)
+				}
+				return u.SetAndShowState(c, DeckEdit, &data)
+			default:
+				return DeckShare.Show(c)
+			}
+			if !deck.Role.CanEditDeck() {
+				return u.SetAndShowState(c, DeckEdit, &data)
+			}
+			code, err := deck.CreateInvite(tx, role)
+			if err != nil {
+				return err
+			}
+			reply("Forward this link to share '%s': https://telegram.me/%s?start=%s", deck.Name, c.m.UserName(), code)
+			reply("The link works for 30 days. You can revoke it earlier under %s.", ShareDeck)
+			reply("People that already use me can also send /join %s", code)
+			return u.SetAndShowState(c, DeckEdit, &data)
 		case DeckNameEdit:
 			deck, err := u.GetDeck(tx, data.DeckID)
 			name := strings.TrimSpace(strings.Replace(msg.Text, "\n", " ", -1))
@@ -198,6 +506,9 @@ func HandleMessage(msg *tgbotapi.Message) {
 			if err != nil {
 				return err
 			}
+			if !deck.Role.CanEditCards() {
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: data.DeckID})
+			}
 			_, err = deck.CreateCard(tx, data.Front, data.Back)
 			if err != nil {
 				return err
@@ -205,41 +516,77 @@ func HandleMessage(msg *tgbotapi.Message) {
 			reply("Card created")
 			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: data.DeckID})
 		case CardEdit:
-			card, err := GetCard(tx, data.CardID)
+			card, err := u.GetCard(tx, data.CardID)
 			if err != nil {
 				return err
 			}
+			if card == nil {
+				return u.SetAndShowState(c, DeckList, nil)
+			}
 			switch msg.Text {
 			case Back:
 				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: card.DeckID})
-			case DeleteCard:
-				err = card.Delete(tx)
+			case DeleteCard, EditCardFront, EditCardBack:
+				// Only the progress actions below are open to viewers
+				editable, err := u.GetEditableCard(tx, card.ID)
 				if err != nil {
 					return err
 				}
-				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: card.DeckID})
-			case EditCardFront:
-				return u.SetAndShowState(c, CardEditFront, &data)
-			case EditCardBack:
-				return u.SetAndShowState(c, CardEditBack, &data)
+				if editable == nil {
+					reply("You can't edit the cards in this deck.")
+					return CardEdit.Show(c)
+				}
+				switch msg.Text {
+				case DeleteCard:
+					if err = card.Delete(tx); err != nil {
+						return err
+					}
+					return u.SetAndShowState(c, DeckDetails, &Data{DeckID: card.DeckID})
+				case EditCardFront:
+					return u.SetAndShowState(c, CardEditFront, &data)
+				default:
+					return u.SetAndShowState(c, CardEditBack, &data)
+				}
+			case BuryCard, SuspendCard, UnsuspendCard:
+				switch msg.Text {
+				case BuryCard:
+					err = card.Bury(c)
+					reply("Skipped until tomorrow")
+				case SuspendCard:
+					err = card.SetSuspended(tx, true)
+					reply("Suspended")
+				case UnsuspendCard:
+					err = card.SetSuspended(tx, false)
+					reply("Unsuspended")
+				}
+				if err != nil {
+					return err
+				}
+				return CardEdit.Show(c)
 			default:
 				return CardEdit.Show(c)
 			}
 		case CardEditFront:
-			card, err := GetCard(tx, data.CardID)
+			card, err := u.GetEditableCard(tx, data.CardID)
 			if err != nil {
 				return err
 			}
+			if card == nil {
+				return u.SetAndShowState(c, DeckList, nil)
+			}
 			if err = card.SetFront(tx, processMessage(msg, nil)); err != nil {
 				return err
 			}
 			reply("Card updated")
 			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: card.DeckID})
 		case CardEditBack:
-			card, err := GetCard(tx, data.CardID)
+			card, err := u.GetEditableCard(tx, data.CardID)
 			if err != nil {
 				return err
 			}
+			if card == nil {
+				return u.SetAndShowState(c, DeckList, nil)
+			}
 			if err = card.SetBack(tx, processMessage(msg, nil)); err != nil {
 				return err
 			}
@@ -247,29 +594,41 @@ func HandleMessage(msg *tgbotapi.Message) {
 			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: card.DeckID})
 		case RehearsingCardReview:
 			card, err := u.GetScheduledCard(tx)
+			if err != nil {
+				return err
+			}
+			if card == nil {
+				return u.SetAndShowState(c, Rehearsing, nil)
+			}
+			wasLeech := card.Leech
 
+			var quality int16
 			switch msg.Text {
 			case Difficulty0:
 				reply("Too bad!")
-				err = card.Respond(c, 0)
+				quality = 0
 			case Difficulty1:
 				reply("You'll get it right next time!")
-				err = card.Respond(c, 1)
+				quality = 1
 			case Difficulty2:
 				reply("👍 All right!")
-				err = card.Respond(c, 2)
+				quality = 2
 			case Difficulty3:
 				reply("💯")
-				err = card.Respond(c, 3)
+				quality = 3
 			default:
 				return RehearsingCardReview.Show(c)
 			}
 
-			if err != nil {
+			if err = card.Respond(c, quality); err != nil {
 				return err
 			}
 
-			return u.SetAndShowState(c, Rehearsing, nil)
+			data.recordSessionReview(quality)
+			if card.Leech && !wasLeech {
+				return leech(c, card, Rehearsing, &data)
+			}
+			return u.SetAndShowState(c, Rehearsing, &data)
 		case CardReview:
 			deck, err := u.GetDeck(tx, data.DeckID)
 			if err != nil {
@@ -280,62 +639,81 @@ func HandleMessage(msg *tgbotapi.Message) {
 			if err != nil {
 				return err
 			}
+			if card == nil {
+				return u.SetAndShowState(c, DeckDetails, &data)
+			}
+			wasLeech := card.Leech
 
+			var quality int16
 			switch msg.Text {
 			case Difficulty0:
 				reply("Too bad!")
-				err = card.Respond(c, 0)
+				quality = 0
 			case Difficulty1:
 				reply("Not bad!")
-				err = card.Respond(c, 1)
+				quality = 1
 			case Difficulty2:
 				reply("All right!")
-				err = card.Respond(c, 2)
+				quality = 2
 			case Difficulty3:
 				reply("💯")
-				err = card.Respond(c, 3)
+				quality = 3
 			default:
 				return CardReview.Show(c)
 			}
 
-			if err != nil {
+			if err = card.Respond(c, quality); err != nil {
 				return err
 			}
 
+			data.recordSessionReview(quality)
+			if card.Leech && !wasLeech {
+				return leech(c, card, DeckDetails, &data)
+			}
 			return u.SetAndShowState(c, DeckDetails, &data)
 		case SetTimeZone:
-			var tzId, tzName string
-			var err error
-			if msg.Location == nil {
-				location, err := time.LoadLocation(msg.Text)
-				if err != nil {
-					msg := createReply("Please send me your location.")
-					msg.ReplyMarkup = tgbotapi.NewReplyKeyboard(
-						tgbotapi.NewKeyboardButtonRow(
-							tgbotapi.NewKeyboardButtonLocation("All right!"),
-						),
-					)
-					Send(msg)
-					return nil
+			return handleTimeZone(c, msg, data.Onboarding)
+		case TimeZonePick:
+			switch msg.Text {
+			case Next:
+				data.Page++
+				return u.SetAndShowState(c, TimeZonePick, &data)
+			case Previous:
+				if data.Page > 0 {
+					data.Page--
 				}
-			} else {
-				tzId, tzName, err = getTimezone(msg.Location)
-				if err != nil {
-					return err
+				return u.SetAndShowState(c, TimeZonePick, &data)
+			case Back:
+				return u.SetAndShowState(c, SetTimeZone, &Data{Onboarding: data.Onboarding})
+			}
+			picked := strings.TrimPrefix(msg.Text, TimeZone+" ")
+			if i := strings.Index(picked, " ("); i >= 0 {
+				picked = picked[:i]
+			}
+			for _, id := range SearchTimeZones(data.TimeZoneQuery) {
+				if id == picked {
+					if err := setTimeZone(c, id, data.Onboarding); err != nil {
+						return err
+					}
+					return timeZoneSet(c, data.Onboarding)
 				}
 			}
-			err = u.SetTimeZone(tx, tzId)
-			if err != nil {
-				return err
+			return handleTimeZone(c, msg, data.Onboarding)
+		case TimeZoneConfirm:
+			if msg.Text == TimeZoneCorrect {
+				return timeZoneSet(c, data.Onboarding)
 			}
-			reply("Got it! You're in the '%s' time zone.", tzName)
-			return u.SetAndShowState(c, DeckList, nil)
+			return handleTimeZone(c, msg, data.Onboarding)
 
 		case Settings:
 			if strings.HasPrefix(msg.Text, ChangeLocation) {
 				return u.SetAndShowState(c, SetTimeZone, nil)
 			} else if strings.HasPrefix(msg.Text, ChangeTimeToRehearse) {
 				return u.SetAndShowState(c, SetRehearsalTime, nil)
+			} else if strings.HasPrefix(msg.Text, RehearsalDays) {
+				return u.SetAndShowState(c, SetRehearsalDays, nil)
+			} else if strings.HasPrefix(msg.Text, QuietHours) {
+				return u.SetAndShowState(c, SetQuietHours, nil)
 			} else if msg.Text == EnableScheduling {
 				reply("Automatic rehearsing enabled")
 				if err := u.SetScheduled(tx, true); err != nil {
@@ -348,44 +726,211 @@ func HandleMessage(msg *tgbotapi.Message) {
 					return err
 				}
 				return Settings.Show(c)
+			} else if msg.Text == EnableRoundRobin {
+				reply("Rehearsal now takes turns between your decks")
+				if err := u.SetRoundRobin(tx, true); err != nil {
+					return err
+				}
+				return Settings.Show(c)
+			} else if msg.Text == DisableRoundRobin {
+				reply("Rehearsal now starts with the most overdue cards")
+				if err := u.SetRoundRobin(tx, false); err != nil {
+					return err
+				}
+				return Settings.Show(c)
+			} else if msg.Text == EnableReminders {
+				reply("I'll remind you when you haven't rehearsed yet")
+				if err := u.SetReminders(tx, true); err != nil {
+					return err
+				}
+				return Settings.Show(c)
+			} else if msg.Text == DisableReminders {
+				reply("I'll only send you your rehearsals, without any reminders")
+				if err := u.SetReminders(tx, false); err != nil {
+					return err
+				}
+				return Settings.Show(c)
+			} else if strings.HasPrefix(msg.Text, Vacation) {
+				return u.SetAndShowState(c, VacationEdit, nil)
 			} else {
 				return u.SetAndShowState(c, DeckList, nil)
 			}
-		case UserSetup:
-			if msg.Location == nil {
-				msg := createReply("Please send me your location.")
-				msg.ReplyMarkup = tgbotapi.NewReplyKeyboard(
-					tgbotapi.NewKeyboardButtonRow(
-						tgbotapi.NewKeyboardButtonLocation("All right!"),
-					),
-				)
-				Send(msg)
-				return nil
-			} else {
-				tzId, tzName, err := getTimezone(msg.Location)
-				if err != nil {
+		case VacationEdit:
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, Settings, nil)
+			case EndVacation:
+				if err := u.EndVacation(tx); err != nil {
 					return err
 				}
-				err = u.SetTimeZone(tx, tzId)
-				if err != nil {
-					return err
+				reply("Welcome back!")
+				return u.SetAndShowState(c, BacklogSpread, nil)
+			case SpreadBacklog:
+				return u.SetAndShowState(c, BacklogSpread, nil)
+			}
+			if u.VacationEnd.Valid {
+				return VacationEdit.Show(c)
+			}
+			start, end, ok := parseVacation(u.Today(), msg.Text)
+			if !ok {
+				reply("I don't understand what you mean, please try again.")
+				return VacationEdit.Show(c)
+			}
+			if err := u.SetVacation(tx, start, end); err != nil {
+				return err
+			}
+			reply("Enjoy your vacation! I won't send you any rehearsals from %s until %s.", start.Format(DateFormat), end.Format(DateFormat))
+			return u.SetAndShowState(c, Settings, nil)
+		case BacklogSpread:
+			if msg.Text == Back {
+				return u.SetAndShowState(c, DeckList, nil)
+			}
+			days, err := strconv.Atoi(strings.TrimSpace(msg.Text))
+			if err != nil || days < 1 {
+				reply("Please send me a number of days.")
+				return BacklogSpread.Show(c)
+			}
+			n, err := u.SpreadBacklog(tx, days)
+			if err != nil {
+				return err
+			}
+			reply("Spread out %d cards over %d days.", n, days)
+			return u.SetAndShowState(c, DeckList, nil)
+		case UserSetup:
+			return handleTimeZone(c, msg, true)
+		case CramSetup:
+			deck, err := u.GetDeck(tx, data.DeckID)
+			if err != nil {
+				return err
+			}
+			var cram *Cram
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+			case CramAll:
+				cram, err = deck.StartCram(tx, false)
+			case CramFailed:
+				cram, err = deck.StartCram(tx, true)
+			default:
+				return CramSetup.Show(c)
+			}
+			if err != nil {
+				return err
+			}
+			return u.SetAndShowState(c, Cramming, &Data{DeckID: deck.ID, CramID: cram.ID})
+		case Cramming:
+			switch msg.Text {
+			case Back:
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: data.DeckID})
+			case ShowReverseOfCard:
+				return u.SetAndShowState(c, CrammingCardReview, &data)
+			default:
+				return Cramming.Show(c)
+			}
+		case CrammingCardReview:
+			cram, err := GetCram(tx, u.ID, data.CramID)
+			if err != nil {
+				return err
+			}
+			if cram == nil {
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: data.DeckID})
+			}
+			var quality int16
+			switch msg.Text {
+			case Difficulty0:
+				reply("Too bad!")
+				quality = 0
+			case Difficulty1:
+				reply("Not bad!")
+				quality = 1
+			case Difficulty2:
+				reply("All right!")
+				quality = 2
+			case Difficulty3:
+				reply("💯")
+				quality = 3
+			default:
+				return CrammingCardReview.Show(c)
+			}
+			// Not passed through Card.Respond, so the schedule stays the same
+			if err = cram.Log(tx, data.CardID, quality); err != nil {
+				return err
+			}
+			return u.SetAndShowState(c, Cramming, &data)
+		case SessionSetup:
+			if msg.Text == Back && data.DeckID != 0 {
+				return u.SetAndShowState(c, DeckDetails, &Data{DeckID: data.DeckID})
+			} else if msg.Text == Back {
+				return u.SetAndShowState(c, DeckList, nil)
+			}
+			goal, duration, ok := parseSessionGoal(msg.Text)
+			if !ok {
+				reply("I don't understand what you mean, please try again.")
+				return SessionSetup.Show(c)
+			}
+			session := Data{DeckID: data.DeckID}
+			session.startSession(goal, duration)
+			if data.DeckID != 0 {
+				return u.SetAndShowState(c, DeckDetails, &session)
+			}
+			return u.SetAndShowState(c, Rehearsing, &session)
+		case SetRehearsalDays:
+			if msg.Text == Back {
+				return u.SetAndShowState(c, Settings, nil)
+			}
+			for _, d := range weekdays {
+				var days pq.Int64Array
+				if msg.Text == fmt.Sprintf(DayEnabledFormat, d) {
+					if len(u.RehearsalDays) == 1 {
+						reply("You need at least one day to rehearse on.")
+						return SetRehearsalDays.Show(c)
+					}
+					for _, day := range u.RehearsalDays {
+						if day != int64(d) {
+							days = append(days, day)
+						}
+					}
+				} else if msg.Text == fmt.Sprintf(DayDisabledFormat, d) {
+					days = append(append(days, u.RehearsalDays...), int64(d))
+				} else {
+					continue
 				}
-				reply("Got it! You're in the '%s' time zone.", tzName)
-				err = u.SetScheduled(tx, true)
-				if err != nil {
+				if err := u.SetRehearsalDays(tx, days); err != nil {
 					return err
 				}
-				reply("Every day at noon you will get sent your flash cards if there's any that need rehearsing. You can change the time of rehearsal in your /settings.")
-				return u.SetAndShowState(c, DeckList, nil)
+				break
+			}
+			return SetRehearsalDays.Show(c)
+		case SetQuietHours:
+			if msg.Text == Back {
+				return u.SetAndShowState(c, Settings, nil)
+			}
+			start, end, err := parseQuietHours(msg.Text)
+			if err != nil {
+				reply("I don't understand what you mean, please try again.")
+				return SetQuietHours.Show(c)
+			}
+			if alwaysQuiet(u.RehearsalTimes, start, end) {
+				reply("Those quiet hours cover all of your rehearsal times (%s), so you'd never get any rehearsals. Please pick shorter quiet hours, or change your rehearsal times first.", formatTimes(u.RehearsalTimes))
+				return SetQuietHours.Show(c)
+			}
+			if err = u.SetQuietHours(tx, start, end); err != nil {
+				return err
 			}
+			reply("Quiet hours changed to '%s'", formatQuietHours(start, end))
+			return u.SetAndShowState(c, Settings, nil)
 		case SetRehearsalTime:
-			t, err := time.Parse("15:04", msg.Text)
+			times, err := parseTimes(msg.Text)
+			if err == nil && alwaysQuiet(times, u.QuietStart, u.QuietEnd) {
+				reply("All of those times are in your quiet hours (%s), so you'd never get any rehearsals. Please pick a time outside of them.", formatQuietHours(u.QuietStart, u.QuietEnd))
+				return SetRehearsalTime.Show(c)
+			}
 			if err == nil {
-				err = u.SetRehearsalTime(tx, t)
+				err = u.SetRehearsalTimes(tx, times)
 				if err != nil {
 					return err
 				}
-				reply("Rehearsal time changed to '%s'", t.Format(TimeFormat))
+				reply("Rehearsal time changed to '%s'", formatTimes(times))
 			} else {
 				reply("I don't understand what you mean, please try again.")
 			}
@@ -395,24 +940,163 @@ func HandleMessage(msg *tgbotapi.Message) {
 			return nil
 		}
 	}); err != nil {
-		raven.CaptureError(err, nil)
-		Send(tgbotapi.NewMessage(msg.Chat.ID, err.Error()))
+		observeHandler(state.String(), start, err)
+		handlingFailed(m, log.WithFields(logrus.Fields{"state": state, "duration": time.Since(start)}), msg.Chat.ID, "handling message failed", err)
+		return
 	}
+	observeHandler(state.String(), start, nil)
+	log.WithFields(logrus.Fields{"state": state, "duration": time.Since(start)}).Info("handled message")
 }
 
-func getTimezone(loc *tgbotapi.Location) (string, string, error) {
-	resp, err := Maps.Timezone(context.TODO(), &maps.TimezoneRequest{
-		Location: &maps.LatLng{
-			Lat: loc.Latitude,
-			Lng: loc.Longitude,
-		},
-		Timestamp: time.Now(),
-		Language:  "en",
-	})
+// editCard goes into CardEdit if the card is in one of the user's decks, and
+// shows the given state again if not. Viewers of the deck can only bury and
+// suspend it there.
+func editCard(c *Context, cardID int, otherwise State) error {
+	card, err := c.u.GetCard(c.tx, cardID)
 	if err != nil {
-		return "", "", err
+		return err
+	}
+	if card == nil {
+		c.reply("That card isn't in any of your decks.")
+		return otherwise.Show(c)
+	}
+	return c.u.SetAndShowState(c, CardEdit, &Data{CardID: card.ID})
+}
+
+// leech lets the user know a card just became a leech. Tagged leeches go straight
+// to editing if the user is allowed to, since rewording the card usually helps.
+func leech(c *Context, card *Card, next State, data *Data) error {
+	if card.Suspended {
+		c.reply("You keep forgetting this card, so I've suspended it. You can find it under '%s' in its deck.", Leeches)
+		return c.u.SetAndShowState(c, next, data)
+	}
+	editable, err := c.u.GetEditableCard(c.tx, card.ID)
+	if err != nil {
+		return err
+	}
+	if editable == nil {
+		c.reply("You keep forgetting this card, so I've tagged it as a leech.")
+		return c.u.SetAndShowState(c, next, data)
+	}
+	c.reply("You keep forgetting this card, so I've tagged it as a leech. Rewording it or splitting it up might help!")
+	return c.u.SetAndShowState(c, CardEdit, &Data{CardID: card.ID})
+}
+
+func joinDeck(c *Context, code string) (*Deck, error) {
+	deck, err := c.u.JoinDeck(c.tx, code)
+	if err != nil {
+		return nil, err
+	}
+	if deck == nil {
+		c.reply("I don't know that deck, please check the link you were sent. Links stop working after 30 days, so you might need a new one.")
+	} else {
+		c.reply("You joined '%s'!", deck.Name)
+	}
+	return deck, nil
+}
+
+// parseVacation takes either a number of days starting today, or the first and
+// last day of the vacation.
+func parseVacation(today time.Time, text string) (start, end time.Time, ok bool) {
+	fields := strings.Fields(text)
+	switch len(fields) {
+	case 1:
+		days, err := strconv.Atoi(fields[0])
+		if err != nil || days < 1 {
+			return
+		}
+		return today, today.AddDate(0, 0, days-1), true
+	case 2:
+		var err error
+		if start, err = time.Parse(DateFormat, fields[0]); err != nil {
+			return
+		}
+		if end, err = time.Parse(DateFormat, fields[1]); err != nil {
+			return
+		}
+		return start, end, !end.Before(start) && !end.Before(today)
+	}
+	return
+}
+
+func getTimezone(loc *tgbotapi.Location) (string, error) {
+	return TimeZones.TimeZone(loc.Latitude, loc.Longitude)
+}
+
+// handleTimeZone takes a location, or else searches for the time zone the user
+// typed, and lets them pick from the results if there's more than one. The zone
+// for a location is shown to the user to check, since it can be off near borders.
+func handleTimeZone(c *Context, msg *tgbotapi.Message, onboarding bool) error {
+	if msg.Location != nil {
+		id, err := getTimezone(msg.Location)
+		if err != nil {
+			return err
+		}
+		if err = setTimeZone(c, id, onboarding); err != nil {
+			return err
+		}
+		return c.u.SetAndShowState(c, TimeZoneConfirm, &Data{Onboarding: onboarding})
+	}
+	query := strings.TrimSpace(msg.Text)
+	if query == "" {
+		prompt := c.createReply("Please send me your location, or type the name of your city or time zone.")
+		prompt.ReplyMarkup = tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButtonLocation("All right!"),
+			),
+		)
+		c.send(prompt)
+		return nil
+	}
+	ids := SearchTimeZones(query)
+	switch len(ids) {
+	case 0:
+		c.reply("I couldn't find a time zone for '%s'. Try the name of a big city near you, or your UTC offset like 'UTC+2'.", query)
+		return nil
+	case 1:
+		if err := setTimeZone(c, ids[0], onboarding); err != nil {
+			return err
+		}
+		return timeZoneSet(c, onboarding)
+	}
+	return c.u.SetAndShowState(c, TimeZonePick, &Data{TimeZoneQuery: query, Onboarding: onboarding})
+}
+
+// setTimeZone saves the time zone, and turns on rehearsals for users that are
+// just getting started.
+func setTimeZone(c *Context, id string, onboarding bool) error {
+	if err := c.u.SetTimeZone(c.tx, id); err != nil {
+		return err
+	}
+	if onboarding {
+		return c.u.SetScheduled(c.tx, true)
+	}
+	return nil
+}
+
+// timeZoneSet lets the user know their time zone is set and goes back to the decks.
+func timeZoneSet(c *Context, onboarding bool) error {
+	c.reply("Got it! You're in the '%s' time zone.", c.u.TimeZone)
+	if onboarding {
+		c.reply("Every day at noon you will get sent your flash cards if there's any that need rehearsing. You can change the time of rehearsal in your /settings.")
+	}
+	return c.u.SetAndShowState(c, DeckList, nil)
+}
+
+// timeZonePageSize is how many time zones TimeZonePick shows at once.
+const timeZonePageSize = 8
+
+// timeZonePage returns the time zones on the page, and whether there's more after it.
+func timeZonePage(ids []string, page int) ([]string, bool) {
+	start := page * timeZonePageSize
+	if start < 0 || start >= len(ids) {
+		return nil, false
+	}
+	end := start + timeZonePageSize
+	if end >= len(ids) {
+		return ids[start:], false
 	}
-	return resp.TimeZoneID, resp.TimeZoneName, nil
+	return ids[start:end], true
 }
 
 func HandleChosenInlineResult(chosenInlineResult *tgbotapi.ChosenInlineResult) {}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Config is read from the defaults, then the JSON file given with -secrets, if
+// any, and then the environment, each overriding what came before.
+type Config struct {
+	BotToken                 string `json:"bot_token"`
+	PostgresConnectionString string `json:"postgres_connection_string"`
+	PostgresSchema           string `json:"postgres_schema"`
+	// "offline" or "maps", which needs the Maps API key
+	TimeZoneResolver string `json:"time_zone_resolver"`
+	// Optional, only used for looking up time zones
+	MapsAPIKey string `json:"maps_api_key"`
+	// Optional, without it errors only end up in the log
+	SentryDSN string `json:"sentry_dsn"`
+}
+
+var defaultConfig = Config{
+	PostgresSchema:   "srsbot",
+	TimeZoneResolver: "offline",
+}
+
+type configField struct {
+	name     string
+	env      string
+	value    *string
+	validate func(string) error
+}
+
+func (c *Config) fields() []configField {
+	return []configField{
+		{"bot_token", "BOT_TOKEN", &c.BotToken, validateBotToken},
+		{"postgres_connection_string", "POSTGRES_CONNECTION_STRING", &c.PostgresConnectionString, required},
+		{"postgres_schema", "POSTGRES_SCHEMA", &c.PostgresSchema, validateIdentifier},
+		{"time_zone_resolver", "TIME_ZONE_RESOLVER", &c.TimeZoneResolver, oneOf("offline", "maps")},
+		{"maps_api_key", "MAPS_API_KEY", &c.MapsAPIKey, nil},
+		{"sentry_dsn", "SENTRY_DSN", &c.SentryDSN, validateSentryDSN},
+	}
+}
+
+// LoadConfig reads the config from the file at path, which may be empty to only
+// use the defaults and the environment.
+func LoadConfig(path string) (Config, error) {
+	c := defaultConfig
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&c); err != nil {
+			return c, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, field := range c.fields() {
+		if value, ok := os.LookupEnv(field.env); ok {
+			*field.value = value
+		}
+	}
+	return c, c.Validate()
+}
+
+// Validate checks every field and returns all problems at once.
+func (c *Config) Validate() error {
+	var problems []string
+	for _, field := range c.fields() {
+		if field.validate == nil {
+			continue
+		}
+		if err := field.validate(*field.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s) %v", field.name, field.env, err))
+		}
+	}
+	if c.TimeZoneResolver == "maps" && c.MapsAPIKey == "" {
+		problems = append(problems, "maps_api_key (MAPS_API_KEY) is needed with time_zone_resolver maps")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// PostgresConnectionStringWithSchema sets the search_path in the connection
+// string, so every connection in the pool uses the schema.
+func (c *Config) PostgresConnectionStringWithSchema() string {
+	s := c.PostgresConnectionString
+	if strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://") {
+		if u, err := url.Parse(s); err == nil {
+			q := u.Query()
+			q.Set("search_path", c.PostgresSchema)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return s + " search_path=" + c.PostgresSchema
+}
+
+var errMissing = errors.New("is missing")
+
+func required(s string) error {
+	if s == "" {
+		return errMissing
+	}
+	return nil
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(s string) error {
+		for _, value := range values {
+			if s == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("should be one of %s", strings.Join(values, ", "))
+	}
+}
+
+var botTokenRegexp = regexp.MustCompile(`^\d+:[\w-]+$`)
+
+func validateBotToken(s string) error {
+	if s == "" {
+		return errMissing
+	}
+	if !botTokenRegexp.MatchString(s) {
+		return errors.New("should look like 123456:ABC-DEF")
+	}
+	return nil
+}
+
+var identifierRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+func validateIdentifier(s string) error {
+	if !identifierRegexp.MatchString(s) {
+		return errors.New("should be a lowercase identifier like srsbot")
+	}
+	return nil
+}
+
+func validateSentryDSN(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.Host == "" {
+		return errors.New("should look like https://key@sentry.io/1")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clearConfigEnv unsets the config's environment variables for the test.
+func clearConfigEnv(t *testing.T) {
+	for _, field := range (&Config{}).fields() {
+		t.Setenv(field.env, "")
+		os.Unsetenv(field.env)
+	}
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfig(t, `{
+ "bot_token": "123:json",
+ "postgres_connection_string": "dbname=json",
+ "postgres_schema": "json_schema"
+}`)
+	t.Setenv("POSTGRES_SCHEMA", "env_schema")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		BotToken:                 "123:json",
+		PostgresConnectionString: "dbname=json",
+		PostgresSchema:           "env_schema",
+		TimeZoneResolver:         "offline",
+	}
+	if c != want {
+		t.Errorf("LoadConfig = %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("BOT_TOKEN", "123:env")
+	t.Setenv("POSTGRES_CONNECTION_STRING", "dbname=env")
+
+	c, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BotToken != "123:env" || c.PostgresConnectionString != "dbname=env" || c.PostgresSchema != defaultConfig.PostgresSchema {
+		t.Errorf("LoadConfig = %+v", c)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	clearConfigEnv(t)
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"missing file", filepath.Join(t.TempDir(), "missing.json"), "no such file"},
+		{"invalid JSON", writeConfig(t, `{"bot_token": `), "secrets.json"},
+		{"missing fields", writeConfig(t, `{}`), "bot_token (BOT_TOKEN) is missing"},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(test.path)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: LoadConfig error = %v, want it to mention %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := defaultConfig
+	valid.BotToken = "123456:ABC-DEF"
+	valid.PostgresConnectionString = "dbname=srsbot"
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"missing required fields", func(c *Config) {
+			c.BotToken = ""
+			c.PostgresConnectionString = ""
+		}, []string{"bot_token (BOT_TOKEN) is missing", "postgres_connection_string (POSTGRES_CONNECTION_STRING) is missing"}},
+		{"bad bot token", func(c *Config) { c.BotToken = "ABC" }, []string{"bot_token (BOT_TOKEN) should look like"}},
+		{"bad schema", func(c *Config) { c.PostgresSchema = "Bad-Schema" }, []string{"postgres_schema (POSTGRES_SCHEMA)"}},
+		{"unknown resolver", func(c *Config) { c.TimeZoneResolver = "google" }, []string{"should be one of offline, maps"}},
+		{"maps without a key", func(c *Config) { c.TimeZoneResolver = "maps" }, []string{"maps_api_key (MAPS_API_KEY) is needed"}},
+		{"maps with a key", func(c *Config) {
+			c.TimeZoneResolver = "maps"
+			c.MapsAPIKey = "key"
+		}, nil},
+		{"bad sentry DSN", func(c *Config) { c.SentryDSN = "sentry.io" }, []string{"sentry_dsn (SENTRY_DSN)"}},
+		{"sentry DSN", func(c *Config) { c.SentryDSN = "https://key@sentry.io/1" }, nil},
+	}
+	for _, test := range tests {
+		c := valid
+		test.change(&c)
+		err := c.Validate()
+		if len(test.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: Validate = %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: Validate didn't fail", test.name)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: Validate = %v, want it to mention %q", test.name, err, want)
+			}
+		}
+	}
+}
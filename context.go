@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/telegram-bot-api.v4"
 )
 
@@ -12,11 +13,22 @@ type Context struct {
 	tx   *sqlx.Tx
 	data *Data
 	from int64
+	m    Messenger
+	// Carries the trace_id and user_id of the work the Context is for
+	log *logrus.Entry
+}
+
+func (c *Context) send(chattable tgbotapi.Chattable) (tgbotapi.Message, error) {
+	message, err := c.m.Send(chattable)
+	if err != nil {
+		c.log.WithError(err).Warn("sending failed")
+	}
+	return message, err
 }
 
 func (c *Context) createReply(format string, data ...interface{}) tgbotapi.MessageConfig {
 	return tgbotapi.NewMessage(c.from, fmt.Sprintf(format, data...))
 }
 func (c *Context) reply(format string, data ...interface{}) (tgbotapi.Message, error) {
-	return Send(c.createReply(format, data...))
+	return c.send(c.createReply(format, data...))
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/bouk/memorizationbot/sm"
+	"github.com/jmoiron/sqlx"
+)
+
+// A Cram goes through the cards of a deck regardless of when they're due, until
+// each of them was answered correctly once. The answers go into the cram log
+// instead of the member's progress, so they don't affect the schedule.
+type Cram struct {
+	ID         int       `db:"id"`
+	UserID     int       `db:"user_id"`
+	DeckID     int       `db:"deck_id"`
+	FailedOnly bool      `db:"failed_only"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// StartCram starts cramming all cards of the deck, or only the ones the member
+// has forgotten before: the ones with lapses, and the ones that were answered
+// wrong the last time they were reviewed or crammed, like during learning steps.
+func (d *Deck) StartCram(tx *sqlx.Tx, failedOnly bool) (*Cram, error) {
+	var cram Cram
+	err := tx.Get(&cram, "INSERT INTO crams (user_id, deck_id, failed_only) VALUES ($1, $2, $3) RETURNING *", d.MemberID, d.ID, failedOnly)
+	return &cram, err
+}
+
+func GetCram(tx *sqlx.Tx, userID int, id int) (*Cram, error) {
+	var cram Cram
+	err := tx.Get(&cram, "SELECT * FROM crams WHERE user_id=$1 AND id=$2", userID, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &cram, err
+}
+
+// GetCard returns the next card to cram, or nil when all of them were answered
+// correctly. Cards that haven't come up yet go first, then the ones that were
+// answered wrong the longest ago.
+func (cr *Cram) GetCard(tx *sqlx.Tx) (*Card, error) {
+	var card Card
+	err := tx.Get(&card, `SELECT c.*
+FROM member_cards c
+LEFT JOIN (
+ SELECT card_id, MAX(created_at) AS answered_at, BOOL_OR(quality >= $5) AS correct
+ FROM cram_log
+ WHERE cram_id=$1
+ GROUP BY card_id
+) l ON l.card_id = c.id
+LEFT JOIN card_progress p ON p.user_id = c.user_id AND p.card_id = c.id
+LEFT JOIN (
+ SELECT DISTINCT ON (cl.card_id) cl.card_id, cl.quality
+ FROM cram_log cl
+ INNER JOIN crams ON crams.id = cl.cram_id
+ WHERE crams.user_id=$3 AND crams.deck_id=$2 AND crams.id != $1
+ ORDER BY cl.card_id, cl.created_at DESC, cl.id DESC
+) last_cram ON last_cram.card_id = c.id
+WHERE
+ c.deck_id=$2 AND
+ c.user_id=$3 AND
+ (NOT $4 OR c.lapses > 0 OR p.last_quality < $5 OR last_cram.quality < $5) AND
+ l.correct IS NOT TRUE
+ORDER BY
+ l.answered_at ASC NULLS FIRST,
+ c.random_order ASC
+LIMIT 1`, cr.ID, cr.DeckID, cr.UserID, cr.FailedOnly, sm.SM2Mod.PassQuality())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &card, err
+}
+
+func (cr *Cram) Log(tx *sqlx.Tx, cardID int, quality int16) error {
+	_, err := tx.Exec("INSERT INTO cram_log (cram_id, card_id, quality) VALUES ($1, $2, $3)", cr.ID, cardID, quality)
+	if err == nil {
+		observeReview(quality, "cram")
+	}
+	return err
+}
+
+// Stats returns how many cards were crammed, and how many of those were
+// answered correctly the first time.
+func (cr *Cram) Stats(tx *sqlx.Tx) (cards int, firstTry int, err error) {
+	var result struct {
+		Cards    int `db:"cards"`
+		FirstTry int `db:"first_try"`
+	}
+	err = tx.Get(&result, `SELECT
+ COUNT(*) AS cards,
+ COUNT(CASE WHEN first.quality >= $2 THEN TRUE END) AS first_try
+FROM (
+ SELECT DISTINCT ON (card_id) quality
+ FROM cram_log
+ WHERE cram_id=$1
+ ORDER BY card_id, created_at ASC, id ASC
+) first`, cr.ID, sm.SM2Mod.PassQuality())
+	return result.Cards, result.FirstTry, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestCramFailedOnly(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	mustExec(t, db, "INSERT INTO users (id) VALUES (1)")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES (1, 1, 'Words')")
+	mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role) VALUES (1, 1, 'owner')")
+	for id := 1; id <= 5; id++ {
+		mustExec(t, db, "INSERT INTO cards (id, deck_id, front, back) VALUES ($1, 1, '[]', '[]')", id)
+	}
+	mustExec(t, db, `INSERT INTO card_progress (user_id, card_id, last_review, lapses, last_quality) VALUES
+ (1, 1, NOW(), 1, 4),
+ (1, 2, NOW(), 0, 1),
+ (1, 3, NOW(), 0, 4),
+ (1, 4, NOW(), 0, 4)`)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	deck, err := (&User{ID: 1}).GetDeck(tx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Card 1 lapsed, card 2 was failed during its learning steps, and card 4
+	// was failed the last time it was crammed
+	earlier, err := deck.StartCram(tx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, answer := range []struct {
+		cardID  int
+		quality int16
+	}{{3, 1}, {3, 4}, {4, 4}, {4, 1}} {
+		if err = earlier.Log(tx, answer.cardID, answer.quality); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cram, err := deck.StartCram(tx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var crammed []int
+	for {
+		card, err := cram.GetCard(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card == nil {
+			break
+		}
+		if len(crammed) > 5 {
+			t.Fatalf("still cramming after %v", crammed)
+		}
+		crammed = append(crammed, card.ID)
+		if err = cram.Log(tx, card.ID, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Ints(crammed)
+	want := []int{1, 2, 4}
+	if len(crammed) != len(want) || crammed[0] != want[0] || crammed[1] != want[1] || crammed[2] != want[2] {
+		t.Errorf("crammed cards %v, want %v", crammed, want)
+	}
+}
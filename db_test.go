@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// newTestSchema points DB at a new, empty schema in the database from
+// TEST_POSTGRES_CONNECTION_STRING, which is dropped again after the test. Tests
+// that need a database are skipped without it.
+func newTestSchema(t *testing.T) *sqlx.DB {
+	connectionString := os.Getenv("TEST_POSTGRES_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("TEST_POSTGRES_CONNECTION_STRING isn't set")
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	schema := "test_" + hex.EncodeToString(b)
+
+	admin, err := sqlx.Open("postgres", connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = admin.Exec("CREATE SCHEMA " + pq.QuoteIdentifier(schema)); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	oldDB, oldSecrets := DB, Secrets
+	Secrets = Config{
+		PostgresConnectionString: connectionString,
+		PostgresSchema:           schema,
+	}
+	DB, err = sqlx.Open("postgres", Secrets.PostgresConnectionStringWithSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := DB
+	t.Cleanup(func() {
+		db.Close()
+		DB, Secrets = oldDB, oldSecrets
+		if _, err := admin.Exec("DROP SCHEMA " + pq.QuoteIdentifier(schema) + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+	return db
+}
@@ -1,20 +1,74 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
+// The order in which a member reviews the cards of a deck
+const (
+	OrderDue    = "due"
+	OrderRandom = "random"
+	OrderEase   = "ease"
+)
+
+// Where new cards go in between the cards that are being reviewed
+const (
+	NewCardsMixed = "mixed"
+	NewCardsFirst = "first"
+	NewCardsLast  = "last"
+)
+
+// What happens to cards that become leeches
+const (
+	LeechTag     = "tag"
+	LeechSuspend = "suspend"
+)
+
+// Role of a member of a deck. The owner created the deck, editors can change
+// its cards and viewers can only rehearse them.
+type Role string
+
+const (
+	Owner  = Role("owner")
+	Editor = Role("editor")
+	Viewer = Role("viewer")
+)
+
+func (r Role) CanEditCards() bool {
+	return r == Owner || r == Editor
+}
+
+func (r Role) CanEditDeck() bool {
+	return r == Owner
+}
+
 type Deck struct {
-	ID        int    `db:"id"`
-	UserID    int    `db:"user_id"`
-	Name      string `db:"name"`
-	Scheduled bool   `db:"scheduled"`
+	ID     int    `db:"id"`
+	UserID int    `db:"user_id"`
+	Name   string `db:"name"`
 
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
+
+	// The member the deck was loaded for
+	MemberID         int   `db:"member_id"`
+	Role             Role  `db:"role"`
+	Scheduled        bool  `db:"scheduled"`
+	NewCardsPerDay   int16 `db:"new_cards_per_day"`
+	MaxReviewsPerDay int16 `db:"max_reviews_per_day"`
+	// In seconds
+	LearningSteps   pq.Int64Array `db:"learning_steps"`
+	ReviewOrder     string        `db:"review_order"`
+	NewCardPosition string        `db:"new_card_position"`
+	LeechThreshold  int16         `db:"leech_threshold"`
+	LeechAction     string        `db:"leech_action"`
 }
 
 func (d *Deck) Delete(tx *sqlx.Tx) error {
@@ -22,26 +76,122 @@ func (d *Deck) Delete(tx *sqlx.Tx) error {
 	return err
 }
 
+// Leave removes the member from the deck along with their progress on its cards.
+func (d *Deck) Leave(tx *sqlx.Tx) error {
+	_, err := tx.Exec("DELETE FROM card_progress WHERE user_id=$1 AND card_id IN (SELECT id FROM cards WHERE deck_id=$2)", d.MemberID, d.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM deck_members WHERE user_id=$1 AND deck_id=$2", d.MemberID, d.ID)
+	return err
+}
+
 func (d *Deck) SetName(tx *sqlx.Tx, name string) error {
 	return tx.Get(d, "UPDATE decks SET name=$1 WHERE id=$2 RETURNING *", name, d.ID)
 }
 
 func (d *Deck) SetScheduled(tx *sqlx.Tx, scheduled bool) error {
-	return tx.Get(d, "UPDATE decks SET scheduled=$1 WHERE id=$2 RETURNING *", scheduled, d.ID)
+	return tx.Get(d, "UPDATE deck_members SET scheduled=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING scheduled", scheduled, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetNewCardsPerDay(tx *sqlx.Tx, n int16) error {
+	return tx.Get(d, "UPDATE deck_members SET new_cards_per_day=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING new_cards_per_day", n, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetMaxReviewsPerDay(tx *sqlx.Tx, n int16) error {
+	return tx.Get(d, "UPDATE deck_members SET max_reviews_per_day=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING max_reviews_per_day", n, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetLearningSteps(tx *sqlx.Tx, steps pq.Int64Array) error {
+	return tx.Get(d, "UPDATE deck_members SET learning_steps=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING learning_steps", steps, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetReviewOrder(tx *sqlx.Tx, order string) error {
+	return tx.Get(d, "UPDATE deck_members SET review_order=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING review_order", order, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetNewCardPosition(tx *sqlx.Tx, position string) error {
+	return tx.Get(d, "UPDATE deck_members SET new_card_position=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING new_card_position", position, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetLeechThreshold(tx *sqlx.Tx, n int16) error {
+	return tx.Get(d, "UPDATE deck_members SET leech_threshold=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING leech_threshold", n, d.ID, d.MemberID)
+}
+
+func (d *Deck) SetLeechAction(tx *sqlx.Tx, action string) error {
+	return tx.Get(d, "UPDATE deck_members SET leech_action=$1 WHERE deck_id=$2 AND user_id=$3 RETURNING leech_action", action, d.ID, d.MemberID)
+}
+
+func (d *Deck) CountLeeches(tx *sqlx.Tx) (count int, err error) {
+	err = tx.Get(&count, "SELECT COUNT(*) FROM card_progress p INNER JOIN cards c ON c.id = p.card_id WHERE c.deck_id=$1 AND p.user_id=$2 AND p.leech", d.ID, d.MemberID)
+	return
+}
+
+func (d *Deck) CountSuspended(tx *sqlx.Tx) (count int, err error) {
+	err = tx.Get(&count, "SELECT COUNT(*) FROM card_progress p INNER JOIN cards c ON c.id = p.card_id WHERE c.deck_id=$1 AND p.user_id=$2 AND p.suspended", d.ID, d.MemberID)
+	return
+}
+
+// GetLeech returns the first leech of the member starting from the given card ID,
+// or nil if there are no more.
+func (d *Deck) GetLeech(tx *sqlx.Tx, fromID int) (*Card, error) {
+	return d.getCardFrom(tx, "leech", fromID)
+}
+
+// GetSuspended returns the first suspended card of the member starting from the
+// given card ID, or nil if there are no more.
+func (d *Deck) GetSuspended(tx *sqlx.Tx, fromID int) (*Card, error) {
+	return d.getCardFrom(tx, "suspended", fromID)
+}
+
+func (d *Deck) getCardFrom(tx *sqlx.Tx, column string, fromID int) (*Card, error) {
+	var card Card
+	err := tx.Get(&card, "SELECT * FROM member_cards WHERE deck_id=$1 AND user_id=$2 AND "+column+" AND id >= $3 ORDER BY id ASC LIMIT 1", d.ID, d.MemberID, fromID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &card, err
+}
+
+// GetNextLearningDue returns how long it takes until the first card that is being
+// learned in the deck is due, if any.
+func (d *Deck) GetNextLearningDue(tx *sqlx.Tx) (*time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := tx.Get(&seconds, "SELECT EXTRACT(EPOCH FROM MIN(next_repetition) - NOW()) FROM member_cards WHERE deck_id=$1 AND user_id=$2 AND learning_step > 0", d.ID, d.MemberID)
+	if err != nil || !seconds.Valid {
+		return nil, err
+	}
+	due := time.Duration(seconds.Float64 * float64(time.Second))
+	return &due, nil
 }
 
+// GetCardForReview returns the card to review next in the deck, or nil if
+// there's none left for now.
 func (d *Deck) GetCardForReview(c *Context) (*Card, error) {
 	var card Card
 	err := c.tx.Get(&card, `SELECT *
-FROM cards
+FROM reviewable_cards
 WHERE
  deck_id=$1 AND
- next_repetition <= date_in_time_zone($2)
+ user_id=$2
 ORDER BY
- next_repetition ASC,
- repetition_today ASC,
- random_order ASC
-LIMIT 1`, d.ID, c.u.TimeZone)
+ review_order(
+  $3,
+  $4,
+  is_new,
+  ROW_NUMBER() OVER (
+   PARTITION BY is_new
+   ORDER BY review_group_order($3, is_new, next_repetition, easiness_factor, random_order), repetition_today, random_order
+  ),
+  next_repetition,
+  easiness_factor,
+  repetition_today,
+  random_order
+ ) ASC
+LIMIT 1`, d.ID, d.MemberID, d.ReviewOrder, d.NewCardPosition)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	return &card, err
 }
 
@@ -60,6 +210,24 @@ func (d *Deck) CreateCard(tx *sqlx.Tx, front []Message, back []Message) (*Card,
 		return nil, err
 	}
 	var card Card
-	err = tx.Get(&card, "INSERT INTO cards (deck_id, front, back) VALUES ($1, $2, $3) RETURNING *", d.ID, frontJson, backJson)
+	err = tx.Get(&card, "INSERT INTO cards (deck_id, front, back) VALUES ($1, $2, $3) RETURNING id, deck_id, front, back, created_at, updated_at", d.ID, frontJson, backJson)
 	return &card, err
 }
+
+// CreateInvite returns a code that lets other users join the deck with the given role.
+func (d *Deck) CreateInvite(tx *sqlx.Tx, role Role) (code string, err error) {
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	err = tx.Get(&code, "INSERT INTO deck_invites (code, deck_id, role) VALUES ($1, $2, $3) RETURNING code", hex.EncodeToString(b), d.ID, role)
+	return
+}
+
+// RevokeInvites stops all links to the deck from working and returns how many
+// were still valid. People that already joined stay members.
+func (d *Deck) RevokeInvites(tx *sqlx.Tx) (count int, err error) {
+	err = tx.Get(&count, `WITH r AS (DELETE FROM deck_invites WHERE deck_id=$1 RETURNING expires_at)
+ SELECT COUNT(*) FROM r WHERE expires_at > NOW()`, d.ID)
+	return
+}
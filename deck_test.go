@@ -0,0 +1,162 @@
+package main
+
+import "testing"
+
+func TestGetCardForReviewMixesNewCards(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	mustExec(t, db, "INSERT INTO users (id) VALUES (1)")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES (1, 1, 'Words')")
+	mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role, new_card_position) VALUES (1, 1, 'owner', 'mixed')")
+	for id := 1; id <= 4; id++ {
+		mustExec(t, db, "INSERT INTO cards (id, deck_id, front, back) VALUES ($1, 1, '[]', '[]')", id)
+	}
+	// Cards 1 and 2 are reviews, 3 and 4 are new
+	mustExec(t, db, `INSERT INTO card_progress (user_id, card_id, next_repetition, last_review) VALUES
+ (1, 1, NOW() - INTERVAL '2 days', NOW() - INTERVAL '3 days'),
+ (1, 2, NOW() - INTERVAL '1 day', NOW() - INTERVAL '3 days')`)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	u := &User{ID: 1}
+	deck, err := u.GetDeck(tx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Context{u: u, tx: tx, log: Log.WithField("test", t.Name())}
+
+	var order []bool
+	for {
+		card, err := deck.GetCardForReview(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card == nil {
+			break
+		}
+		if !card.IsNew && len(order) == 0 && card.ID != 1 {
+			t.Errorf("first review is card %d, want the one that's been due the longest", card.ID)
+		}
+		order = append(order, card.IsNew)
+		_, err = tx.Exec(`INSERT INTO card_progress (user_id, card_id, suspended) VALUES (1, $1, TRUE)
+ON CONFLICT (user_id, card_id) DO UPDATE SET suspended = TRUE`, card.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []bool{false, true, false, true}
+	if len(order) != len(want) {
+		t.Fatalf("reviewed cards that are new: %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("reviewed cards that are new: %v, want %v", order, want)
+		}
+	}
+}
+
+func TestInvites(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	mustExec(t, db, "INSERT INTO users (id) VALUES (1), (2), (3)")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES (1, 1, 'Words')")
+	mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role) VALUES (1, 1, 'owner')")
+	mustExec(t, db, "INSERT INTO deck_invites (code, deck_id, role, expires_at) VALUES ('old', 1, 'viewer', NOW() - INTERVAL '1 day')")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	owner := &User{ID: 1}
+	deck, err := owner.GetDeck(tx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := deck.CreateInvite(tx, Viewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if joined, err := (&User{ID: 2}).JoinDeck(tx, "old"); err != nil || joined != nil {
+		t.Errorf("joining with an expired code = %v, %v", joined, err)
+	}
+	if joined, err := (&User{ID: 2}).JoinDeck(tx, code); err != nil || joined == nil {
+		t.Errorf("joining with a new code = %v, %v", joined, err)
+	}
+
+	// Only the new code was still valid
+	if count, err := deck.RevokeInvites(tx); err != nil || count != 1 {
+		t.Errorf("RevokeInvites = %d, %v, want 1", count, err)
+	}
+	if joined, err := (&User{ID: 3}).JoinDeck(tx, code); err != nil || joined != nil {
+		t.Errorf("joining with a revoked code = %v, %v", joined, err)
+	}
+	if g, err := LinkGroupChat(tx, -100, code, owner); err != nil || g != nil {
+		t.Errorf("linking a group with a revoked code = %v, %v", g, err)
+	}
+
+	// Joining someone else's deck doesn't take the name
+	if has, err := (&User{ID: 2}).HasDeckWithName(tx, "Words"); err != nil || has {
+		t.Errorf("HasDeckWithName of a member = %v, %v", has, err)
+	}
+	if has, err := owner.HasDeckWithName(tx, "Words"); err != nil || !has {
+		t.Errorf("HasDeckWithName of the owner = %v, %v", has, err)
+	}
+}
+
+func TestDeckLabels(t *testing.T) {
+	decks := []Deck{
+		{ID: 3, Name: "Verbs"},
+		{ID: 1, Name: "Words"},
+		{ID: 2, Name: "Words"},
+	}
+	labels := deckLabels(decks)
+	want := []string{"Verbs", "Words (#1)", "Words (#2)"}
+	if len(labels) != len(want) {
+		t.Fatalf("deckLabels = %q, want %q", labels, want)
+	}
+	for i := range want {
+		if labels[i] != want[i] {
+			t.Errorf("label %d = %q, want %q", i, labels[i], want[i])
+		}
+	}
+}
+
+func TestRepetitionTodayResetsOvernight(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	mustExec(t, db, "INSERT INTO users (id, time_zone) VALUES (1, 'UTC')")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES (1, 1, 'Words')")
+	mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role, max_reviews_per_day) VALUES (1, 1, 'owner', 0)")
+	mustExec(t, db, "INSERT INTO cards (id, deck_id, front, back) VALUES (1, 1, '[]', '[]')")
+	// Failed twice the day before yesterday and due again
+	mustExec(t, db, `INSERT INTO card_progress (user_id, card_id, repetition_today, last_review, next_repetition)
+ VALUES (1, 1, 2, NOW() - INTERVAL '2 days', NOW() - INTERVAL '1 hour')`)
+
+	check := func(wantRepetitionToday int, wantReviewable bool) {
+		t.Helper()
+		var card struct {
+			RepetitionToday int  `db:"repetition_today"`
+			Reviewable      bool `db:"reviewable"`
+		}
+		err := db.Get(&card, `SELECT
+ repetition_today,
+ EXISTS(SELECT 1 FROM reviewable_cards WHERE user_id=1 AND id=1) AS reviewable
+FROM member_cards WHERE user_id=1 AND id=1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card.RepetitionToday != wantRepetitionToday || card.Reviewable != wantReviewable {
+			t.Errorf("card has repetition_today %d and reviewable %v, want %d and %v", card.RepetitionToday, card.Reviewable, wantRepetitionToday, wantReviewable)
+		}
+	}
+	// Yesterday's repetitions don't get around the limit of 0 reviews
+	check(0, false)
+	// Today's do
+	mustExec(t, db, "UPDATE card_progress SET last_review=NOW() WHERE user_id=1 AND card_id=1")
+	check(2, true)
+}
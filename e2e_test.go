@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// newTestDB sets up a new schema with all migrations applied.
+func newTestDB(t *testing.T) {
+	db := newTestSchema(t)
+	if _, err := MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testChat talks to the bot as one user, through the webhook.
+type testChat struct {
+	t      *testing.T
+	m      *RecordingMessenger
+	userID int
+	nextID int
+}
+
+// newTestChat sets up a migrated test database and a user to talk to the bot,
+// which replies through a RecordingMessenger without pausing.
+func newTestChat(t *testing.T, userID int) *testChat {
+	newTestDB(t)
+	m := &RecordingMessenger{BotUserName: "TestBot"}
+	oldMessenger := DefaultMessenger
+	DefaultMessenger = m
+	pause = func(time.Duration) {}
+	t.Cleanup(func() {
+		DefaultMessenger = oldMessenger
+		pause = time.Sleep
+	})
+	return &testChat{t: t, m: m, userID: userID}
+}
+
+// send posts the message to the webhook, waits until it's handled and checks
+// the texts the bot sent back.
+func (c *testChat) send(msg tgbotapi.Message, want ...string) {
+	c.t.Helper()
+	c.nextID++
+	msg.MessageID = c.nextID
+	msg.From = &tgbotapi.User{ID: c.userID, FirstName: "Test"}
+	msg.Chat = &tgbotapi.Chat{ID: int64(c.userID), Type: "private"}
+	msg.Date = int(time.Now().Unix())
+	body, err := json.Marshal(tgbotapi.Update{UpdateID: c.nextID, Message: &msg})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.m.Reset()
+	w := httptest.NewRecorder()
+	handleTelegramWebhook(w, httptest.NewRequest("POST", "/telegram/webhook/token", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		c.t.Fatalf("webhook responded %d", w.Code)
+	}
+	handling.Wait()
+
+	got := c.m.Texts()
+	if len(got) != len(want) {
+		c.t.Fatalf("after %q the bot sent\n%q\nwant\n%q", msg.Text, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			c.t.Errorf("after %q message %d is %q, want %q", msg.Text, i, got[i], want[i])
+		}
+	}
+}
+
+func (c *testChat) say(text string, want ...string) {
+	c.t.Helper()
+	c.send(tgbotapi.Message{Text: text}, want...)
+}
+
+// start sends /start, which shows the help and asks for the time zone.
+func (c *testChat) start() {
+	c.t.Helper()
+	help := &RecordingMessenger{}
+	HelpUser(help, int64(c.userID))
+	want := append([]string{"Hi there!"}, help.Texts()...)
+	want = append(want, "Now, to get started please send me your location, so I can determine your time zone! 🌍 If you'd rather not, type the name of your city or time zone, or your UTC offset like 'UTC+2'.")
+	c.say("/start", want...)
+}
+
+func TestOnboarding(t *testing.T) {
+	c := newTestChat(t, 1)
+	c.start()
+
+	c.say("Amsterdam",
+		"Got it! You're in the 'Europe/Amsterdam' time zone.",
+		"Every day at noon you will get sent your flash cards if there's any that need rehearsing. You can change the time of rehearsal in your /settings.",
+		fmt.Sprintf("You're now ready to create your first deck, so press '%s' to get started.", AddDeck),
+	)
+
+	var u User
+	if err := DB.Get(&u, "SELECT * FROM users WHERE id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if u.TimeZone != "Europe/Amsterdam" || !u.Scheduled || u.State != DeckList {
+		t.Errorf("user after onboarding has time zone %s, scheduled %v and state %s", u.TimeZone, u.Scheduled, u.State)
+	}
+}
+
+func TestOnboardingWithLocation(t *testing.T) {
+	c := newTestChat(t, 1)
+	c.start()
+
+	// Resolved offline, so it has to be checked by the user
+	offset, _ := timeZoneOffset("Europe/Amsterdam", time.Now())
+	c.send(tgbotapi.Message{Location: &tgbotapi.Location{Latitude: 52.37, Longitude: 4.89}},
+		fmt.Sprintf("Your location looks like it's in the 'Europe/Amsterdam' time zone (%s). Not right? Type the name of your city to pick another one.", formatUTCOffset(offset)),
+	)
+	c.say("Brussels",
+		"Got it! You're in the 'Europe/Brussels' time zone.",
+		"Every day at noon you will get sent your flash cards if there's any that need rehearsing. You can change the time of rehearsal in your /settings.",
+		fmt.Sprintf("You're now ready to create your first deck, so press '%s' to get started.", AddDeck),
+	)
+}
+
+// addDeckWithCard goes from the deck list to a deck with one card in it.
+func addDeckWithCard(c *testChat) {
+	c.t.Helper()
+	c.say(AddDeck, "What's the name of the new deck?")
+	c.say("Words",
+		"Deck 'Words' has been created!",
+		fmt.Sprintf("You currently have no cards, so press '%s' to create one.", AddCard),
+	)
+	c.say(AddCard, "Please send a message to use for the front.")
+	c.say("hond", "Please send a message to use for the back.")
+	c.say("dog",
+		"Card created",
+		"1/1 cards left to rehearse in 'Words'",
+		"hond",
+	)
+}
+
+func TestAddDeckAndCard(t *testing.T) {
+	c := newTestChat(t, 1)
+	addDeckWithCard(c)
+
+	var cards []Card
+	err := DB.Select(&cards, "SELECT c.* FROM member_cards c INNER JOIN decks d ON d.id = c.deck_id WHERE d.name='Words' AND c.user_id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 || !cards[0].IsNew {
+		t.Fatalf("deck has cards %+v, want one new card", cards)
+	}
+	if front, err := cards[0].GetFront(); err != nil || len(front) != 1 || front[0].Text != "hond" {
+		t.Errorf("front of the card is %+v, %v", front, err)
+	}
+}
+
+func TestRehearseAndAnswer(t *testing.T) {
+	c := newTestChat(t, 1)
+	addDeckWithCard(c)
+
+	c.say(ShowReverseOfCard, "dog")
+	c.say(Difficulty3, "💯", "No more cards to review today.")
+
+	// The buttons of the card stay around after it's done
+	c.say(BuryCard, "No card to skip", "No more cards to review today.")
+	c.say(EditCard, "No card to edit", "No more cards to review today.")
+
+	var reviewed bool
+	if err := DB.Get(&reviewed, "SELECT last_review IS NOT NULL FROM card_progress WHERE user_id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if !reviewed {
+		t.Error("the answer wasn't recorded")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bouk/memorizationbot/action"
+	"github.com/bouk/memorizationbot/sm"
+	"github.com/getsentry/raven-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// A Telegram group that gets quizzed on a shared deck every day
+type GroupChat struct {
+	ID        int64     `db:"id"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+	DeckID    int       `db:"deck_id"`
+	TimeZone  string    `db:"time_zone"`
+	QuizTime  time.Time `db:"quiz_time"`
+	QuizSize  int16     `db:"quiz_size"`
+	NextQuiz  time.Time `db:"next_quiz"`
+
+	// The quiz currently going on
+	QuizStartedAt time.Time     `db:"quiz_started_at"`
+	QuizCardID    sql.NullInt64 `db:"quiz_card_id"`
+	QuizRevealed  bool          `db:"quiz_revealed"`
+	QuizRemaining int16         `db:"quiz_remaining"`
+
+	// Who linked the deck, who can change the quiz along with the group admins
+	LinkedBy sql.NullInt64 `db:"linked_by"`
+}
+
+type LeaderboardEntry struct {
+	Name     string `db:"name"`
+	Correct  int    `db:"correct"`
+	Answered int    `db:"answered"`
+}
+
+func GetGroupChat(tx *sqlx.Tx, id int64) (*GroupChat, error) {
+	var g GroupChat
+	err := tx.Get(&g, "SELECT * FROM group_chats WHERE id=$1 FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else {
+		return &g, err
+	}
+}
+
+// LinkGroupChat links the group to the deck of the invite code, taking over the
+// time zone of the user that linked it. Returns nil if the code doesn't exist or
+// has expired.
+func LinkGroupChat(tx *sqlx.Tx, id int64, code string, u *User) (*GroupChat, error) {
+	var g GroupChat
+	err := tx.Get(&g, `INSERT INTO group_chats (id, deck_id, time_zone, linked_by)
+ SELECT $1, deck_id, $3, $4 FROM deck_invites WHERE code=$2 AND expires_at > NOW()
+ ON CONFLICT (id) DO UPDATE SET deck_id=EXCLUDED.deck_id, linked_by=EXCLUDED.linked_by, quiz_card_id=NULL, quiz_remaining=0
+ RETURNING *`, id, code, u.TimeZone, u.ID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else {
+		return &g, err
+	}
+}
+
+// CanManage returns whether the user can link another deck, unlink it or
+// change the quiz time: the one who linked the deck and the admins of the group.
+func (g *GroupChat) CanManage(m Messenger, userID int) (bool, error) {
+	if g.LinkedBy.Valid && g.LinkedBy.Int64 == int64(userID) {
+		return true, nil
+	}
+	member, err := m.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: g.ID, UserID: userID})
+	if err != nil {
+		return false, err
+	}
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
+
+func (g *GroupChat) Unlink(tx *sqlx.Tx) error {
+	_, err := tx.Exec("DELETE FROM group_chats WHERE id=$1", g.ID)
+	return err
+}
+
+func (g *GroupChat) SetQuizTime(tx *sqlx.Tx, t time.Time) error {
+	return tx.Get(g, "UPDATE group_chats SET quiz_time=$1 WHERE id=$2 RETURNING *", t.Format(TimeFormat), g.ID)
+}
+
+func (g *GroupChat) send(m Messenger, format string, data ...interface{}) (tgbotapi.Message, error) {
+	return m.Send(tgbotapi.NewMessage(g.ID, fmt.Sprintf(format, data...)))
+}
+
+// StartQuiz starts a new quiz and sends the first card.
+func (g *GroupChat) StartQuiz(m Messenger, tx *sqlx.Tx) error {
+	err := tx.Get(g, "UPDATE group_chats SET quiz_started_at=NOW(), quiz_remaining=quiz_size, quiz_card_id=NULL WHERE id=$1 RETURNING *", g.ID)
+	if err != nil {
+		return err
+	}
+	g.send(m, "Time for the group quiz! Everyone rates themselves on each card and their own schedule gets updated.")
+	return g.NextCard(m, tx)
+}
+
+// NextCard sends the card that was quizzed the longest ago, or the leaderboard
+// if the quiz is over.
+func (g *GroupChat) NextCard(m Messenger, tx *sqlx.Tx) error {
+	if g.QuizRemaining <= 0 {
+		return g.FinishQuiz(m, tx)
+	}
+
+	var cardID int
+	err := tx.Get(&cardID, `SELECT c.id
+FROM cards c
+LEFT JOIN group_quiz_cards q ON q.chat_id=$1 AND q.card_id=c.id
+WHERE c.deck_id=$2
+ORDER BY
+ q.quizzed_at ASC NULLS FIRST,
+ c.random_order ASC
+LIMIT 1`, g.ID, g.DeckID)
+	if err == sql.ErrNoRows {
+		g.send(m, "The deck doesn't have any cards yet.")
+		return g.FinishQuiz(m, tx)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO group_quiz_cards (chat_id, card_id) VALUES ($1, $2)
+ ON CONFLICT (chat_id, card_id) DO UPDATE SET quizzed_at=NOW()`, g.ID, cardID)
+	if err != nil {
+		return err
+	}
+	err = tx.Get(g, "UPDATE group_chats SET quiz_card_id=$1, quiz_revealed=FALSE, quiz_remaining=quiz_remaining-1 WHERE id=$2 RETURNING *", cardID, g.ID)
+	if err != nil {
+		return err
+	}
+
+	card, err := GetCardContent(tx, cardID)
+	if err != nil {
+		return err
+	}
+	return card.SendFront(m, g.ID, tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(ShowReverseOfCard, callbackData(action.GroupShowBack, cardID)),
+		),
+	))
+}
+
+// RevealCard sends the back of the current card once, along with the buttons to answer.
+func (g *GroupChat) RevealCard(m Messenger, tx *sqlx.Tx, cardID int) error {
+	if g.QuizRevealed || !g.IsQuizzing(cardID) {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE group_chats SET quiz_revealed=TRUE WHERE id=$1", g.ID); err != nil {
+		return err
+	}
+	card, err := GetCardContent(tx, cardID)
+	if err != nil {
+		return err
+	}
+	return card.SendBack(m, g.ID, tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(Difficulty0, callbackData(action.GroupAnswer, cardID, 0)),
+			tgbotapi.NewInlineKeyboardButtonData(Difficulty1, callbackData(action.GroupAnswer, cardID, 1)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(Difficulty2, callbackData(action.GroupAnswer, cardID, 2)),
+			tgbotapi.NewInlineKeyboardButtonData(Difficulty3, callbackData(action.GroupAnswer, cardID, 3)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(Next, callbackData(action.GroupNext, cardID)),
+		),
+	))
+}
+
+// Answer records the answer of a group member for the leaderboard and updates
+// their own progress on the card, making them a member of the deck if needed.
+// The deck isn't scheduled for new members, they only get quizzed in the group
+// unless they turn on rehearsals for it themselves. Returns false if the card
+// isn't the one being quizzed, or if they already answered it during the quiz.
+func (g *GroupChat) Answer(c *Context, cardID int, name string, quality int16) (bool, error) {
+	if !g.IsQuizzing(cardID) {
+		return false, nil
+	}
+	_, err := c.tx.Exec("INSERT INTO deck_members (deck_id, user_id, role, scheduled) VALUES ($1, $2, $3, FALSE) ON CONFLICT DO NOTHING", g.DeckID, c.u.ID, Viewer)
+	if err != nil {
+		return false, err
+	}
+	card, err := GetCard(c.tx, c.u.ID, cardID)
+	if err != nil || card == nil || card.DeckID != g.DeckID {
+		return false, err
+	}
+	result, err := c.tx.Exec(`INSERT INTO group_answers (chat_id, quiz_started_at, card_id, user_id, name, quality)
+ VALUES ($1, $2, $3, $4, $5, $6)
+ ON CONFLICT DO NOTHING`, g.ID, g.QuizStartedAt, cardID, c.u.ID, name, quality)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, card.Respond(c, quality)
+}
+
+// IsQuizzing returns whether the card is the one currently being quizzed.
+func (g *GroupChat) IsQuizzing(cardID int) bool {
+	return g.QuizCardID.Valid && g.QuizCardID.Int64 == int64(cardID)
+}
+
+func (g *GroupChat) GetLeaderboard(tx *sqlx.Tx) ([]LeaderboardEntry, error) {
+	entries := []LeaderboardEntry{}
+	err := tx.Select(&entries, `SELECT
+ MAX(name) AS name,
+ COUNT(CASE WHEN quality >= $3 THEN TRUE END) AS correct,
+ COUNT(*) AS answered
+FROM group_answers
+WHERE chat_id=$1 AND quiz_started_at=$2
+GROUP BY user_id
+ORDER BY correct DESC, answered DESC`, g.ID, g.QuizStartedAt, sm.SM2Mod.PassQuality())
+	return entries, err
+}
+
+func (g *GroupChat) FinishQuiz(m Messenger, tx *sqlx.Tx) error {
+	err := tx.Get(g, "UPDATE group_chats SET quiz_card_id=NULL, quiz_remaining=0 WHERE id=$1 RETURNING *", g.ID)
+	if err != nil {
+		return err
+	}
+	entries, err := g.GetLeaderboard(tx)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		g.send(m, "That's it for today! Nobody answered this time.")
+		return nil
+	}
+	lines := []string{"That's it for today! 🏆"}
+	for i, entry := range entries {
+		lines = append(lines, fmt.Sprintf("%d. %s: %d/%d", i+1, entry.Name, entry.Correct, entry.Answered))
+	}
+	g.send(m, "%s", strings.Join(lines, "\n"))
+	return nil
+}
+
+func WithGroupChat(id int64, f func(*GroupChat, *sqlx.Tx) error) error {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	g, err := GetGroupChat(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = f(g, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func HandleGroupMessage(m Messenger, log *logrus.Entry, msg *tgbotapi.Message) {
+	start := time.Now()
+	err := WithGroupChat(msg.Chat.ID, func(g *GroupChat, tx *sqlx.Tx) error {
+		reply := func(format string, data ...interface{}) {
+			m.Send(tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf(format, data...)))
+		}
+
+		// Whether the sender can change how the group gets quizzed
+		canManage := func() (bool, error) {
+			can, err := g.CanManage(m, msg.From.ID)
+			if err == nil && !can {
+				reply("Only the person that linked the deck and admins of the group can do that.")
+			}
+			return can, err
+		}
+
+		switch msg.Command() {
+		case "start", "help":
+			reply("Share a deck with me and send /link with the code from the share link to get quizzed on it every day. Use /quiztime to pick the time of the quiz, /quiz to start one right away and /unlink to stop.")
+		case "link":
+			if g != nil {
+				if can, err := canManage(); err != nil || !can {
+					return err
+				}
+			}
+			var u User
+			err := tx.Get(&u, "SELECT * FROM users WHERE id=$1", msg.From.ID)
+			if err == sql.ErrNoRows {
+				reply("Please talk to me in private first, so I know your time zone.")
+				return nil
+			} else if err != nil {
+				return err
+			}
+			code := msg.CommandArguments()
+			if i := strings.LastIndex(code, "start="); i != -1 {
+				code = code[i+len("start="):]
+			}
+			g, err = LinkGroupChat(tx, msg.Chat.ID, strings.TrimSpace(code), &u)
+			if err != nil {
+				return err
+			}
+			if g == nil {
+				reply("I don't know that deck, please check the link. Links stop working after 30 days.")
+				return nil
+			}
+			reply("Linked! I'll quiz you every day at %s (%s).", g.QuizTime.Format(TimeFormat), g.TimeZone)
+		case "unlink":
+			if g == nil {
+				return nil
+			}
+			if can, err := canManage(); err != nil || !can {
+				return err
+			}
+			reply("I won't quiz you anymore.")
+			return g.Unlink(tx)
+		case "quiztime":
+			if g == nil {
+				reply("Please /link a deck first.")
+				return nil
+			}
+			if can, err := canManage(); err != nil || !can {
+				return err
+			}
+			t, err := time.Parse(TimeFormat, strings.TrimSpace(msg.CommandArguments()))
+			if err != nil {
+				reply("Please send the time like this: /quiztime 09:00")
+				return nil
+			}
+			if err = g.SetQuizTime(tx, t); err != nil {
+				return err
+			}
+			reply("Quiz time changed to '%s'", t.Format(TimeFormat))
+		case "quiz":
+			if g == nil {
+				reply("Please /link a deck first.")
+				return nil
+			}
+			return g.StartQuiz(m, tx)
+		}
+		return nil
+	})
+	observeHandler(groupHandler, start, err)
+	if err != nil {
+		handlingFailed(m, log, msg.Chat.ID, "handling group message failed", err)
+	}
+}
+
+func HandleGroupCallbackQuery(m Messenger, log *logrus.Entry, callback *tgbotapi.CallbackQuery) {
+	start := time.Now()
+	parts := strings.Split(callback.Data, ":")
+	if len(parts) < 2 || callback.Message == nil {
+		return
+	}
+	log = log.WithFields(logrus.Fields{"chat_id": callback.Message.Chat.ID, "user_id": callback.From.ID})
+	cardID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	chatID := callback.Message.Chat.ID
+	answer := ""
+
+	switch parts[0] {
+	case action.GroupShowBack, action.GroupNext:
+		err = WithGroupChat(chatID, func(g *GroupChat, tx *sqlx.Tx) error {
+			if g == nil {
+				return nil
+			}
+			if parts[0] == action.GroupShowBack {
+				return g.RevealCard(m, tx, cardID)
+			}
+			if g.IsQuizzing(cardID) {
+				return g.NextCard(m, tx)
+			}
+			return nil
+		})
+	case action.GroupAnswer:
+		if len(parts) < 3 {
+			return
+		}
+		quality, parseErr := strconv.ParseInt(parts[2], 10, 16)
+		if parseErr != nil || quality < 0 || quality > 3 {
+			return
+		}
+		err = WithUser(log, callback.From.ID, func(u *User, tx *sqlx.Tx) error {
+			var g GroupChat
+			if err := tx.Get(&g, "SELECT * FROM group_chats WHERE id=$1", chatID); err == sql.ErrNoRows {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			c := &Context{
+				from: int64(u.ID),
+				tx:   tx,
+				u:    u,
+				m:    m,
+				log:  log,
+			}
+			if !g.IsQuizzing(cardID) {
+				answer = "That card isn't being quizzed anymore."
+				return nil
+			}
+			answered, err := g.Answer(c, cardID, callback.From.FirstName, int16(quality))
+			if err != nil {
+				return err
+			}
+			answer = stringTernary(answered, "Got it!", "You already answered this one.")
+			return nil
+		})
+	}
+
+	observeHandler(groupHandler, start, err)
+	if err != nil {
+		err = safeError(err)
+		log.WithError(err).Error("handling group callback query failed")
+		raven.CaptureError(err, map[string]string{"trace_id": traceID(log)})
+	}
+	m.AnswerCallbackQuery(tgbotapi.NewCallback(callback.ID, answer))
+}
+
+func pollGroupQuizzes(m Messenger) (bool, error) {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	chatIDs := []int64{}
+	err = tx.Select(&chatIDs, "SELECT chat_id FROM scheduled_group_quizzes()")
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	pollerBatchSize.WithLabelValues("group_quizzes").Observe(float64(len(chatIDs)))
+	log := newTrace()
+	for _, chatID := range chatIDs {
+		if err := WithGroupChat(chatID, func(g *GroupChat, tx *sqlx.Tx) error {
+			if g == nil {
+				return nil
+			}
+			return g.StartQuiz(m, tx)
+		}); err != nil {
+			log.WithField("chat_id", chatID).WithError(err).Error("starting group quiz failed")
+			raven.CaptureError(err, nil)
+		}
+	}
+	if len(chatIDs) > 0 {
+		log.WithField("count", len(chatIDs)).Info("started group quizzes")
+	}
+	return len(chatIDs) > 0, nil
+}
+
+func callbackData(a string, args ...int) string {
+	data := a
+	for _, arg := range args {
+		data += ":" + strconv.Itoa(arg)
+	}
+	return data
+}
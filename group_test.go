@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestGroupAnswer(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	mustExec(t, db, "INSERT INTO users (id) VALUES (1), (2)")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES (1, 1, 'Words')")
+	mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role) VALUES (1, 1, 'owner')")
+	mustExec(t, db, "INSERT INTO cards (id, deck_id, front, back) VALUES (1, 1, '[{\"t\":0,\"c\":\"hond\"}]', '[{\"t\":0,\"c\":\"dog\"}]')")
+	mustExec(t, db, "INSERT INTO cards (id, deck_id, front, back) VALUES (2, 1, '[]', '[]')")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES (2, 2, 'Secret')")
+	mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role) VALUES (2, 2, 'owner')")
+	mustExec(t, db, "INSERT INTO cards (id, deck_id, front, back) VALUES (3, 2, '[]', '[]')")
+	mustExec(t, db, "INSERT INTO group_chats (id, deck_id, quiz_card_id) VALUES (-100, 1, 1)")
+
+	answer := func(userID int, cardID int, name string, quality int16) bool {
+		t.Helper()
+		var answered bool
+		err := WithUser(Log.WithField("test", t.Name()), userID, func(u *User, tx *sqlx.Tx) error {
+			g, err := GetGroupChat(tx, -100)
+			if err != nil {
+				return err
+			}
+			c := &Context{u: u, tx: tx, from: int64(u.ID), m: &RecordingMessenger{}, log: Log.WithField("test", t.Name())}
+			answered, err = g.Answer(c, cardID, name, quality)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return answered
+	}
+
+	if !answer(1, 1, "Owner", 3) {
+		t.Error("first answer of the owner wasn't recorded")
+	}
+	if !answer(2, 1, "Friend", 1) {
+		t.Error("first answer of someone new wasn't recorded")
+	}
+	if answer(2, 1, "Friend", 3) {
+		t.Error("second answer to the same card was recorded")
+	}
+	// Buttons of earlier cards, and cards of other decks, don't count
+	if answer(1, 2, "Owner", 3) {
+		t.Error("answer to a card that isn't being quizzed was recorded")
+	}
+	mustExec(t, db, "UPDATE group_chats SET quiz_card_id=3 WHERE id=-100")
+	if answer(2, 3, "Friend", 3) {
+		t.Error("answer to a card of another deck was recorded")
+	}
+	mustExec(t, db, "UPDATE group_chats SET quiz_card_id=1 WHERE id=-100")
+
+	// Answering in the group doesn't sign people up for rehearsals of the deck
+	var scheduled bool
+	if err := db.Get(&scheduled, "SELECT scheduled FROM deck_members WHERE deck_id=1 AND user_id=2"); err != nil {
+		t.Fatal(err)
+	}
+	if scheduled {
+		t.Error("the deck is scheduled for someone who only answered in the group")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	g, err := GetGroupChat(tx, -100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := g.GetLeaderboard(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LeaderboardEntry{{"Owner", 1, 1}, {"Friend", 0, 1}}
+	if len(entries) != len(want) || entries[0] != want[0] || entries[1] != want[1] {
+		t.Errorf("leaderboard = %+v, want %+v", entries, want)
+	}
+}
+
+func TestGroupCanManage(t *testing.T) {
+	m := &RecordingMessenger{Admins: []int{3}}
+	g := &GroupChat{ID: -100, LinkedBy: sql.NullInt64{Int64: 1, Valid: true}}
+	tests := []struct {
+		userID int
+		want   bool
+	}{
+		{1, true},  // linked the deck
+		{2, false}, // just a member
+		{3, true},  // admin
+	}
+	for _, test := range tests {
+		if can, err := g.CanManage(m, test.userID); err != nil || can != test.want {
+			t.Errorf("CanManage(%d) = %v, %v, want %v", test.userID, can, err, test.want)
+		}
+	}
+
+	// Whoever linked a group before it was recorded is treated like a member
+	g.LinkedBy = sql.NullInt64{}
+	if can, err := g.CanManage(m, 1); err != nil || can {
+		t.Errorf("CanManage without linked_by = %v, %v, want false", can, err)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"sync"
 
 	"gopkg.in/telegram-bot-api.v4"
 )
@@ -17,16 +19,60 @@ func handleTelegramWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !handleUpdate(DefaultMessenger, update) {
+		http.Error(w, "unknown body", http.StatusBadRequest)
+		return
+	}
+}
+
+// handleUpdate dispatches an update in the background, whether it came in through
+// the webhook or through long polling, replying through m. It returns false for
+// unknown updates.
+func handleUpdate(m Messenger, update tgbotapi.Update) bool {
+	log := traceUpdate(update)
+	updatesReceived.WithLabelValues(updateType(update)).Inc()
 	if update.CallbackQuery != nil {
-		go HandleCallbackQuery(update.CallbackQuery)
+		inBackground(func() { HandleCallbackQuery(m, log, update.CallbackQuery) })
 	} else if update.ChosenInlineResult != nil {
-		go HandleChosenInlineResult(update.ChosenInlineResult)
+		inBackground(func() { HandleChosenInlineResult(update.ChosenInlineResult) })
 	} else if update.InlineQuery != nil {
-		go HandleInlineQuery(update.InlineQuery)
+		inBackground(func() { HandleInlineQuery(update.InlineQuery) })
 	} else if update.Message != nil {
-		go HandleMessage(update.Message)
+		inBackground(func() { HandleMessageWith(m, log, update.Message) })
 	} else {
-		http.Error(w, "unknown body", http.StatusBadRequest)
-		return
+		log.Warn("unknown update")
+		return false
+	}
+	return true
+}
+
+// handling counts the updates that are still being handled in the background,
+// so tests can wait for them.
+var handling sync.WaitGroup
+
+func inBackground(f func()) {
+	handling.Add(1)
+	go func() {
+		defer handling.Done()
+		f()
+	}()
+}
+
+// pollUpdates gets updates with long polling instead of the webhook, which works
+// without a public hostname or TLS. It removes the webhook, since Telegram doesn't
+// allow both. It only returns when polling fails, and then always with an error.
+func pollUpdates() error {
+	if _, err := BotAPI.RemoveWebhook(); err != nil {
+		return err
+	}
+	config := tgbotapi.NewUpdate(0)
+	config.Timeout = 60
+	updates, err := BotAPI.GetUpdatesChan(config)
+	if err != nil {
+		return err
+	}
+	for update := range updates {
+		handleUpdate(DefaultMessenger, update)
 	}
+	return errors.New("the updates channel closed")
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/getsentry/raven-go"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Log is what everything logs through. The work for an update or a run of the
+// poller gets its own entry with a trace_id, so all of its lines can be found
+// together, and update_id, user_id, state and duration where they're known.
+//
+// Never log what users send, it's their cards. describeMessage leaves it out.
+var Log = logrus.New()
+
+// setupLogging sets the level and format, 'text' or 'json', and sends what the
+// standard logger gets, like from libraries, through Log too.
+func setupLogging(level, format string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Log.SetLevel(l)
+	switch format {
+	case "text":
+		Log.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		Log.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(Log.WriterLevel(logrus.InfoLevel))
+	return nil
+}
+
+// newTrace starts the log entry for one piece of work.
+func newTrace() *logrus.Entry {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return Log.WithField("trace_id", hex.EncodeToString(b))
+}
+
+// traceID returns the trace_id of the entry, see newTrace.
+func traceID(log *logrus.Entry) string {
+	id, _ := log.Data["trace_id"].(string)
+	return id
+}
+
+// safeError returns what's safe to log and report about an error. Errors from
+// Postgres can quote the values of a query, which are what users sent, so only
+// their code and what they're about are kept.
+func safeError(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return err
+	}
+	s := fmt.Sprintf("pq: %s (%s)", pqErr.Code.Name(), pqErr.Code)
+	if pqErr.Table != "" {
+		s += " on table " + pqErr.Table
+	}
+	if pqErr.Column != "" {
+		s += " column " + pqErr.Column
+	}
+	if pqErr.Constraint != "" {
+		s += " constraint " + pqErr.Constraint
+	}
+	return fmt.Errorf("%s", s)
+}
+
+// handlingFailed logs and reports what's safe about an error that stopped a
+// message from being handled, and tells the chat with the trace_id to look for.
+func handlingFailed(m Messenger, log *logrus.Entry, chatID int64, message string, err error) {
+	err = safeError(err)
+	log.WithError(err).Error(message)
+	raven.CaptureError(err, map[string]string{"trace_id": traceID(log)})
+	m.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, something went wrong on my end. If it keeps happening, please report it along with this code: %s", traceID(log))))
+}
+
+// traceUpdate starts the log entry for an update from Telegram.
+func traceUpdate(update tgbotapi.Update) *logrus.Entry {
+	return newTrace().WithField("update_id", update.UpdateID)
+}
+
+// describeMessage returns what's safe to log about a message: who sent it where,
+// what kind it is and the command, but not the text or any of the media.
+func describeMessage(msg *tgbotapi.Message) logrus.Fields {
+	fields := logrus.Fields{
+		"chat_id":    msg.Chat.ID,
+		"message_id": msg.MessageID,
+		"kind":       messageKind(msg),
+	}
+	if msg.From != nil {
+		fields["user_id"] = msg.From.ID
+	}
+	if command := msg.Command(); command != "" {
+		fields["command"] = command
+	} else if msg.Text != "" {
+		fields["text_length"] = len(msg.Text)
+	}
+	return fields
+}
+
+func messageKind(msg *tgbotapi.Message) string {
+	switch {
+	case msg.IsCommand():
+		return "command"
+	case msg.Text != "":
+		return "text"
+	case msg.Photo != nil:
+		return "photo"
+	case msg.Sticker != nil:
+		return "sticker"
+	case msg.Voice != nil:
+		return "voice"
+	case msg.Audio != nil:
+		return "audio"
+	case msg.Video != nil:
+		return "video"
+	case msg.Document != nil:
+		return "document"
+	case msg.Location != nil:
+		return "location"
+	}
+	return "other"
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestSafeError(t *testing.T) {
+	err := safeError(&pq.Error{
+		Code:       "23505",
+		Message:    `duplicate key value violates unique constraint "decks_user_id_name_key"`,
+		Detail:     "Key (user_id, name)=(1, my secret deck) already exists.",
+		Table:      "decks",
+		Constraint: "decks_user_id_name_key",
+	})
+	want := "pq: unique_violation (23505) on table decks constraint decks_user_id_name_key"
+	if err.Error() != want {
+		t.Errorf("safeError = %q, want %q", err, want)
+	}
+
+	other := errors.New("no such deck")
+	if safeError(other) != other {
+		t.Error("safeError changed an error that isn't from Postgres")
+	}
+}
+
+func TestHandlingFailed(t *testing.T) {
+	m := &RecordingMessenger{}
+	log := newTrace()
+	handlingFailed(m, log, 1, "handling message failed", &pq.Error{Code: "22P02", Message: `invalid input syntax for type integer: "my secret"`})
+
+	texts := m.Texts()
+	if len(texts) != 1 {
+		t.Fatalf("sent %q, want one message", texts)
+	}
+	if strings.Contains(texts[0], "secret") || !strings.Contains(texts[0], traceID(log)) {
+		t.Errorf("sent %q, want a message with only the trace_id %s", texts[0], traceID(log))
+	}
+}
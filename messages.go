@@ -9,15 +9,23 @@ const (
 	AddCard                    = "➕ New Card"
 	AddDeck                    = "➕ New Deck"
 	Back                       = "🔙"
+	BuryCard                   = "⏭ Skip for today"
 	ChangeLocation             = "🌍 Set location"
 	ChangeLocationFormat       = ChangeLocation + " (from %s)"
 	ConfirmDeleteDeck          = "🔥 Yes"
+	CramAll                    = "📚 All cards"
+	CramDeck                   = "📚 Cram"
+	CramFailed                 = "😣 Only forgotten cards"
 	DeleteCard                 = "🗑 Delete"
+	DayDisabledFormat          = "⬜️ %s"
+	DayEnabledFormat           = "✅ %s"
 	DeleteDeck                 = "🗑 Delete"
 	Difficulty0                = "😮 No idea"
 	Difficulty1                = "😣 Wrong"
 	Difficulty2                = "🙂 Recalled"
 	Difficulty3                = "☺️ Easy"
+	DisableReminders           = "🔕 Stop reminders"
+	DisableRoundRobin          = "📅 Most overdue deck first"
 	DisableScheduling          = "🙅 Disable rehearsal"
 	DontDeleteDeck             = "⛔️ No"
 	EditCard                   = "📝 Edit Card"
@@ -25,14 +33,59 @@ const (
 	EditCardFront              = "✏️ Edit Front"
 	EditDeck                   = "✏️ Edit Deck"
 	EditName                   = "✏️ Edit Name"
+	EditOrder                  = "🔀 Order"
 	EditSettings               = "🔧 Settings"
+	EndVacation                = "🏁 End vacation"
 	ChangeTimeToRehearse       = "🕙 Set rehearsal time"
 	ChangeTimeToRehearseFormat = ChangeTimeToRehearse + " (from %s)"
+	EnableReminders            = "🔔 Send reminders"
+	EnableRoundRobin           = "🔁 Take turns between decks"
 	EnableScheduling           = "💁 Enable rehearsal"
 	Help                       = "🤔 Help"
+	LeaveDeck                  = "🚪 Leave"
+	LeechThreshold             = "🐛 Leech threshold"
+	LeechThresholdFormat       = LeechThreshold + " (%d)"
+	Leeches                    = "🐛 Leeches"
+	LeechesFormat              = Leeches + " (%d)"
+	LearningSteps              = "⏱ Learning steps"
+	LearningStepsFormat        = LearningSteps + " (%s)"
+	MaxReviewsPerDay           = "🔁 Reviews per day"
+	MaxReviewsPerDayFormat     = MaxReviewsPerDay + " (%d)"
+	NewCardsAfter              = "🆕 New cards last"
+	NewCardsBefore             = "🆕 New cards first"
+	NewCardsMixedIn            = "🆕 New cards mixed in"
+	NewCardsPerDay             = "🆕 New cards per day"
+	NewCardsPerDayFormat       = NewCardsPerDay + " (%d)"
+	Next                       = "➡️ Next"
+	NotALeech                  = "🩹 Not a leech"
 	OK                         = "🆗"
+	OrderByDue                 = "📅 Oldest first"
+	OrderByEase                = "😓 Hardest first"
+	OrderRandomly              = "🎲 Random"
+	Previous                   = "⬅️ Previous"
+	QuietHours                 = "🌙 Quiet hours"
+	QuietHoursFormat           = QuietHours + " (%s)"
+	RehearsalDays              = "📆 Rehearsal days"
+	RehearsalDaysFormat        = RehearsalDays + " (%s)"
+	RevokeInvites              = "🚫 Revoke links"
 	Save                       = "💾"
+	ShareDeck                  = "🔗 Share"
+	ShareEditable              = "✏️ Can edit"
+	ShareReadOnly              = "👀 Read-only"
 	ShowReverseOfCard          = "🔄 Show back"
+	SpreadBacklog              = "📦 Spread out backlog"
+	StartSession               = "🎯 Session"
+	SuspendCard                = "⏸ Suspend"
+	SuspendLeeches             = "⏸ Suspend leeches"
+	SuspendedCards             = "💤 Suspended"
+	SuspendedCardsFormat       = SuspendedCards + " (%d)"
+	TagLeeches                 = "🏷 Only tag leeches"
+	TimeZone                   = "🕰"
+	TimeZoneCorrect            = "👍 That's right"
+	TimeZoneFormat             = TimeZone + " %s (%s)"
+	UnsuspendCard              = "▶️ Unsuspend"
+	Vacation                   = "🏖 Vacation"
+	VacationFormat             = Vacation + " (until %s)"
 )
 
 var (
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Messenger is how the bot talks to Telegram. Everything that sends gets one
+// passed in, so tests can run it against a RecordingMessenger instead.
+type Messenger interface {
+	// Send sends messages, photos and everything else, and edits them too
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error)
+	// UserName is the user name of the bot, used in links to it
+	UserName() string
+	// GetChatMember tells whether someone is an admin of a group
+	GetChatMember(config tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error)
+}
+
+// DefaultMessenger is the BotMessenger set up by connect, which the webhook, long
+// polling and the poller are started with.
+var DefaultMessenger Messenger
+
+// BotMessenger sends everything through the Telegram Bot API.
+type BotMessenger struct {
+	bot *tgbotapi.BotAPI
+}
+
+func NewBotMessenger(bot *tgbotapi.BotAPI) *BotMessenger {
+	return &BotMessenger{bot}
+}
+
+func (m *BotMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	message, err := m.bot.Send(c)
+	if err != nil {
+		sendFailures.WithLabelValues(chattableType(c)).Inc()
+	}
+	return message, err
+}
+
+func (m *BotMessenger) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	response, err := m.bot.AnswerCallbackQuery(config)
+	if err != nil {
+		sendFailures.WithLabelValues("callback").Inc()
+	}
+	return response, err
+}
+
+func (m *BotMessenger) UserName() string {
+	return m.bot.Self.UserName
+}
+
+func (m *BotMessenger) GetChatMember(config tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error) {
+	return m.bot.GetChatMember(config)
+}
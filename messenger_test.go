@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// RecordingMessenger keeps everything that gets sent instead of sending it, for
+// tests of whole conversations.
+type RecordingMessenger struct {
+	// Returned by UserName
+	BotUserName string
+	// Users that GetChatMember says are admins of every group
+	Admins []int
+
+	mu        sync.Mutex
+	sent      []tgbotapi.Chattable
+	callbacks []tgbotapi.CallbackConfig
+	lastID    int
+}
+
+func (m *RecordingMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, c)
+	m.lastID++
+	message := tgbotapi.Message{MessageID: m.lastID}
+	if config, ok := c.(tgbotapi.MessageConfig); ok {
+		message.Text = config.Text
+		message.Chat = &tgbotapi.Chat{ID: config.ChatID}
+	}
+	return message, nil
+}
+
+func (m *RecordingMessenger) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.callbacks = append(m.callbacks, config)
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (m *RecordingMessenger) UserName() string {
+	return m.BotUserName
+}
+
+func (m *RecordingMessenger) GetChatMember(config tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error) {
+	member := tgbotapi.ChatMember{User: &tgbotapi.User{ID: config.UserID}, Status: "member"}
+	for _, id := range m.Admins {
+		if id == config.UserID {
+			member.Status = "administrator"
+		}
+	}
+	return member, nil
+}
+
+// Sent returns everything that was sent so far.
+func (m *RecordingMessenger) Sent() []tgbotapi.Chattable {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]tgbotapi.Chattable(nil), m.sent...)
+}
+
+// Texts returns the text of every message that was sent so far, leaving out
+// photos and such.
+func (m *RecordingMessenger) Texts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	texts := make([]string, 0, len(m.sent))
+	for _, c := range m.sent {
+		if config, ok := c.(tgbotapi.MessageConfig); ok {
+			texts = append(texts, config.Text)
+		}
+	}
+	return texts
+}
+
+// Callbacks returns the answers to callback queries so far.
+func (m *RecordingMessenger) Callbacks() []tgbotapi.CallbackConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]tgbotapi.CallbackConfig(nil), m.callbacks...)
+}
+
+// Reset forgets everything that was sent, so the next step of a conversation
+// can be checked on its own.
+func (m *RecordingMessenger) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+	m.callbacks = nil
+}
+
+func TestSendFront(t *testing.T) {
+	keyboard := tgbotapi.NewRemoveKeyboard(false)
+	tests := []struct {
+		name  string
+		front string
+		types []string
+	}{
+		{"text", `[{"t":0,"c":"hond"}]`, []string{"message"}},
+		{"photo with caption", `[{"t":1,"c":"flag","f":"photo-id"}]`, []string{"photo"}},
+		{"several", `[{"t":0,"c":"what's this?"},{"t":4,"f":"sticker-id"},{"t":7,"la":52.37,"lo":4.89}]`, []string{"message", "sticker", "location"}},
+		{"empty", `[]`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &RecordingMessenger{}
+			card := &Card{Front: types.JSONText(test.front)}
+			if err := card.SendFront(m, 42, keyboard); err != nil {
+				t.Fatal(err)
+			}
+			sent := m.Sent()
+			if len(sent) != len(test.types) {
+				t.Fatalf("sent %d messages, want %d", len(sent), len(test.types))
+			}
+			for i, c := range sent {
+				if typ := chattableType(c); typ != test.types[i] {
+					t.Errorf("message %d is a %s, want a %s", i, typ, test.types[i])
+				}
+				// Only the last message gets the keyboard
+				markup := reflect.ValueOf(c).FieldByName("ReplyMarkup").Interface()
+				if last := i == len(sent)-1; (markup != nil) != last {
+					t.Errorf("message %d has keyboard %v", i, markup)
+				}
+			}
+		})
+	}
+}
+
+func TestHelpUser(t *testing.T) {
+	var paused time.Duration
+	pause = func(d time.Duration) { paused += d }
+	defer func() { pause = time.Sleep }()
+
+	m := &RecordingMessenger{}
+	HelpUser(m, 42)
+	if texts := m.Texts(); len(texts) != 7 {
+		t.Errorf("sent %d messages, want 7", len(texts))
+	}
+	for _, c := range m.Sent() {
+		if chatID := c.(tgbotapi.MessageConfig).ChatID; chatID != 42 {
+			t.Errorf("sent to %d, want 42", chatID)
+		}
+	}
+	if paused != 24*time.Second {
+		t.Errorf("paused for %v, want 24s", paused)
+	}
+}
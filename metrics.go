@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Metrics for Prometheus, served on -metrics-addr. States are labeled with their
+// name, see State.String.
+var (
+	updatesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "memorizationbot_updates_received_total",
+		Help: "Updates received from Telegram, by type.",
+	}, []string{"type"})
+
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memorizationbot_handler_duration_seconds",
+		Help:    "How long handling a message took, by the state the user was in, or group for group chats.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"state"})
+
+	handlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "memorizationbot_handler_errors_total",
+		Help: "Messages that couldn't be handled, by the state the user was in, or group for group chats.",
+	}, []string{"state"})
+
+	sendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "memorizationbot_telegram_send_failures_total",
+		Help: "Requests to the Bot API that failed, by what was sent.",
+	}, []string{"type"})
+
+	pollerBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memorizationbot_poller_batch_size",
+		Help:    "How much the poller picked up at once, by kind.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 40},
+	}, []string{"kind"})
+
+	pollerLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "memorizationbot_poller_lag_seconds",
+		Help:    "How late rehearsals and learning reminders were sent.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	})
+
+	reviews = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "memorizationbot_reviews_total",
+		Help: "Cards reviewed, by quality and whether it was a review or a cram.",
+	}, []string{"quality", "mode"})
+
+	userTransactionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memorizationbot_user_transaction_duration_seconds",
+		Help:    "How long the transactions of WithUser took, by whether they were committed.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		updatesReceived,
+		handlerDuration,
+		handlerErrors,
+		sendFailures,
+		pollerBatchSize,
+		pollerLag,
+		reviews,
+		userTransactionDuration,
+	)
+}
+
+// createMetricsServer serves /metrics on its own address, so it doesn't end up
+// on the internet along with the webhook.
+func createMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:    MetricsAddr,
+		Handler: mux,
+	}
+}
+
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.ChosenInlineResult != nil:
+		return "chosen_inline_result"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	case update.Message != nil:
+		return "message"
+	}
+	return "unknown"
+}
+
+// chattableType names what's being sent, like "message" for a MessageConfig.
+func chattableType(c tgbotapi.Chattable) string {
+	name := fmt.Sprintf("%T", c)
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.ToLower(strings.TrimSuffix(name, "Config"))
+}
+
+// groupHandler is the state label of messages and callback queries in group
+// chats, which don't have a state.
+const groupHandler = "group"
+
+func observeHandler(state string, start time.Time, err error) {
+	handlerDuration.WithLabelValues(state).Observe(time.Since(start).Seconds())
+	if err != nil {
+		handlerErrors.WithLabelValues(state).Inc()
+	}
+}
+
+func observeReview(quality int16, mode string) {
+	reviews.WithLabelValues(strconv.Itoa(int(quality)), mode).Inc()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Migration changes the schema from the version before it to Version. New ones
+// go at the end of Migrations, with their SQL in server/migrations and in the
+// go:generate line below.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+//go:generate file2const --package=main server/migrations/0001_baseline.up.sql:migration0001Up server/migrations/0001_baseline.down.sql:migration0001Down server/migrations/0002_tables.up.sql:migration0002Up server/migrations/0002_tables.down.sql:migration0002Down server/migrations/0003_functions.up.sql:migration0003Up server/migrations/0003_functions.down.sql:migration0003Down server/migrations/0004_poller_lag.up.sql:migration0004Up server/migrations/0004_poller_lag.down.sql:migration0004Down server/migrations/0005_invite_expiry.up.sql:migration0005Up server/migrations/0005_invite_expiry.down.sql:migration0005Down server/migrations/0006_group_chat_linked_by.up.sql:migration0006Up server/migrations/0006_group_chat_linked_by.down.sql:migration0006Down server/migrations/0007_repetition_today.up.sql:migration0007Up server/migrations/0007_repetition_today.down.sql:migration0007Down migrations_sql.go
+var Migrations = []Migration{
+	{1, "baseline", migration0001Up, migration0001Down},
+	{2, "tables", migration0002Up, migration0002Down},
+	{3, "functions", migration0003Up, migration0003Down},
+	{4, "poller_lag", migration0004Up, migration0004Down},
+	{5, "invite_expiry", migration0005Up, migration0005Down},
+	{6, "group_chat_linked_by", migration0006Up, migration0006Down},
+	{7, "repetition_today", migration0007Up, migration0007Down},
+}
+
+// migrationLockID is the key of the advisory lock that keeps two processes, like
+// the old and new server during a restart, from migrating at the same time.
+const migrationLockID = 7061
+
+// inMigrationLock runs f in a transaction that holds the migration lock, after
+// making sure the schema and the schema_migrations table exist.
+func inMigrationLock(db *sqlx.DB, f func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(Secrets.PostgresSchema)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+ version INTEGER PRIMARY KEY,
+ name TEXT NOT NULL,
+ applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+)`)
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func appliedVersion(tx *sqlx.Tx) (version int, err error) {
+	err = tx.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	return
+}
+
+// adoptBaseline marks the baseline as applied in databases that were set up
+// before there were migrations, which have its tables but no versions.
+func adoptBaseline(tx *sqlx.Tx) error {
+	version, err := appliedVersion(tx)
+	if err != nil || version > 0 {
+		return err
+	}
+	var exists bool
+	err = tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema=$1 AND table_name='users')", Secrets.PostgresSchema)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", Migrations[0].Version, Migrations[0].Name)
+	return err
+}
+
+// MigrateUp applies every migration that hasn't been applied yet, each in its
+// own transaction, and returns the ones it applied.
+func MigrateUp(db *sqlx.DB) ([]Migration, error) {
+	if err := inMigrationLock(db, adoptBaseline); err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, m := range Migrations {
+		done := false
+		err := inMigrationLock(db, func(tx *sqlx.Tx) error {
+			version, err := appliedVersion(tx)
+			if err != nil || version >= m.Version {
+				done = err == nil
+				return err
+			}
+			if _, err = tx.Exec(m.Up); err != nil {
+				return fmt.Errorf("migration %d %s: %v", m.Version, m.Name, err)
+			}
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			return err
+		})
+		if err != nil {
+			return applied, err
+		}
+		if !done {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the last applied migration and returns it, or nil if there
+// weren't any.
+func MigrateDown(db *sqlx.DB) (*Migration, error) {
+	var reverted *Migration
+	err := inMigrationLock(db, func(tx *sqlx.Tx) error {
+		version, err := appliedVersion(tx)
+		if err != nil || version == 0 {
+			return err
+		}
+		for i := range Migrations {
+			if Migrations[i].Version == version {
+				reverted = &Migrations[i]
+			}
+		}
+		if reverted == nil {
+			return fmt.Errorf("migration %d is applied but unknown to this binary", version)
+		}
+		if _, err = tx.Exec(reverted.Down); err != nil {
+			return fmt.Errorf("migration %d %s: %v", reverted.Version, reverted.Name, err)
+		}
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version=$1", version)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+type MigrationStatus struct {
+	Migration
+	// Not valid if the migration is pending
+	AppliedAt pq.NullTime
+}
+
+func GetMigrationStatus(db *sqlx.DB) ([]MigrationStatus, error) {
+	statuses := make([]MigrationStatus, len(Migrations))
+	err := inMigrationLock(db, func(tx *sqlx.Tx) error {
+		for i, m := range Migrations {
+			statuses[i].Migration = m
+			err := tx.Get(&statuses[i].AppliedAt, "SELECT applied_at FROM schema_migrations WHERE version=$1", m.Version)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// runMigrate runs the migrate subcommand with the arguments after it.
+func runMigrate(args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		applied, err := MigrateUp(DB)
+		for _, m := range applied {
+			fmt.Printf("Applied %d %s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Already up to date")
+		}
+		return err
+	case "down":
+		m, err := MigrateDown(DB)
+		if m != nil {
+			fmt.Printf("Reverted %d %s\n", m.Version, m.Name)
+		} else if err == nil {
+			fmt.Println("Nothing to revert")
+		}
+		return err
+	case "status":
+		statuses, err := GetMigrationStatus(DB)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt.Valid {
+				applied = "applied " + s.AppliedAt.Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d %-12s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Unknown migrate command '%s', use 'up', 'down' or 'status'\n", command)
+	os.Exit(1)
+	return nil
+}
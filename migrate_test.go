@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func mustExec(t *testing.T, db *sqlx.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := newTestSchema(t)
+
+	applied, err := MigrateUp(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(Migrations))
+	}
+	if applied, err = MigrateUp(db); err != nil || len(applied) != 0 {
+		t.Fatalf("second MigrateUp applied %d, %v", len(applied), err)
+	}
+
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		m, err := MigrateDown(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == nil || m.Version != Migrations[i].Version {
+			t.Fatalf("reverted %v, want %d", m, Migrations[i].Version)
+		}
+	}
+	if m, err := MigrateDown(db); m != nil || err != nil {
+		t.Fatalf("MigrateDown with nothing applied = %v, %v", m, err)
+	}
+	if _, err = MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The baseline is what databases from before there were migrations look like,
+// with no schema_migrations table. Upgrading them keeps everyone's progress.
+func TestMigrateUpFromBaseline(t *testing.T) {
+	db := newTestSchema(t)
+	mustExec(t, db, Migrations[0].Up)
+	mustExec(t, db, "INSERT INTO users (id, rehearsal_time, time_zone, scheduled) VALUES (1, '08:30', 'Europe/Amsterdam', TRUE)")
+	mustExec(t, db, "INSERT INTO decks (id, user_id, name, scheduled) VALUES (1, 1, 'Words', FALSE)")
+	mustExec(t, db, `INSERT INTO cards (id, deck_id, easiness_factor, previous_interval, repetition, next_repetition)
+VALUES (1, 1, 230, 6, 3, '2030-01-02')`)
+	mustExec(t, db, "INSERT INTO cards (id, deck_id) VALUES (2, 1)")
+
+	applied, err := MigrateUp(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations)-1 || applied[0].Version != 2 {
+		t.Fatalf("applied %v, want everything after the baseline", applied)
+	}
+
+	var rehearsalTimes []string
+	if err = db.Select(&rehearsalTimes, "SELECT unnest(rehearsal_times)::TEXT FROM users WHERE id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rehearsalTimes) != 1 || rehearsalTimes[0] != "08:30:00" {
+		t.Errorf("rehearsal_times = %v, want [08:30:00]", rehearsalTimes)
+	}
+
+	var member struct {
+		Role      string `db:"role"`
+		Scheduled bool   `db:"scheduled"`
+	}
+	if err = db.Get(&member, "SELECT role, scheduled FROM deck_members WHERE deck_id=1 AND user_id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if member.Role != "owner" || member.Scheduled {
+		t.Errorf("deck member = %+v, want an unscheduled owner", member)
+	}
+
+	var progress struct {
+		EasinessFactor   int16 `db:"easiness_factor"`
+		PreviousInterval int16 `db:"previous_interval"`
+		Repetition       int16 `db:"repetition"`
+		DueAtMidnight    bool  `db:"due_at_midnight"`
+	}
+	err = db.Get(&progress, `SELECT
+ easiness_factor,
+ previous_interval,
+ repetition,
+ next_repetition::TIMESTAMPTZ = '2030-01-02'::TIMESTAMP AT TIME ZONE 'Europe/Amsterdam' AS due_at_midnight
+FROM card_progress WHERE user_id=1 AND card_id=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.EasinessFactor != 230 || progress.PreviousInterval != 6 || progress.Repetition != 3 || !progress.DueAtMidnight {
+		t.Errorf("progress of the reviewed card = %+v", progress)
+	}
+
+	var isNew bool
+	if err = db.Get(&isNew, "SELECT is_new FROM member_cards WHERE id=2 AND user_id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if !isNew {
+		t.Error("card that was never reviewed isn't new")
+	}
+
+	// Going back to the baseline puts the owner's progress back on the cards
+	for len(applied) > 0 {
+		if _, err = MigrateDown(db); err != nil {
+			t.Fatal(err)
+		}
+		applied = applied[1:]
+	}
+	var card struct {
+		EasinessFactor int16  `db:"easiness_factor"`
+		NextRepetition string `db:"next_repetition"`
+	}
+	if err = db.Get(&card, "SELECT easiness_factor, next_repetition::TEXT FROM cards WHERE id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if card.EasinessFactor != 230 || card.NextRepetition != "2030-01-02" {
+		t.Errorf("card after reverting = %+v", card)
+	}
+}
@@ -0,0 +1,1315 @@
+package main
+
+const (
+	migration0001Up = `-- The schema from before there were migrations, so databases that were set up
+-- back then are at this version. MigrateUp marks it as applied for them.
+
+CREATE TABLE users (
+ id INTEGER PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ rehearsal TIMESTAMP NOT NULL DEFAULT NOW(),
+ rehearsal_time TIME NOT NULL DEFAULT '12:00',
+ state INTEGER NOT NULL DEFAULT 0,
+ time_zone TEXT NOT NULL DEFAULT 'America/New_York',
+ data JSONB NOT NULL DEFAULT '{}',
+ scheduled BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX ON users (rehearsal) WHERE scheduled;
+
+CREATE TABLE decks (
+ id SERIAL PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ name TEXT NOT NULL,
+ scheduled BOOLEAN NOT NULL DEFAULT TRUE,
+ UNIQUE (user_id, name)
+);
+
+CREATE TABLE cards (
+ id SERIAL PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ front JSONB NOT NULL DEFAULT '[]',
+ back JSONB NOT NULL DEFAULT '[]',
+ easiness_factor SMALLINT NOT NULL DEFAULT 250,
+ previous_interval SMALLINT NOT NULL DEFAULT 1,
+ repetition SMALLINT NOT NULL DEFAULT 1 CHECK (repetition >= 1),
+ repetition_today SMALLINT NOT NULL DEFAULT 0 CHECK (repetition_today >= 0),
+ random_order INTEGER NOT NULL DEFAULT TRUNC(RANDOM() * 2147483647)::INTEGER,
+ next_repetition DATE NOT NULL DEFAULT (CURRENT_DATE - 7)
+);
+CREATE INDEX ON cards (deck_id, next_repetition ASC, repetition ASC);
+
+CREATE FUNCTION update_updated_at()
+RETURNS TRIGGER AS $$
+BEGIN
+  NEW.updated_at = now();
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION date_in_time_zone(tz TEXT)
+RETURNS DATE AS $$
+BEGIN
+  RETURN (NOW() AT TIME ZONE tz)::DATE;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION date_in_time_zone(u users)
+RETURNS DATE AS $$
+BEGIN
+  RETURN date_in_time_zone(u.time_zone);
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION next_rehearsal(u users)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN ((date_in_time_zone(u) + INTERVAL '1 DAY')::TIMESTAMP AT TIME ZONE u.time_zone) + u.rehearsal_time;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION schedule_user_rehearsal()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF ((NEW.scheduled AND NOT OLD.scheduled)
+    OR (NEW.rehearsal_time != OLD.rehearsal_time)
+    OR (NEW.time_zone != OLD.time_zone)) THEN
+    NEW.rehearsal = next_rehearsal(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION scheduled_card_for_user(id INTEGER)
+RETURNS SETOF cards AS $$
+  SELECT
+    c.*
+  FROM cards c
+  INNER JOIN decks d ON c.deck_id = d.id
+  INNER JOIN users u ON d.user_id = u.id
+  WHERE
+   d.user_id=$1 AND
+   d.scheduled AND
+   c.next_repetition <= u.date_in_time_zone
+  ORDER BY
+   c.next_repetition ASC,
+   c.repetition_today ASC,
+   c.random_order ASC
+  LIMIT 1;
+$$ LANGUAGE SQL;
+
+CREATE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER) AS $$
+DECLARE x RECORD;
+BEGIN
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.id
+   LOOP
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER update_decks_updated_at BEFORE UPDATE ON decks FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER update_cards_updated_at BEFORE UPDATE ON cards FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER schedule_user_rehearsal_on_enable BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE schedule_user_rehearsal();
+`
+	migration0001Down = `DROP TRIGGER schedule_user_rehearsal_on_enable ON users;
+DROP TRIGGER update_cards_updated_at ON cards;
+DROP TRIGGER update_decks_updated_at ON decks;
+DROP TRIGGER update_users_updated_at ON users;
+
+DROP FUNCTION scheduled_cards_to_send();
+DROP FUNCTION scheduled_card_for_user(INTEGER);
+DROP FUNCTION schedule_user_rehearsal();
+DROP FUNCTION next_rehearsal(users);
+DROP FUNCTION date_in_time_zone(users);
+DROP FUNCTION date_in_time_zone(TEXT);
+DROP FUNCTION update_updated_at();
+
+DROP TABLE cards;
+DROP TABLE decks;
+DROP TABLE users;
+`
+	migration0002Up = `-- Upgrades the baseline to decks that are shared between members, who each have
+-- their own progress on the cards. The baseline's functions and triggers are
+-- replaced by the ones in 0003_functions.
+
+DROP TRIGGER schedule_user_rehearsal_on_enable ON users;
+DROP TRIGGER update_cards_updated_at ON cards;
+DROP TRIGGER update_decks_updated_at ON decks;
+DROP TRIGGER update_users_updated_at ON users;
+
+DROP FUNCTION scheduled_cards_to_send();
+DROP FUNCTION scheduled_card_for_user(INTEGER);
+DROP FUNCTION schedule_user_rehearsal();
+DROP FUNCTION next_rehearsal(users);
+DROP FUNCTION date_in_time_zone(users);
+DROP FUNCTION date_in_time_zone(TEXT);
+DROP FUNCTION update_updated_at();
+
+ALTER TABLE users
+ ADD COLUMN rehearsal_times TIME[] NOT NULL DEFAULT '{12:00}' CHECK (array_length(rehearsal_times, 1) >= 1),
+ ADD COLUMN learning_reminder TIMESTAMP,
+ ADD COLUMN round_robin BOOLEAN NOT NULL DEFAULT FALSE,
+ ADD COLUMN vacation_start DATE,
+ ADD COLUMN vacation_end DATE,
+ ADD CHECK (vacation_end >= vacation_start),
+ -- Days of the week rehearsals get sent on, 0 is Sunday
+ ADD COLUMN rehearsal_days SMALLINT[] NOT NULL DEFAULT '{0,1,2,3,4,5,6}' CHECK (array_length(rehearsal_days, 1) >= 1),
+ -- No rehearsals get sent in between, the window can wrap around midnight
+ ADD COLUMN quiet_start TIME,
+ ADD COLUMN quiet_end TIME,
+ ADD CHECK ((quiet_start IS NULL) = (quiet_end IS NULL)),
+ -- Follow-ups for ignored rehearsals and warnings for streaks that are about to end
+ ADD COLUMN reminders BOOLEAN NOT NULL DEFAULT TRUE,
+ ADD COLUMN rehearsal_sent TIMESTAMP,
+ ADD COLUMN follow_up TIMESTAMP,
+ ADD COLUMN streak_warned_on DATE;
+UPDATE users SET rehearsal_times = ARRAY[rehearsal_time];
+ALTER TABLE users DROP COLUMN rehearsal_time;
+CREATE INDEX users_follow_up_idx ON users (follow_up);
+
+CREATE TABLE deck_members (
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ role TEXT NOT NULL DEFAULT 'viewer' CHECK (role IN ('owner', 'editor', 'viewer')),
+ scheduled BOOLEAN NOT NULL DEFAULT TRUE,
+ new_cards_per_day SMALLINT NOT NULL DEFAULT 20 CHECK (new_cards_per_day >= 0),
+ max_reviews_per_day SMALLINT NOT NULL DEFAULT 200 CHECK (max_reviews_per_day >= 0),
+ -- In seconds
+ learning_steps INTEGER[] NOT NULL DEFAULT '{60,600}',
+ review_order TEXT NOT NULL DEFAULT 'due' CHECK (review_order IN ('due', 'random', 'ease')),
+ new_card_position TEXT NOT NULL DEFAULT 'mixed' CHECK (new_card_position IN ('mixed', 'first', 'last')),
+ -- Cards that are forgotten this many times become leeches
+ leech_threshold SMALLINT NOT NULL DEFAULT 8 CHECK (leech_threshold >= 1),
+ leech_action TEXT NOT NULL DEFAULT 'tag' CHECK (leech_action IN ('tag', 'suspend')),
+ PRIMARY KEY (deck_id, user_id)
+);
+CREATE INDEX deck_members_user_id_idx ON deck_members (user_id);
+
+-- Every deck so far belongs to its user, and whether it's scheduled is up to
+-- each member now
+INSERT INTO deck_members (deck_id, user_id, role, scheduled)
+SELECT id, user_id, 'owner', scheduled FROM decks WHERE user_id IS NOT NULL;
+ALTER TABLE decks DROP COLUMN scheduled;
+
+CREATE TABLE deck_invites (
+ code TEXT PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ role TEXT NOT NULL CHECK (role IN ('editor', 'viewer'))
+);
+
+CREATE TABLE card_progress (
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ easiness_factor SMALLINT NOT NULL DEFAULT 250,
+ previous_interval SMALLINT NOT NULL DEFAULT 1,
+ repetition SMALLINT NOT NULL DEFAULT 1 CHECK (repetition >= 1),
+ repetition_today SMALLINT NOT NULL DEFAULT 0 CHECK (repetition_today >= 0),
+ random_order INTEGER NOT NULL DEFAULT TRUNC(RANDOM() * 2147483647)::INTEGER,
+ next_repetition TIMESTAMP NOT NULL DEFAULT (NOW() - INTERVAL '7 days'),
+ learning_step SMALLINT NOT NULL DEFAULT 0 CHECK (learning_step >= 0),
+ -- Cards that were suspended or buried before they were ever reviewed have none
+ last_review TIMESTAMP,
+ -- How many times the card was forgotten after it was learned
+ lapses SMALLINT NOT NULL DEFAULT 0 CHECK (lapses >= 0),
+ -- Of the last review, including the ones during learning steps
+ last_quality SMALLINT,
+ leech BOOLEAN NOT NULL DEFAULT FALSE,
+ suspended BOOLEAN NOT NULL DEFAULT FALSE,
+ -- Skipped without rating until then
+ buried_until TIMESTAMP,
+ PRIMARY KEY (user_id, card_id)
+);
+CREATE INDEX card_progress_user_id_next_repetition_repetition_idx ON card_progress (user_id, next_repetition ASC, repetition ASC);
+
+-- The progress on the cards becomes the owner's. Cards that were never reviewed
+-- still have their next repetition a week before they were created, and don't
+-- get any. Reviews were the last thing to update a card, apart from edits.
+INSERT INTO card_progress (
+ user_id,
+ card_id,
+ easiness_factor,
+ previous_interval,
+ repetition,
+ repetition_today,
+ random_order,
+ next_repetition,
+ last_review
+)
+SELECT
+ d.user_id,
+ c.id,
+ c.easiness_factor,
+ c.previous_interval,
+ c.repetition,
+ c.repetition_today,
+ c.random_order,
+ c.next_repetition::TIMESTAMP AT TIME ZONE u.time_zone,
+ c.updated_at
+FROM cards c
+INNER JOIN decks d ON c.deck_id = d.id
+INNER JOIN users u ON d.user_id = u.id
+WHERE c.next_repetition > c.created_at::DATE - 7;
+
+ALTER TABLE cards
+ DROP COLUMN easiness_factor,
+ DROP COLUMN previous_interval,
+ DROP COLUMN repetition,
+ DROP COLUMN repetition_today,
+ DROP COLUMN next_repetition;
+CREATE INDEX cards_deck_id_idx ON cards (deck_id);
+
+-- How many new cards and reviews a member did in a deck on a day in their time zone
+CREATE TABLE daily_reviews (
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ day DATE NOT NULL,
+ new_cards SMALLINT NOT NULL DEFAULT 0,
+ reviews SMALLINT NOT NULL DEFAULT 0,
+ PRIMARY KEY (user_id, deck_id, day)
+);
+
+-- Going through a deck without affecting the schedule, see cram_log
+CREATE TABLE crams (
+ id SERIAL PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ failed_only BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE cram_log (
+ id SERIAL PRIMARY KEY,
+ cram_id INTEGER REFERENCES crams ON DELETE CASCADE,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ quality SMALLINT NOT NULL
+);
+CREATE INDEX cram_log_cram_id_card_id_idx ON cram_log (cram_id, card_id);
+
+CREATE TABLE group_chats (
+ id BIGINT PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ deck_id INTEGER NOT NULL REFERENCES decks ON DELETE CASCADE,
+ time_zone TEXT NOT NULL DEFAULT 'America/New_York',
+ quiz_time TIME NOT NULL DEFAULT '09:00',
+ quiz_size SMALLINT NOT NULL DEFAULT 5 CHECK (quiz_size >= 1),
+ next_quiz TIMESTAMP NOT NULL DEFAULT NOW(),
+ quiz_started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ quiz_card_id INTEGER REFERENCES cards ON DELETE SET NULL,
+ quiz_revealed BOOLEAN NOT NULL DEFAULT FALSE,
+ quiz_remaining SMALLINT NOT NULL DEFAULT 0
+);
+CREATE INDEX group_chats_next_quiz_idx ON group_chats (next_quiz);
+
+-- When each card was last quizzed in a group, so quizzes rotate through the deck
+CREATE TABLE group_quiz_cards (
+ chat_id BIGINT REFERENCES group_chats ON DELETE CASCADE,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ quizzed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ PRIMARY KEY (chat_id, card_id)
+);
+
+CREATE TABLE group_answers (
+ chat_id BIGINT REFERENCES group_chats ON DELETE CASCADE,
+ quiz_started_at TIMESTAMP NOT NULL,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ name TEXT NOT NULL,
+ quality SMALLINT NOT NULL,
+ PRIMARY KEY (chat_id, quiz_started_at, card_id, user_id)
+);
+
+-- Decks as seen by each of their members
+CREATE VIEW member_decks AS
+SELECT
+ d.*,
+ m.user_id AS member_id,
+ m.role,
+ m.scheduled,
+ m.new_cards_per_day,
+ m.max_reviews_per_day,
+ m.learning_steps,
+ m.review_order,
+ m.new_card_position,
+ m.leech_threshold,
+ m.leech_action
+FROM decks d
+INNER JOIN deck_members m ON m.deck_id = d.id;
+
+-- Cards as seen by each member of their deck, with the member's own progress.
+-- Cards that a member has never reviewed get the same defaults as card_progress.
+CREATE VIEW member_cards AS
+SELECT
+ c.id,
+ c.deck_id,
+ c.created_at,
+ c.updated_at,
+ c.front,
+ c.back,
+ m.user_id,
+ COALESCE(p.easiness_factor, 250)::SMALLINT AS easiness_factor,
+ COALESCE(p.previous_interval, 1)::SMALLINT AS previous_interval,
+ COALESCE(p.repetition, 1)::SMALLINT AS repetition,
+ COALESCE(p.repetition_today, 0)::SMALLINT AS repetition_today,
+ COALESCE(p.random_order, c.random_order) AS random_order,
+ COALESCE(p.next_repetition, c.created_at - INTERVAL '7 days') AS next_repetition,
+ COALESCE(p.learning_step, 0)::SMALLINT AS learning_step,
+ COALESCE(FLOOR(EXTRACT(EPOCH FROM NOW() - p.last_review) / 86400), 0)::SMALLINT AS elapsed_days,
+ p.last_review IS NULL AS is_new,
+ COALESCE(p.lapses, 0)::SMALLINT AS lapses,
+ COALESCE(p.leech, FALSE) AS leech,
+ COALESCE(p.suspended, FALSE) AS suspended,
+ p.buried_until
+FROM cards c
+INNER JOIN deck_members m ON m.deck_id = c.deck_id
+LEFT JOIN card_progress p ON p.card_id = c.id AND p.user_id = m.user_id;
+`
+	migration0002Down = `DROP VIEW member_cards;
+DROP VIEW member_decks;
+
+DROP TABLE group_answers;
+DROP TABLE group_quiz_cards;
+DROP TABLE group_chats;
+DROP TABLE cram_log;
+DROP TABLE crams;
+DROP TABLE daily_reviews;
+DROP TABLE deck_invites;
+
+-- Only the progress of the owners makes it back
+DROP INDEX cards_deck_id_idx;
+ALTER TABLE cards
+ ADD COLUMN easiness_factor SMALLINT NOT NULL DEFAULT 250,
+ ADD COLUMN previous_interval SMALLINT NOT NULL DEFAULT 1,
+ ADD COLUMN repetition SMALLINT NOT NULL DEFAULT 1 CHECK (repetition >= 1),
+ ADD COLUMN repetition_today SMALLINT NOT NULL DEFAULT 0 CHECK (repetition_today >= 0),
+ ADD COLUMN next_repetition DATE NOT NULL DEFAULT (CURRENT_DATE - 7);
+UPDATE cards c
+SET
+ easiness_factor = p.easiness_factor,
+ previous_interval = p.previous_interval,
+ repetition = p.repetition,
+ repetition_today = p.repetition_today,
+ next_repetition = (p.next_repetition::TIMESTAMPTZ AT TIME ZONE u.time_zone)::DATE
+FROM card_progress p, decks d, users u
+WHERE
+ p.card_id = c.id AND
+ d.id = c.deck_id AND
+ p.user_id = d.user_id AND
+ u.id = d.user_id;
+UPDATE cards c
+SET next_repetition = c.created_at::DATE - 7
+WHERE NOT EXISTS (SELECT 1 FROM card_progress p INNER JOIN decks d ON p.user_id = d.user_id WHERE p.card_id = c.id AND d.id = c.deck_id);
+CREATE INDEX ON cards (deck_id, next_repetition ASC, repetition ASC);
+DROP TABLE card_progress;
+
+ALTER TABLE decks ADD COLUMN scheduled BOOLEAN NOT NULL DEFAULT TRUE;
+UPDATE decks d
+SET scheduled = m.scheduled
+FROM deck_members m
+WHERE m.deck_id = d.id AND m.user_id = d.user_id;
+DROP TABLE deck_members;
+
+ALTER TABLE users ADD COLUMN rehearsal_time TIME NOT NULL DEFAULT '12:00';
+UPDATE users SET rehearsal_time = rehearsal_times[1];
+DROP INDEX users_follow_up_idx;
+ALTER TABLE users
+ DROP COLUMN rehearsal_times,
+ DROP COLUMN learning_reminder,
+ DROP COLUMN round_robin,
+ DROP COLUMN vacation_start,
+ DROP COLUMN vacation_end,
+ DROP COLUMN rehearsal_days,
+ DROP COLUMN quiet_start,
+ DROP COLUMN quiet_end,
+ DROP COLUMN reminders,
+ DROP COLUMN rehearsal_sent,
+ DROP COLUMN follow_up,
+ DROP COLUMN streak_warned_on;
+
+CREATE FUNCTION update_updated_at()
+RETURNS TRIGGER AS $$
+BEGIN
+  NEW.updated_at = now();
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION date_in_time_zone(tz TEXT)
+RETURNS DATE AS $$
+BEGIN
+  RETURN (NOW() AT TIME ZONE tz)::DATE;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION date_in_time_zone(u users)
+RETURNS DATE AS $$
+BEGIN
+  RETURN date_in_time_zone(u.time_zone);
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION next_rehearsal(u users)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN ((date_in_time_zone(u) + INTERVAL '1 DAY')::TIMESTAMP AT TIME ZONE u.time_zone) + u.rehearsal_time;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION schedule_user_rehearsal()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF ((NEW.scheduled AND NOT OLD.scheduled)
+    OR (NEW.rehearsal_time != OLD.rehearsal_time)
+    OR (NEW.time_zone != OLD.time_zone)) THEN
+    NEW.rehearsal = next_rehearsal(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION scheduled_card_for_user(id INTEGER)
+RETURNS SETOF cards AS $$
+  SELECT
+    c.*
+  FROM cards c
+  INNER JOIN decks d ON c.deck_id = d.id
+  INNER JOIN users u ON d.user_id = u.id
+  WHERE
+   d.user_id=$1 AND
+   d.scheduled AND
+   c.next_repetition <= u.date_in_time_zone
+  ORDER BY
+   c.next_repetition ASC,
+   c.repetition_today ASC,
+   c.random_order ASC
+  LIMIT 1;
+$$ LANGUAGE SQL;
+
+CREATE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER) AS $$
+DECLARE x RECORD;
+BEGIN
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.id
+   LOOP
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER update_decks_updated_at BEFORE UPDATE ON decks FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER update_cards_updated_at BEFORE UPDATE ON cards FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER schedule_user_rehearsal_on_enable BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE schedule_user_rehearsal();
+`
+	migration0003Up = `CREATE OR REPLACE FUNCTION update_updated_at()
+RETURNS TRIGGER AS $$
+BEGIN
+  NEW.updated_at = now();
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION date_in_time_zone(tz TEXT)
+RETURNS DATE AS $$
+BEGIN
+  RETURN (NOW() AT TIME ZONE tz)::DATE;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION date_in_time_zone(u users)
+RETURNS DATE AS $$
+BEGIN
+  RETURN date_in_time_zone(u.time_zone);
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION start_of_day_in_time_zone(d DATE, tz TEXT)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN d::TIMESTAMP AT TIME ZONE tz;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION on_vacation(u users, d DATE)
+RETURNS BOOLEAN AS $$
+BEGIN
+  RETURN COALESCE(d BETWEEN u.vacation_start AND u.vacation_end, FALSE);
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION in_quiet_hours(u users, t TIME)
+RETURNS BOOLEAN AS $$
+BEGIN
+  IF u.quiet_start IS NULL OR u.quiet_end IS NULL THEN
+    RETURN FALSE;
+  ELSIF u.quiet_start <= u.quiet_end THEN
+    RETURN t >= u.quiet_start AND t < u.quiet_end;
+  ELSE
+    RETURN t >= u.quiet_start OR t < u.quiet_end;
+  END IF;
+END;
+$$ language 'plpgsql';
+
+-- The first of the user's rehearsal times that is still to come, on one of
+-- their rehearsal days and outside of their quiet hours
+CREATE OR REPLACE FUNCTION next_rehearsal(u users)
+RETURNS TIMESTAMP AS $$
+DECLARE
+  now_local TIMESTAMP;
+  d DATE;
+  t TIME;
+  days_tried INTEGER = 0;
+BEGIN
+  now_local = NOW() AT TIME ZONE u.time_zone;
+  d = now_local::DATE;
+  -- After a week without a slot, all the rehearsal times fall in the quiet hours
+  WHILE days_tried <= 7 LOOP
+    -- Skip over the vacation, so the rehearsal after it is the first one sent
+    IF on_vacation(u, d) THEN
+      d = u.vacation_end + 1;
+    END IF;
+    IF EXTRACT(DOW FROM d) = ANY(u.rehearsal_days) THEN
+      SELECT MIN(x) INTO t
+      FROM unnest(u.rehearsal_times) x
+      WHERE
+        (d > now_local::DATE OR x > now_local::TIME) AND
+        NOT in_quiet_hours(u, x);
+      IF t IS NOT NULL THEN
+        RETURN (d + t) AT TIME ZONE u.time_zone;
+      END IF;
+    END IF;
+    d = d + 1;
+    days_tried = days_tried + 1;
+  END LOOP;
+  RETURN 'infinity';
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION schedule_user_rehearsal()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF ((NEW.scheduled AND NOT OLD.scheduled)
+    OR (NEW.rehearsal_times != OLD.rehearsal_times)
+    OR (NEW.time_zone != OLD.time_zone)
+    OR (NEW.vacation_start IS DISTINCT FROM OLD.vacation_start)
+    OR (NEW.vacation_end IS DISTINCT FROM OLD.vacation_end)
+    OR (NEW.rehearsal_days != OLD.rehearsal_days)
+    OR (NEW.quiet_start IS DISTINCT FROM OLD.quiet_start)
+    OR (NEW.quiet_end IS DISTINCT FROM OLD.quiet_end)) THEN
+    NEW.rehearsal = next_rehearsal(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+-- How many new cards and reviews each member has left today in each of their decks
+CREATE OR REPLACE VIEW member_deck_limits AS
+SELECT
+ m.deck_id,
+ m.user_id,
+ date_in_time_zone(u.time_zone) AS today,
+ m.new_cards_per_day - COALESCE(r.new_cards, 0) AS new_cards_left,
+ m.max_reviews_per_day - COALESCE(r.reviews, 0) AS reviews_left
+FROM deck_members m
+INNER JOIN users u ON u.id = m.user_id
+LEFT JOIN daily_reviews r ON r.user_id = m.user_id AND r.deck_id = m.deck_id AND r.day = date_in_time_zone(u.time_zone);
+
+-- Cards that are due and fit within today's limits. Cards that were failed today
+-- always need to be repeated, so they don't count against the limits.
+CREATE OR REPLACE VIEW reviewable_cards AS
+SELECT
+ c.*
+FROM member_cards c
+INNER JOIN member_deck_limits l ON l.deck_id = c.deck_id AND l.user_id = c.user_id
+WHERE
+ c.next_repetition <= NOW() AND
+ NOT c.suspended AND
+ (c.buried_until IS NULL OR c.buried_until <= NOW()) AND
+ (c.repetition_today > 0 OR CASE WHEN c.is_new THEN l.new_cards_left > 0 ELSE l.reviews_left > 0 END);
+
+-- How many cards are ready to be rehearsed in the scheduled decks of a user
+CREATE OR REPLACE FUNCTION scheduled_cards_due(id INTEGER)
+RETURNS INTEGER AS $$
+  SELECT
+    COUNT(*)::INTEGER
+  FROM reviewable_cards c
+  INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+  WHERE
+   c.user_id=$1 AND
+   m.scheduled;
+$$ LANGUAGE SQL;
+
+-- How many days in a row before the given day the user did any reviews
+CREATE OR REPLACE FUNCTION review_streak(id INTEGER, d DATE)
+RETURNS INTEGER AS $$
+  SELECT
+    COUNT(*)::INTEGER
+  FROM (
+    SELECT day, ROW_NUMBER() OVER (ORDER BY day DESC) AS n
+    FROM (SELECT DISTINCT day FROM daily_reviews WHERE user_id=$1 AND day < $2) days
+  ) x
+  WHERE x.day = $2 - x.n::INTEGER;
+$$ LANGUAGE SQL;
+
+-- Sort key for the order of the cards within the new cards or the reviews of a
+-- deck. New cards always come in random order.
+CREATE OR REPLACE FUNCTION review_group_order(
+  review_order TEXT,
+  is_new BOOLEAN,
+  next_repetition TIMESTAMP,
+  easiness_factor SMALLINT,
+  random_order INTEGER
+)
+RETURNS DOUBLE PRECISION AS $$
+  SELECT CASE
+    WHEN $2 THEN $5
+    WHEN $1 = 'random' THEN $5
+    WHEN $1 = 'ease' THEN $4
+    ELSE EXTRACT(EPOCH FROM $3)
+  END::DOUBLE PRECISION;
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Sort key for the order in which a member reviews the cards of a deck. The
+-- group position is where the card is among the new cards or the reviews by
+-- review_group_order, which is how mixing them takes turns between the two.
+CREATE OR REPLACE FUNCTION review_order(
+  review_order TEXT,
+  new_card_position TEXT,
+  is_new BOOLEAN,
+  group_position BIGINT,
+  next_repetition TIMESTAMP,
+  easiness_factor SMALLINT,
+  repetition_today SMALLINT,
+  random_order INTEGER
+)
+RETURNS DOUBLE PRECISION[] AS $$
+  SELECT ARRAY[
+    CASE $2
+      WHEN 'first' THEN (NOT $3)::INTEGER
+      WHEN 'last' THEN $3::INTEGER
+      ELSE 0
+    END,
+    CASE $2
+      WHEN 'mixed' THEN $4
+      ELSE 0
+    END,
+    -- A review goes before the new card in the same position
+    $3::INTEGER,
+    review_group_order($1, $3, $5, $6, $8),
+    $7,
+    $8
+  ]::DOUBLE PRECISION[];
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION next_group_quiz(g group_chats)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN ((date_in_time_zone(g.time_zone) + INTERVAL '1 DAY')::TIMESTAMP AT TIME ZONE g.time_zone) + g.quiz_time;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION schedule_group_quiz()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    NEW.next_quiz = next_group_quiz(NEW);
+  ELSIF ((NEW.quiz_time != OLD.quiz_time)
+    OR (NEW.time_zone != OLD.time_zone)) THEN
+    NEW.next_quiz = next_group_quiz(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION scheduled_group_quizzes()
+RETURNS TABLE(chat_id BIGINT) AS $$
+  UPDATE group_chats g
+  SET
+    next_quiz = g.next_group_quiz
+  FROM (
+    SELECT id
+    FROM group_chats
+    WHERE
+      next_quiz <= NOW()
+    LIMIT 20
+    FOR UPDATE SKIP LOCKED
+  ) subset
+  WHERE g.id = subset.id
+  RETURNING g.id;
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION scheduled_card_for_user(id INTEGER)
+RETURNS SETOF member_cards AS $$
+  SELECT
+    c.*
+  FROM reviewable_cards c
+  INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+  INNER JOIN users u ON c.user_id = u.id
+  LEFT JOIN daily_reviews r ON r.user_id = c.user_id AND r.deck_id = c.deck_id AND r.day = u.date_in_time_zone
+  WHERE
+   c.user_id=$1 AND
+   m.scheduled
+  ORDER BY
+   -- Taking turns means going to the deck with the fewest reviews today
+   CASE WHEN u.round_robin THEN COALESCE(r.new_cards + r.reviews, 0) ELSE 0 END ASC,
+   review_order(
+     m.review_order,
+     m.new_card_position,
+     c.is_new,
+     ROW_NUMBER() OVER (
+       PARTITION BY c.deck_id, c.is_new
+       ORDER BY review_group_order(m.review_order, c.is_new, c.next_repetition, c.easiness_factor, c.random_order), c.repetition_today, c.random_order
+     ),
+     c.next_repetition,
+     c.easiness_factor,
+     c.repetition_today,
+     c.random_order
+   ) ASC
+  LIMIT 1;
+$$ LANGUAGE SQL;
+
+DROP FUNCTION IF EXISTS scheduled_cards_to_send();
+CREATE OR REPLACE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER, back_from_vacation BOOLEAN) AS $$
+DECLARE x RECORD;
+BEGIN
+  -- Users that aren't scheduled don't get a rehearsal to welcome them back with,
+  -- but their vacation is over all the same
+  UPDATE users u
+  SET vacation_start = NULL, vacation_end = NULL
+  WHERE NOT u.scheduled AND u.vacation_end < date_in_time_zone(u.time_zone);
+
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes' AND
+        -- Users in the middle of something, like a study session or writing a
+        -- card, get their rehearsal once they're back at the deck list or in a
+        -- plain rehearsal
+        state IN (0, 1, 2) AND
+        NOT data ? 'ss'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The user gets to spread out their backlog instead of getting a card
+    IF x.vacation_end < date_in_time_zone(x.time_zone) THEN
+      UPDATE users uu SET vacation_start = NULL, vacation_end = NULL WHERE uu.id = x.id;
+      user_id = x.id;
+      card_id = NULL;
+      back_from_vacation = TRUE;
+      RETURN NEXT;
+      CONTINUE;
+    END IF;
+
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu
+      SET
+        state = 1,
+        data = '{}',
+        rehearsal_sent = NOW(),
+        follow_up = CASE WHEN uu.reminders THEN NOW() + INTERVAL '3 hours' END
+      WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+
+  -- Cards that were still being learned when the user finished rehearsing
+  FOR x IN
+    UPDATE users u
+    SET
+      learning_reminder = NULL
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        learning_reminder <= NOW() AND
+        state = 0 AND
+        -- Reminders that come up during the quiet hours wait until they're over
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The cards that were being learned wait for the first rehearsal after the vacation
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+-- Follow-ups for rehearsals that were ignored, and warnings for streaks that are
+-- about to end at midnight. Only users that aren't busy with something else get them.
+CREATE OR REPLACE FUNCTION scheduled_nudges()
+RETURNS TABLE(user_id INTEGER, kind TEXT, due INTEGER, streak INTEGER) AS $$
+DECLARE x RECORD;
+BEGIN
+  FOR x IN
+    UPDATE users u
+    SET
+      follow_up = NULL
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        follow_up <= NOW() AND
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    CONTINUE WHEN NOT x.reminders OR x.state NOT IN (0, 1);
+    -- Anything reviewed since the rehearsal was sent means it wasn't ignored
+    CONTINUE WHEN EXISTS (SELECT 1 FROM card_progress p WHERE p.user_id = x.id AND p.last_review >= x.rehearsal_sent);
+    due = scheduled_cards_due(x.id);
+    CONTINUE WHEN due = 0;
+    user_id = x.id;
+    kind = 'follow_up';
+    streak = review_streak(x.id, date_in_time_zone(x.time_zone));
+    RETURN NEXT;
+  END LOOP;
+
+  FOR x IN
+    UPDATE users u
+    SET
+      streak_warned_on = date_in_time_zone(u.time_zone)
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        reminders AND
+        scheduled AND
+        state IN (0, 1) AND
+        (NOW() AT TIME ZONE time_zone)::TIME >= '21:00' AND
+        streak_warned_on IS DISTINCT FROM date_in_time_zone(time_zone) AND
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME) AND
+        NOT on_vacation(users, date_in_time_zone(time_zone))
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    CONTINUE WHEN EXISTS (SELECT 1 FROM daily_reviews r WHERE r.user_id = x.id AND r.day = date_in_time_zone(x.time_zone));
+    streak = review_streak(x.id, date_in_time_zone(x.time_zone));
+    CONTINUE WHEN streak < 2;
+    due = scheduled_cards_due(x.id);
+    CONTINUE WHEN due = 0;
+    user_id = x.id;
+    kind = 'streak';
+    RETURN NEXT;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS update_users_updated_at ON users;
+CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_decks_updated_at ON decks;
+CREATE TRIGGER update_decks_updated_at BEFORE UPDATE ON decks FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_cards_updated_at ON cards;
+CREATE TRIGGER update_cards_updated_at BEFORE UPDATE ON cards FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_deck_members_updated_at ON deck_members;
+CREATE TRIGGER update_deck_members_updated_at BEFORE UPDATE ON deck_members FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_card_progress_updated_at ON card_progress;
+CREATE TRIGGER update_card_progress_updated_at BEFORE UPDATE ON card_progress FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_group_chats_updated_at ON group_chats;
+CREATE TRIGGER update_group_chats_updated_at BEFORE UPDATE ON group_chats FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS schedule_user_rehearsal_on_enable ON users;
+CREATE TRIGGER schedule_user_rehearsal_on_enable BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE schedule_user_rehearsal();
+DROP TRIGGER IF EXISTS schedule_group_quiz_on_change ON group_chats;
+CREATE TRIGGER schedule_group_quiz_on_change BEFORE INSERT OR UPDATE ON group_chats FOR EACH ROW EXECUTE PROCEDURE schedule_group_quiz();
+`
+	migration0003Down = `DROP TRIGGER IF EXISTS update_users_updated_at ON users;
+DROP TRIGGER IF EXISTS update_decks_updated_at ON decks;
+DROP TRIGGER IF EXISTS update_cards_updated_at ON cards;
+DROP TRIGGER IF EXISTS update_deck_members_updated_at ON deck_members;
+DROP TRIGGER IF EXISTS update_card_progress_updated_at ON card_progress;
+DROP TRIGGER IF EXISTS update_group_chats_updated_at ON group_chats;
+DROP TRIGGER IF EXISTS schedule_user_rehearsal_on_enable ON users;
+DROP TRIGGER IF EXISTS schedule_group_quiz_on_change ON group_chats;
+
+DROP FUNCTION IF EXISTS scheduled_nudges();
+DROP FUNCTION IF EXISTS scheduled_cards_to_send();
+DROP FUNCTION IF EXISTS scheduled_card_for_user(INTEGER);
+DROP FUNCTION IF EXISTS scheduled_group_quizzes();
+DROP FUNCTION IF EXISTS schedule_group_quiz();
+DROP FUNCTION IF EXISTS next_group_quiz(group_chats);
+DROP FUNCTION IF EXISTS review_order(TEXT, TEXT, BOOLEAN, BIGINT, TIMESTAMP, SMALLINT, SMALLINT, INTEGER);
+DROP FUNCTION IF EXISTS review_group_order(TEXT, BOOLEAN, TIMESTAMP, SMALLINT, INTEGER);
+DROP FUNCTION IF EXISTS review_streak(INTEGER, DATE);
+DROP FUNCTION IF EXISTS scheduled_cards_due(INTEGER);
+DROP VIEW IF EXISTS reviewable_cards;
+DROP VIEW IF EXISTS member_deck_limits;
+DROP FUNCTION IF EXISTS schedule_user_rehearsal();
+DROP FUNCTION IF EXISTS next_rehearsal(users);
+DROP FUNCTION IF EXISTS in_quiet_hours(users, TIME);
+DROP FUNCTION IF EXISTS on_vacation(users, DATE);
+DROP FUNCTION IF EXISTS start_of_day_in_time_zone(DATE, TEXT);
+DROP FUNCTION IF EXISTS date_in_time_zone(users);
+DROP FUNCTION IF EXISTS date_in_time_zone(TEXT);
+DROP FUNCTION IF EXISTS update_updated_at();
+`
+	migration0004Up = `-- scheduled_cards_to_send() also returns how many seconds late each card is sent
+-- for the poller lag metric. The return type changes, so it has to be dropped.
+DROP FUNCTION scheduled_cards_to_send();
+
+CREATE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER, back_from_vacation BOOLEAN, lag_seconds DOUBLE PRECISION) AS $$
+DECLARE x RECORD;
+BEGIN
+  -- Users that aren't scheduled don't get a rehearsal to welcome them back with,
+  -- but their vacation is over all the same
+  UPDATE users u
+  SET vacation_start = NULL, vacation_end = NULL
+  WHERE NOT u.scheduled AND u.vacation_end < date_in_time_zone(u.time_zone);
+
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id, rehearsal AS due
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes' AND
+        -- Users in the middle of something, like a study session or writing a
+        -- card, get their rehearsal once they're back at the deck list or in a
+        -- plain rehearsal
+        state IN (0, 1, 2) AND
+        NOT data ? 'ss'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*, EXTRACT(EPOCH FROM NOW() - subset.due) AS lag_seconds
+   LOOP
+    lag_seconds = x.lag_seconds;
+
+    -- The user gets to spread out their backlog instead of getting a card
+    IF x.vacation_end < date_in_time_zone(x.time_zone) THEN
+      UPDATE users uu SET vacation_start = NULL, vacation_end = NULL WHERE uu.id = x.id;
+      user_id = x.id;
+      card_id = NULL;
+      back_from_vacation = TRUE;
+      RETURN NEXT;
+      CONTINUE;
+    END IF;
+
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu
+      SET
+        state = 1,
+        data = '{}',
+        rehearsal_sent = NOW(),
+        follow_up = CASE WHEN uu.reminders THEN NOW() + INTERVAL '3 hours' END
+      WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+
+  -- Cards that were still being learned when the user finished rehearsing
+  FOR x IN
+    UPDATE users u
+    SET
+      learning_reminder = NULL
+    FROM (
+      SELECT id, learning_reminder AS due
+      FROM users
+      WHERE
+        learning_reminder <= NOW() AND
+        state = 0 AND
+        -- Reminders that come up during the quiet hours wait until they're over
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*, EXTRACT(EPOCH FROM NOW() - subset.due) AS lag_seconds
+   LOOP
+    lag_seconds = x.lag_seconds;
+    -- The cards that were being learned wait for the first rehearsal after the vacation
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+`
+	migration0004Down = `DROP FUNCTION scheduled_cards_to_send();
+
+CREATE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER, back_from_vacation BOOLEAN) AS $$
+DECLARE x RECORD;
+BEGIN
+  -- Users that aren't scheduled don't get a rehearsal to welcome them back with,
+  -- but their vacation is over all the same
+  UPDATE users u
+  SET vacation_start = NULL, vacation_end = NULL
+  WHERE NOT u.scheduled AND u.vacation_end < date_in_time_zone(u.time_zone);
+
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes' AND
+        -- Users in the middle of something, like a study session or writing a
+        -- card, get their rehearsal once they're back at the deck list or in a
+        -- plain rehearsal
+        state IN (0, 1, 2) AND
+        NOT data ? 'ss'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The user gets to spread out their backlog instead of getting a card
+    IF x.vacation_end < date_in_time_zone(x.time_zone) THEN
+      UPDATE users uu SET vacation_start = NULL, vacation_end = NULL WHERE uu.id = x.id;
+      user_id = x.id;
+      card_id = NULL;
+      back_from_vacation = TRUE;
+      RETURN NEXT;
+      CONTINUE;
+    END IF;
+
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu
+      SET
+        state = 1,
+        data = '{}',
+        rehearsal_sent = NOW(),
+        follow_up = CASE WHEN uu.reminders THEN NOW() + INTERVAL '3 hours' END
+      WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+
+  -- Cards that were still being learned when the user finished rehearsing
+  FOR x IN
+    UPDATE users u
+    SET
+      learning_reminder = NULL
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        learning_reminder <= NOW() AND
+        state = 0 AND
+        -- Reminders that come up during the quiet hours wait until they're over
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The cards that were being learned wait for the first rehearsal after the vacation
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+`
+	migration0005Up = `-- Invite links stop working after 30 days, so a link that got out can't be
+-- used to join the deck forever. Existing links get 30 days from now.
+ALTER TABLE deck_invites ADD COLUMN expires_at TIMESTAMP NOT NULL DEFAULT NOW() + INTERVAL '30 days';
+`
+	migration0005Down = `ALTER TABLE deck_invites DROP COLUMN expires_at;
+`
+	migration0006Up = `-- Who linked the deck to the group, who can change the quiz along with the
+-- admins of the group.
+ALTER TABLE group_chats ADD COLUMN linked_by INTEGER REFERENCES users ON DELETE SET NULL;
+`
+	migration0006Down = `ALTER TABLE group_chats DROP COLUMN linked_by;
+`
+	migration0007Up = `-- repetition_today only counts the repetitions since midnight in the member's
+-- time zone. A card that was still in learning or failed yesterday is back to
+-- 0, so its first review today counts against the daily limits again.
+CREATE OR REPLACE VIEW member_cards AS
+SELECT
+ c.id,
+ c.deck_id,
+ c.created_at,
+ c.updated_at,
+ c.front,
+ c.back,
+ m.user_id,
+ COALESCE(p.easiness_factor, 250)::SMALLINT AS easiness_factor,
+ COALESCE(p.previous_interval, 1)::SMALLINT AS previous_interval,
+ COALESCE(p.repetition, 1)::SMALLINT AS repetition,
+ (CASE
+  WHEN (p.last_review::TIMESTAMPTZ AT TIME ZONE u.time_zone)::DATE = (NOW() AT TIME ZONE u.time_zone)::DATE THEN p.repetition_today
+  ELSE 0
+ END)::SMALLINT AS repetition_today,
+ COALESCE(p.random_order, c.random_order) AS random_order,
+ COALESCE(p.next_repetition, c.created_at - INTERVAL '7 days') AS next_repetition,
+ COALESCE(p.learning_step, 0)::SMALLINT AS learning_step,
+ COALESCE(FLOOR(EXTRACT(EPOCH FROM NOW() - p.last_review) / 86400), 0)::SMALLINT AS elapsed_days,
+ p.last_review IS NULL AS is_new,
+ COALESCE(p.lapses, 0)::SMALLINT AS lapses,
+ COALESCE(p.leech, FALSE) AS leech,
+ COALESCE(p.suspended, FALSE) AS suspended,
+ p.buried_until
+FROM cards c
+INNER JOIN deck_members m ON m.deck_id = c.deck_id
+INNER JOIN users u ON u.id = m.user_id
+LEFT JOIN card_progress p ON p.card_id = c.id AND p.user_id = m.user_id;
+`
+	migration0007Down = `CREATE OR REPLACE VIEW member_cards AS
+SELECT
+ c.id,
+ c.deck_id,
+ c.created_at,
+ c.updated_at,
+ c.front,
+ c.back,
+ m.user_id,
+ COALESCE(p.easiness_factor, 250)::SMALLINT AS easiness_factor,
+ COALESCE(p.previous_interval, 1)::SMALLINT AS previous_interval,
+ COALESCE(p.repetition, 1)::SMALLINT AS repetition,
+ COALESCE(p.repetition_today, 0)::SMALLINT AS repetition_today,
+ COALESCE(p.random_order, c.random_order) AS random_order,
+ COALESCE(p.next_repetition, c.created_at - INTERVAL '7 days') AS next_repetition,
+ COALESCE(p.learning_step, 0)::SMALLINT AS learning_step,
+ COALESCE(FLOOR(EXTRACT(EPOCH FROM NOW() - p.last_review) / 86400), 0)::SMALLINT AS elapsed_days,
+ p.last_review IS NULL AS is_new,
+ COALESCE(p.lapses, 0)::SMALLINT AS lapses,
+ COALESCE(p.leech, FALSE) AS leech,
+ COALESCE(p.suspended, FALSE) AS suspended,
+ p.buried_until
+FROM cards c
+INNER JOIN deck_members m ON m.deck_id = c.deck_id
+LEFT JOIN card_progress p ON p.card_id = c.id AND p.user_id = m.user_id;
+`
+)
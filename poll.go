@@ -1,46 +1,82 @@
 package main
 
 import (
-	"log"
+	"database/sql"
 	"time"
 
 	"github.com/getsentry/raven-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/telegram-bot-api.v4"
 )
 
-func poll() (bool, error) {
+func poll(m Messenger) (bool, error) {
+	log := newTrace()
 	tx, err := DB.Beginx()
 	if err != nil {
-		log.Print(err)
-		tx.Rollback()
 		return false, err
 	}
-	rows, err := tx.Queryx("SELECT user_id, card_id FROM scheduled_cards_to_send()")
+	rows, err := tx.Queryx("SELECT user_id, card_id, back_from_vacation, lag_seconds FROM scheduled_cards_to_send()")
 	if err != nil {
-		log.Print(err)
 		tx.Rollback()
 		return false, err
 	}
 	users := make([]int, 0, 20)
 	cards := make([]int, 0, 20)
+	returning := make([]int, 0)
 	for rows.Next() {
-		var userID, cardID int
-		err = rows.Scan(&userID, &cardID)
+		var userID int
+		var cardID sql.NullInt64
+		var backFromVacation bool
+		var lag float64
+		err = rows.Scan(&userID, &cardID, &backFromVacation, &lag)
 		if err != nil {
-			log.Print(err)
 			tx.Rollback()
 			return false, err
 		}
-		users = append(users, userID)
-		cards = append(cards, cardID)
+		pollerLag.Observe(lag)
+		if backFromVacation {
+			returning = append(returning, userID)
+		} else {
+			users = append(users, userID)
+			cards = append(cards, int(cardID.Int64))
+		}
+	}
+	tx.Commit()
+
+	pollerBatchSize.WithLabelValues("rehearsals").Observe(float64(len(users) + len(returning)))
+	if len(users) > 0 || len(returning) > 0 {
+		log.WithFields(logrus.Fields{"cards": len(users), "returning": len(returning)}).Info("sending rehearsals")
 	}
 
+	for _, userID := range returning {
+		if err := WithUser(log, userID, func(u *User, tx *sqlx.Tx) error {
+			c := &Context{
+				data: &Data{},
+				from: int64(userID),
+				tx:   tx,
+				u:    u,
+				m:    m,
+				log:  log.WithField("user_id", userID),
+			}
+			c.reply("Welcome back from your vacation!")
+			return u.SetAndShowState(c, BacklogSpread, nil)
+		}); err != nil {
+			log.WithField("user_id", userID).WithError(err).Error("welcoming back from vacation failed")
+			raven.CaptureError(err, nil)
+		}
+	}
+
+	tx, err = DB.Beginx()
+	if err != nil {
+		return false, err
+	}
 	for i := 0; i < len(users); i++ {
 		userID := users[i]
 		cardID := cards[i]
-		card, err := GetCard(tx, cardID)
+		card, err := GetCard(tx, userID, cardID)
 		if err != nil {
-			log.Print(err)
+			log.WithFields(logrus.Fields{"user_id": userID, "card_id": cardID}).WithError(err).Error("loading scheduled card failed")
 			continue
 		}
 
@@ -52,25 +88,100 @@ func poll() (bool, error) {
 				tgbotapi.NewKeyboardButton(EditCard),
 				tgbotapi.NewKeyboardButton(ShowReverseOfCard),
 			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(BuryCard),
+				tgbotapi.NewKeyboardButton(SuspendCard),
+			),
 		)
 		keyboard.OneTimeKeyboard = true
 
 		go func() {
-			Send(tgbotapi.NewMessage(int64(userID), "Time for your rehearsal!"))
-			card.SendFront(userID, keyboard)
+			m.Send(tgbotapi.NewMessage(int64(userID), "Time for your rehearsal!"))
+			card.SendFront(m, int64(userID), keyboard)
 		}()
 	}
 	tx.Commit()
-	return len(users) > 0, nil
+	return len(users) > 0 || len(returning) > 0, nil
+}
+
+// Kinds of nudges that scheduled_nudges() returns
+const (
+	NudgeFollowUp = "follow_up"
+	NudgeStreak   = "streak"
+)
+
+type nudge struct {
+	UserID int    `db:"user_id"`
+	Kind   string `db:"kind"`
+	Due    int    `db:"due"`
+	Streak int    `db:"streak"`
 }
 
-func Poller() {
+func pollNudges(m Messenger) (bool, error) {
+	tx, err := DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	nudges := []nudge{}
+	err = tx.Select(&nudges, "SELECT user_id, kind, due, streak FROM scheduled_nudges()")
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	pollerBatchSize.WithLabelValues("nudges").Observe(float64(len(nudges)))
+	log := newTrace()
+	for _, n := range nudges {
+		n := n
+		if err := WithUser(log, n.UserID, func(u *User, tx *sqlx.Tx) error {
+			c := &Context{
+				data: &Data{},
+				from: int64(u.ID),
+				tx:   tx,
+				u:    u,
+				m:    m,
+				log:  log.WithField("user_id", u.ID),
+			}
+			switch n.Kind {
+			case NudgeFollowUp:
+				c.reply("Don't forget about your rehearsal, there's still %d cards waiting for you!", n.Due)
+			case NudgeStreak:
+				c.reply("You've rehearsed %d days in a row, don't break your streak! There's %d cards waiting for you before midnight.", n.Streak, n.Due)
+			}
+			return u.SetAndShowState(c, Rehearsing, nil)
+		}); err != nil {
+			log.WithFields(logrus.Fields{"user_id": n.UserID, "kind": n.Kind}).WithError(err).Error("nudging failed")
+			raven.CaptureError(err, nil)
+		}
+	}
+	if len(nudges) > 0 {
+		log.WithField("count", len(nudges)).Info("sent nudges")
+	}
+	return len(nudges) > 0, nil
+}
+
+// Poller sends rehearsals, group quizzes and nudges through m when they are due.
+func Poller(m Messenger) {
 	for {
-		retry, err := poll()
+		retry, err := poll(m)
+		if err != nil {
+			Log.WithError(err).Error("polling rehearsals failed")
+			raven.CaptureError(err, nil)
+		}
+		groupRetry, err := pollGroupQuizzes(m)
+		if err != nil {
+			Log.WithError(err).Error("polling group quizzes failed")
+			raven.CaptureError(err, nil)
+		}
+		nudgeRetry, err := pollNudges(m)
 		if err != nil {
+			Log.WithError(err).Error("polling nudges failed")
 			raven.CaptureError(err, nil)
 		}
-		if !retry {
+		if !retry && !groupRetry && !nudgeRetry {
 			time.Sleep(10 * time.Second)
 		}
 	}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestScheduledCardsToSendOnVacation(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	mustExec(t, db, "INSERT INTO users (id) VALUES (1), (2), (3)")
+	// Not scheduled, with a vacation that ended long ago
+	mustExec(t, db, "UPDATE users SET vacation_start='2000-01-01', vacation_end='2000-01-02' WHERE id=1")
+	// Both still learning a card, but only 2 is on vacation
+	mustExec(t, db, "UPDATE users SET learning_reminder=NOW() - INTERVAL '1 minute' WHERE id IN (2, 3)")
+	mustExec(t, db, "UPDATE users SET vacation_start=CURRENT_DATE - 2, vacation_end=CURRENT_DATE + 2 WHERE id=2")
+	for _, userID := range []int{2, 3} {
+		mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES ($1, $1, 'Words')", userID)
+		mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role) VALUES ($1, $1, 'owner')", userID)
+		mustExec(t, db, "INSERT INTO cards (deck_id, front, back) VALUES ($1, '[]', '[]')", userID)
+	}
+
+	var sentTo []int
+	if err := db.Select(&sentTo, "SELECT user_id FROM scheduled_cards_to_send()"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentTo) != 1 || sentTo[0] != 3 {
+		t.Errorf("cards were sent to %v, want only to the user that isn't on vacation", sentTo)
+	}
+
+	var ended bool
+	if err := db.Get(&ended, "SELECT vacation_end IS NULL FROM users WHERE id=1"); err != nil {
+		t.Fatal(err)
+	}
+	if !ended {
+		t.Error("vacation of a user that isn't scheduled wasn't cleared")
+	}
+}
+
+func TestScheduledCardsToSendWaitsForIdleUsers(t *testing.T) {
+	newTestDB(t)
+	db := DB
+	users := []struct {
+		id    int
+		state State
+		data  string
+	}{
+		{1, DeckList, "{}"},
+		{2, Rehearsing, `{"c":1}`},
+		{3, Rehearsing, `{"ss":1600000000,"sg":20}`},
+		{4, CardCreateBack, `{"d":4}`},
+	}
+	for _, u := range users {
+		mustExec(t, db, `INSERT INTO users (id, scheduled, rehearsal, updated_at, state, data)
+VALUES ($1, TRUE, NOW() - INTERVAL '1 minute', NOW() - INTERVAL '1 hour', $2, $3)`, u.id, u.state, u.data)
+		mustExec(t, db, "INSERT INTO decks (id, user_id, name) VALUES ($1, $1, 'Words')", u.id)
+		mustExec(t, db, "INSERT INTO deck_members (deck_id, user_id, role) VALUES ($1, $1, 'owner')", u.id)
+		mustExec(t, db, "INSERT INTO cards (deck_id, front, back) VALUES ($1, '[]', '[]')", u.id)
+	}
+
+	var sentTo []int
+	if err := db.Select(&sentTo, "SELECT user_id FROM scheduled_cards_to_send() ORDER BY user_id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentTo) != 2 || sentTo[0] != 1 || sentTo[1] != 2 {
+		t.Errorf("cards were sent to %v, want [1 2]", sentTo)
+	}
+
+	// The others keep what they were doing, and their rehearsal stays due
+	var waiting []int
+	if err := db.Select(&waiting, "SELECT id FROM users WHERE rehearsal <= NOW() AND (state = $1 OR data ? 'ss') ORDER BY id", CardCreateBack); err != nil {
+		t.Fatal(err)
+	}
+	if len(waiting) != 2 || waiting[0] != 3 || waiting[1] != 4 {
+		t.Errorf("users %v are still waiting for their rehearsal, want [3 4]", waiting)
+	}
+}
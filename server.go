@@ -2,11 +2,8 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 
@@ -14,6 +11,7 @@ import (
 	"github.com/getsentry/raven-go"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 	"googlemaps.github.io/maps"
 	"gopkg.in/telegram-bot-api.v4"
 	"rsc.io/letsencrypt"
@@ -23,60 +21,56 @@ var (
 	SecretsPath          string
 	LetsencryptCachePath string
 	Hostname             string
+	Mode                 string
+	TLSMode              string
+	TLSCertPath          string
+	TLSKeyPath           string
+	HTTPAddr             string
+	HTTPSAddr            string
+	MigrateOnStart       bool
+	LogLevel             string
+	LogFormat            string
+	MetricsAddr          string
 
 	DB *sqlx.DB
 
 	BotAPI *tgbotapi.BotAPI
 	Maps   *maps.Client
 
-	Secrets struct {
-		BotToken                 string `json:"bot_token"`
-		PostgresConnectionString string `json:"postgres_connection_string"`
-		MapsAPIKey               string `json:"maps_api_key"`
-		SentryDSN                string `json:"sentry_dsn"`
-	}
+	Secrets Config
 )
 
-func Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
-	return BotAPI.Send(c)
-}
-
 func readSecrets() error {
-	secretsFile, err := os.Open(SecretsPath)
-	if err != nil {
-		return err
-	}
-	decoder := json.NewDecoder(secretsFile)
-	err = decoder.Decode(&Secrets)
+	var err error
+	Secrets, err = LoadConfig(SecretsPath)
 	if err != nil {
 		return err
 	}
 	if Secrets.SentryDSN != "" {
 		raven.SetDSN(Secrets.SentryDSN)
 	}
-	if Secrets.BotToken == "" {
-		return errors.New("bot_token is missing in secrets")
-	}
+	DB, err = sqlx.Open("postgres", Secrets.PostgresConnectionStringWithSchema())
+	return err
+}
+
+// connect sets up the clients for Telegram and Maps.
+func connect() error {
+	var err error
 	BotAPI, err = tgbotapi.NewBotAPI(Secrets.BotToken)
 	if err != nil {
 		return err
 	}
-	if Secrets.MapsAPIKey == "" {
-		return errors.New("maps_api_key is missing in secrets")
-	}
-	Maps, err = maps.NewClient(maps.WithAPIKey(Secrets.MapsAPIKey))
-	if err != nil {
-		return err
-	}
-	if Secrets.PostgresConnectionString == "" {
-		return errors.New("postgres_connection_string is missing in secrets")
+	DefaultMessenger = NewBotMessenger(BotAPI)
+	if Secrets.MapsAPIKey != "" {
+		Maps, err = maps.NewClient(maps.WithAPIKey(Secrets.MapsAPIKey))
+		if err != nil {
+			return err
+		}
 	}
-	DB, err = sqlx.Open("postgres", Secrets.PostgresConnectionString)
-	if err != nil {
-		return err
+	if Secrets.TimeZoneResolver == "maps" {
+		TimeZones = MapsTimeZones{Maps}
 	}
-	_, err = DB.Query("SET search_path TO srsbot")
-	return err
+	return nil
 }
 
 //go:generate file2const --package=main site/index.html:Site site.go
@@ -100,40 +94,139 @@ func createHandler() http.Handler {
 }
 
 func main() {
-	flag.StringVar(&SecretsPath, "secrets", "", "Path to secrets file")
+	flag.StringVar(&SecretsPath, "secrets", "", "Path to JSON secrets file, which can be left out when everything is set in the environment")
 	flag.StringVar(&LetsencryptCachePath, "letsencrypt-cache", "", "Path to Let's Encrypt cache file")
 	flag.StringVar(&Hostname, "hostname", "", "Hostname to register webhook with")
+	flag.StringVar(&Mode, "mode", "webhook", "How to get updates from Telegram, 'webhook' or 'poll'")
+	flag.StringVar(&TLSMode, "tls", "letsencrypt", "Where the TLS certificate comes from, 'letsencrypt', 'files' or 'none' to serve plain HTTP behind a proxy")
+	flag.StringVar(&TLSCertPath, "tls-cert", "", "Path to TLS certificate file, with -tls=files")
+	flag.StringVar(&TLSKeyPath, "tls-key", "", "Path to TLS key file, with -tls=files")
+	flag.StringVar(&HTTPAddr, "http-addr", ":8080", "Address to listen on for HTTP, which redirects to HTTPS unless -tls=none. Empty to turn off the redirect")
+	flag.StringVar(&HTTPSAddr, "https-addr", ":8443", "Address to listen on for HTTPS")
+	flag.BoolVar(&MigrateOnStart, "migrate", false, "Migrate the database before starting")
+	flag.StringVar(&LogLevel, "log-level", "info", "Least severe level to log, like 'debug', 'info' or 'error'")
+	flag.StringVar(&LogFormat, "log-format", "text", "How to format logs, 'text' or 'json'")
+	flag.StringVar(&MetricsAddr, "metrics-addr", ":9090", "Address to serve Prometheus metrics on at /metrics. Empty to turn them off")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [migrate up|down|status]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if err := setupLogging(LogLevel, LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := readSecrets(); err != nil {
+			Log.Fatal(err)
+		}
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			Log.Fatal(err)
+		}
+		return
+	} else if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	if SecretsPath == "" || LetsencryptCachePath == "" || Hostname == "" {
+	if Mode != "webhook" && Mode != "poll" {
+		fmt.Fprintf(os.Stderr, "Unknown mode '%s'\n", Mode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if TLSMode != "letsencrypt" && TLSMode != "files" && TLSMode != "none" {
+		fmt.Fprintf(os.Stderr, "Unknown TLS mode '%s'\n", TLSMode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if Mode == "webhook" && Hostname == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if Mode == "webhook" && ((TLSMode == "letsencrypt" && LetsencryptCachePath == "") ||
+		(TLSMode == "files" && (TLSCertPath == "" || TLSKeyPath == "")) ||
+		(TLSMode == "none" && HTTPAddr == "")) {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
 	if err := readSecrets(); err != nil {
-		log.Fatal(err)
+		Log.Fatal(err)
+	}
+	if MigrateOnStart {
+		applied, err := MigrateUp(DB)
+		for _, m := range applied {
+			Log.WithFields(logrus.Fields{"version": m.Version, "name": m.Name}).Info("applied migration")
+		}
+		if err != nil {
+			Log.Fatal(err)
+		}
+	}
+	if err := connect(); err != nil {
+		Log.Fatal(err)
+	}
+
+	if Mode == "poll" {
+		if MetricsAddr != "" {
+			go func() {
+				Log.Fatal(createMetricsServer().ListenAndServe())
+			}()
+		}
+		go Poller(DefaultMessenger)
+		Log.Fatal(pollUpdates())
 	}
 
-	var m letsencrypt.Manager
-	if err := m.CacheFile(LetsencryptCachePath); err != nil {
-		log.Fatal(err)
+	servers, err := createServers()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if MetricsAddr != "" {
+		servers = append(servers, createMetricsServer())
 	}
 
-	httpServer := &http.Server{
-		Addr:    ":8080",
-		Handler: http.HandlerFunc(letsencrypt.RedirectHTTP),
+	go Poller(DefaultMessenger)
+	if err := gracehttp.Serve(servers...); err != nil {
+		Log.Fatal(err)
 	}
+}
 
-	httpsServer := &http.Server{
-		Addr:    ":8443",
-		Handler: createHandler(),
-		TLSConfig: &tls.Config{
-			GetCertificate: m.GetCertificate,
-		},
+// createServers sets up HTTPS with a redirect from HTTP, or only plain HTTP when
+// TLS is taken care of by a proxy in front of the bot.
+func createServers() ([]*http.Server, error) {
+	if TLSMode == "none" {
+		return []*http.Server{{
+			Addr:    HTTPAddr,
+			Handler: createHandler(),
+		}}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if TLSMode == "files" {
+		cert, err := tls.LoadX509KeyPair(TLSCertPath, TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		var m letsencrypt.Manager
+		if err := m.CacheFile(LetsencryptCachePath); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = m.GetCertificate
 	}
 
-	go Poller()
-	if err := gracehttp.Serve(httpServer, httpsServer); err != nil {
-		log.Fatal(err)
+	servers := []*http.Server{{
+		Addr:      HTTPSAddr,
+		Handler:   createHandler(),
+		TLSConfig: tlsConfig,
+	}}
+	if HTTPAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:    HTTPAddr,
+			Handler: http.HandlerFunc(letsencrypt.RedirectHTTP),
+		})
 	}
+	return servers, nil
 }
@@ -0,0 +1,16 @@
+DROP TRIGGER schedule_user_rehearsal_on_enable ON users;
+DROP TRIGGER update_cards_updated_at ON cards;
+DROP TRIGGER update_decks_updated_at ON decks;
+DROP TRIGGER update_users_updated_at ON users;
+
+DROP FUNCTION scheduled_cards_to_send();
+DROP FUNCTION scheduled_card_for_user(INTEGER);
+DROP FUNCTION schedule_user_rehearsal();
+DROP FUNCTION next_rehearsal(users);
+DROP FUNCTION date_in_time_zone(users);
+DROP FUNCTION date_in_time_zone(TEXT);
+DROP FUNCTION update_updated_at();
+
+DROP TABLE cards;
+DROP TABLE decks;
+DROP TABLE users;
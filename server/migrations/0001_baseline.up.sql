@@ -1,6 +1,46 @@
-BEGIN;
+-- The schema from before there were migrations, so databases that were set up
+-- back then are at this version. MigrateUp marks it as applied for them.
 
-CREATE OR REPLACE FUNCTION update_updated_at()
+CREATE TABLE users (
+ id INTEGER PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ rehearsal TIMESTAMP NOT NULL DEFAULT NOW(),
+ rehearsal_time TIME NOT NULL DEFAULT '12:00',
+ state INTEGER NOT NULL DEFAULT 0,
+ time_zone TEXT NOT NULL DEFAULT 'America/New_York',
+ data JSONB NOT NULL DEFAULT '{}',
+ scheduled BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX ON users (rehearsal) WHERE scheduled;
+
+CREATE TABLE decks (
+ id SERIAL PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ name TEXT NOT NULL,
+ scheduled BOOLEAN NOT NULL DEFAULT TRUE,
+ UNIQUE (user_id, name)
+);
+
+CREATE TABLE cards (
+ id SERIAL PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ front JSONB NOT NULL DEFAULT '[]',
+ back JSONB NOT NULL DEFAULT '[]',
+ easiness_factor SMALLINT NOT NULL DEFAULT 250,
+ previous_interval SMALLINT NOT NULL DEFAULT 1,
+ repetition SMALLINT NOT NULL DEFAULT 1 CHECK (repetition >= 1),
+ repetition_today SMALLINT NOT NULL DEFAULT 0 CHECK (repetition_today >= 0),
+ random_order INTEGER NOT NULL DEFAULT TRUNC(RANDOM() * 2147483647)::INTEGER,
+ next_repetition DATE NOT NULL DEFAULT (CURRENT_DATE - 7)
+);
+CREATE INDEX ON cards (deck_id, next_repetition ASC, repetition ASC);
+
+CREATE FUNCTION update_updated_at()
 RETURNS TRIGGER AS $$
 BEGIN
   NEW.updated_at = now();
@@ -8,28 +48,28 @@ BEGIN
 END;
 $$ language 'plpgsql';
 
-CREATE OR REPLACE FUNCTION date_in_time_zone(tz TEXT)
+CREATE FUNCTION date_in_time_zone(tz TEXT)
 RETURNS DATE AS $$
 BEGIN
   RETURN (NOW() AT TIME ZONE tz)::DATE;
 END;
 $$ language 'plpgsql';
 
-CREATE OR REPLACE FUNCTION date_in_time_zone(u users)
+CREATE FUNCTION date_in_time_zone(u users)
 RETURNS DATE AS $$
 BEGIN
   RETURN date_in_time_zone(u.time_zone);
 END;
 $$ language 'plpgsql';
 
-CREATE OR REPLACE FUNCTION next_rehearsal(u users)
+CREATE FUNCTION next_rehearsal(u users)
 RETURNS TIMESTAMP AS $$
 BEGIN
   RETURN ((date_in_time_zone(u) + INTERVAL '1 DAY')::TIMESTAMP AT TIME ZONE u.time_zone) + u.rehearsal_time;
 END;
 $$ language 'plpgsql';
 
-CREATE OR REPLACE FUNCTION schedule_user_rehearsal()
+CREATE FUNCTION schedule_user_rehearsal()
 RETURNS TRIGGER AS $$
 BEGIN
   IF ((NEW.scheduled AND NOT OLD.scheduled)
@@ -41,7 +81,7 @@ BEGIN
 END;
 $$ language 'plpgsql';
 
-CREATE OR REPLACE FUNCTION scheduled_card_for_user(id INTEGER)
+CREATE FUNCTION scheduled_card_for_user(id INTEGER)
 RETURNS SETOF cards AS $$
   SELECT
     c.*
@@ -59,7 +99,7 @@ RETURNS SETOF cards AS $$
   LIMIT 1;
 $$ LANGUAGE SQL;
 
-CREATE OR REPLACE FUNCTION scheduled_cards_to_send()
+CREATE FUNCTION scheduled_cards_to_send()
 RETURNS TABLE(user_id INTEGER, card_id INTEGER) AS $$
 DECLARE x RECORD;
 BEGIN
@@ -95,5 +135,3 @@ CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECU
 CREATE TRIGGER update_decks_updated_at BEFORE UPDATE ON decks FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
 CREATE TRIGGER update_cards_updated_at BEFORE UPDATE ON cards FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
 CREATE TRIGGER schedule_user_rehearsal_on_enable BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE schedule_user_rehearsal();
-
-END;
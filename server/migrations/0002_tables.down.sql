@@ -0,0 +1,157 @@
+DROP VIEW member_cards;
+DROP VIEW member_decks;
+
+DROP TABLE group_answers;
+DROP TABLE group_quiz_cards;
+DROP TABLE group_chats;
+DROP TABLE cram_log;
+DROP TABLE crams;
+DROP TABLE daily_reviews;
+DROP TABLE deck_invites;
+
+-- Only the progress of the owners makes it back
+DROP INDEX cards_deck_id_idx;
+ALTER TABLE cards
+ ADD COLUMN easiness_factor SMALLINT NOT NULL DEFAULT 250,
+ ADD COLUMN previous_interval SMALLINT NOT NULL DEFAULT 1,
+ ADD COLUMN repetition SMALLINT NOT NULL DEFAULT 1 CHECK (repetition >= 1),
+ ADD COLUMN repetition_today SMALLINT NOT NULL DEFAULT 0 CHECK (repetition_today >= 0),
+ ADD COLUMN next_repetition DATE NOT NULL DEFAULT (CURRENT_DATE - 7);
+UPDATE cards c
+SET
+ easiness_factor = p.easiness_factor,
+ previous_interval = p.previous_interval,
+ repetition = p.repetition,
+ repetition_today = p.repetition_today,
+ next_repetition = (p.next_repetition::TIMESTAMPTZ AT TIME ZONE u.time_zone)::DATE
+FROM card_progress p, decks d, users u
+WHERE
+ p.card_id = c.id AND
+ d.id = c.deck_id AND
+ p.user_id = d.user_id AND
+ u.id = d.user_id;
+UPDATE cards c
+SET next_repetition = c.created_at::DATE - 7
+WHERE NOT EXISTS (SELECT 1 FROM card_progress p INNER JOIN decks d ON p.user_id = d.user_id WHERE p.card_id = c.id AND d.id = c.deck_id);
+CREATE INDEX ON cards (deck_id, next_repetition ASC, repetition ASC);
+DROP TABLE card_progress;
+
+ALTER TABLE decks ADD COLUMN scheduled BOOLEAN NOT NULL DEFAULT TRUE;
+UPDATE decks d
+SET scheduled = m.scheduled
+FROM deck_members m
+WHERE m.deck_id = d.id AND m.user_id = d.user_id;
+DROP TABLE deck_members;
+
+ALTER TABLE users ADD COLUMN rehearsal_time TIME NOT NULL DEFAULT '12:00';
+UPDATE users SET rehearsal_time = rehearsal_times[1];
+DROP INDEX users_follow_up_idx;
+ALTER TABLE users
+ DROP COLUMN rehearsal_times,
+ DROP COLUMN learning_reminder,
+ DROP COLUMN round_robin,
+ DROP COLUMN vacation_start,
+ DROP COLUMN vacation_end,
+ DROP COLUMN rehearsal_days,
+ DROP COLUMN quiet_start,
+ DROP COLUMN quiet_end,
+ DROP COLUMN reminders,
+ DROP COLUMN rehearsal_sent,
+ DROP COLUMN follow_up,
+ DROP COLUMN streak_warned_on;
+
+CREATE FUNCTION update_updated_at()
+RETURNS TRIGGER AS $$
+BEGIN
+  NEW.updated_at = now();
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION date_in_time_zone(tz TEXT)
+RETURNS DATE AS $$
+BEGIN
+  RETURN (NOW() AT TIME ZONE tz)::DATE;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION date_in_time_zone(u users)
+RETURNS DATE AS $$
+BEGIN
+  RETURN date_in_time_zone(u.time_zone);
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION next_rehearsal(u users)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN ((date_in_time_zone(u) + INTERVAL '1 DAY')::TIMESTAMP AT TIME ZONE u.time_zone) + u.rehearsal_time;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION schedule_user_rehearsal()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF ((NEW.scheduled AND NOT OLD.scheduled)
+    OR (NEW.rehearsal_time != OLD.rehearsal_time)
+    OR (NEW.time_zone != OLD.time_zone)) THEN
+    NEW.rehearsal = next_rehearsal(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE FUNCTION scheduled_card_for_user(id INTEGER)
+RETURNS SETOF cards AS $$
+  SELECT
+    c.*
+  FROM cards c
+  INNER JOIN decks d ON c.deck_id = d.id
+  INNER JOIN users u ON d.user_id = u.id
+  WHERE
+   d.user_id=$1 AND
+   d.scheduled AND
+   c.next_repetition <= u.date_in_time_zone
+  ORDER BY
+   c.next_repetition ASC,
+   c.repetition_today ASC,
+   c.random_order ASC
+  LIMIT 1;
+$$ LANGUAGE SQL;
+
+CREATE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER) AS $$
+DECLARE x RECORD;
+BEGIN
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.id
+   LOOP
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER update_decks_updated_at BEFORE UPDATE ON decks FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER update_cards_updated_at BEFORE UPDATE ON cards FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+CREATE TRIGGER schedule_user_rehearsal_on_enable BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE schedule_user_rehearsal();
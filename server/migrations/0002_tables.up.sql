@@ -0,0 +1,242 @@
+-- Upgrades the baseline to decks that are shared between members, who each have
+-- their own progress on the cards. The baseline's functions and triggers are
+-- replaced by the ones in 0003_functions.
+
+DROP TRIGGER schedule_user_rehearsal_on_enable ON users;
+DROP TRIGGER update_cards_updated_at ON cards;
+DROP TRIGGER update_decks_updated_at ON decks;
+DROP TRIGGER update_users_updated_at ON users;
+
+DROP FUNCTION scheduled_cards_to_send();
+DROP FUNCTION scheduled_card_for_user(INTEGER);
+DROP FUNCTION schedule_user_rehearsal();
+DROP FUNCTION next_rehearsal(users);
+DROP FUNCTION date_in_time_zone(users);
+DROP FUNCTION date_in_time_zone(TEXT);
+DROP FUNCTION update_updated_at();
+
+ALTER TABLE users
+ ADD COLUMN rehearsal_times TIME[] NOT NULL DEFAULT '{12:00}' CHECK (array_length(rehearsal_times, 1) >= 1),
+ ADD COLUMN learning_reminder TIMESTAMP,
+ ADD COLUMN round_robin BOOLEAN NOT NULL DEFAULT FALSE,
+ ADD COLUMN vacation_start DATE,
+ ADD COLUMN vacation_end DATE,
+ ADD CHECK (vacation_end >= vacation_start),
+ -- Days of the week rehearsals get sent on, 0 is Sunday
+ ADD COLUMN rehearsal_days SMALLINT[] NOT NULL DEFAULT '{0,1,2,3,4,5,6}' CHECK (array_length(rehearsal_days, 1) >= 1),
+ -- No rehearsals get sent in between, the window can wrap around midnight
+ ADD COLUMN quiet_start TIME,
+ ADD COLUMN quiet_end TIME,
+ ADD CHECK ((quiet_start IS NULL) = (quiet_end IS NULL)),
+ -- Follow-ups for ignored rehearsals and warnings for streaks that are about to end
+ ADD COLUMN reminders BOOLEAN NOT NULL DEFAULT TRUE,
+ ADD COLUMN rehearsal_sent TIMESTAMP,
+ ADD COLUMN follow_up TIMESTAMP,
+ ADD COLUMN streak_warned_on DATE;
+UPDATE users SET rehearsal_times = ARRAY[rehearsal_time];
+ALTER TABLE users DROP COLUMN rehearsal_time;
+CREATE INDEX users_follow_up_idx ON users (follow_up);
+
+CREATE TABLE deck_members (
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ role TEXT NOT NULL DEFAULT 'viewer' CHECK (role IN ('owner', 'editor', 'viewer')),
+ scheduled BOOLEAN NOT NULL DEFAULT TRUE,
+ new_cards_per_day SMALLINT NOT NULL DEFAULT 20 CHECK (new_cards_per_day >= 0),
+ max_reviews_per_day SMALLINT NOT NULL DEFAULT 200 CHECK (max_reviews_per_day >= 0),
+ -- In seconds
+ learning_steps INTEGER[] NOT NULL DEFAULT '{60,600}',
+ review_order TEXT NOT NULL DEFAULT 'due' CHECK (review_order IN ('due', 'random', 'ease')),
+ new_card_position TEXT NOT NULL DEFAULT 'mixed' CHECK (new_card_position IN ('mixed', 'first', 'last')),
+ -- Cards that are forgotten this many times become leeches
+ leech_threshold SMALLINT NOT NULL DEFAULT 8 CHECK (leech_threshold >= 1),
+ leech_action TEXT NOT NULL DEFAULT 'tag' CHECK (leech_action IN ('tag', 'suspend')),
+ PRIMARY KEY (deck_id, user_id)
+);
+CREATE INDEX deck_members_user_id_idx ON deck_members (user_id);
+
+-- Every deck so far belongs to its user, and whether it's scheduled is up to
+-- each member now
+INSERT INTO deck_members (deck_id, user_id, role, scheduled)
+SELECT id, user_id, 'owner', scheduled FROM decks WHERE user_id IS NOT NULL;
+ALTER TABLE decks DROP COLUMN scheduled;
+
+CREATE TABLE deck_invites (
+ code TEXT PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ role TEXT NOT NULL CHECK (role IN ('editor', 'viewer'))
+);
+
+CREATE TABLE card_progress (
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ easiness_factor SMALLINT NOT NULL DEFAULT 250,
+ previous_interval SMALLINT NOT NULL DEFAULT 1,
+ repetition SMALLINT NOT NULL DEFAULT 1 CHECK (repetition >= 1),
+ repetition_today SMALLINT NOT NULL DEFAULT 0 CHECK (repetition_today >= 0),
+ random_order INTEGER NOT NULL DEFAULT TRUNC(RANDOM() * 2147483647)::INTEGER,
+ next_repetition TIMESTAMP NOT NULL DEFAULT (NOW() - INTERVAL '7 days'),
+ learning_step SMALLINT NOT NULL DEFAULT 0 CHECK (learning_step >= 0),
+ -- Cards that were suspended or buried before they were ever reviewed have none
+ last_review TIMESTAMP,
+ -- How many times the card was forgotten after it was learned
+ lapses SMALLINT NOT NULL DEFAULT 0 CHECK (lapses >= 0),
+ -- Of the last review, including the ones during learning steps
+ last_quality SMALLINT,
+ leech BOOLEAN NOT NULL DEFAULT FALSE,
+ suspended BOOLEAN NOT NULL DEFAULT FALSE,
+ -- Skipped without rating until then
+ buried_until TIMESTAMP,
+ PRIMARY KEY (user_id, card_id)
+);
+CREATE INDEX card_progress_user_id_next_repetition_repetition_idx ON card_progress (user_id, next_repetition ASC, repetition ASC);
+
+-- The progress on the cards becomes the owner's. Cards that were never reviewed
+-- still have their next repetition a week before they were created, and don't
+-- get any. Reviews were the last thing to update a card, apart from edits.
+INSERT INTO card_progress (
+ user_id,
+ card_id,
+ easiness_factor,
+ previous_interval,
+ repetition,
+ repetition_today,
+ random_order,
+ next_repetition,
+ last_review
+)
+SELECT
+ d.user_id,
+ c.id,
+ c.easiness_factor,
+ c.previous_interval,
+ c.repetition,
+ c.repetition_today,
+ c.random_order,
+ c.next_repetition::TIMESTAMP AT TIME ZONE u.time_zone,
+ c.updated_at
+FROM cards c
+INNER JOIN decks d ON c.deck_id = d.id
+INNER JOIN users u ON d.user_id = u.id
+WHERE c.next_repetition > c.created_at::DATE - 7;
+
+ALTER TABLE cards
+ DROP COLUMN easiness_factor,
+ DROP COLUMN previous_interval,
+ DROP COLUMN repetition,
+ DROP COLUMN repetition_today,
+ DROP COLUMN next_repetition;
+CREATE INDEX cards_deck_id_idx ON cards (deck_id);
+
+-- How many new cards and reviews a member did in a deck on a day in their time zone
+CREATE TABLE daily_reviews (
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ day DATE NOT NULL,
+ new_cards SMALLINT NOT NULL DEFAULT 0,
+ reviews SMALLINT NOT NULL DEFAULT 0,
+ PRIMARY KEY (user_id, deck_id, day)
+);
+
+-- Going through a deck without affecting the schedule, see cram_log
+CREATE TABLE crams (
+ id SERIAL PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ deck_id INTEGER REFERENCES decks ON DELETE CASCADE,
+ failed_only BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE cram_log (
+ id SERIAL PRIMARY KEY,
+ cram_id INTEGER REFERENCES crams ON DELETE CASCADE,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ quality SMALLINT NOT NULL
+);
+CREATE INDEX cram_log_cram_id_card_id_idx ON cram_log (cram_id, card_id);
+
+CREATE TABLE group_chats (
+ id BIGINT PRIMARY KEY,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ deck_id INTEGER NOT NULL REFERENCES decks ON DELETE CASCADE,
+ time_zone TEXT NOT NULL DEFAULT 'America/New_York',
+ quiz_time TIME NOT NULL DEFAULT '09:00',
+ quiz_size SMALLINT NOT NULL DEFAULT 5 CHECK (quiz_size >= 1),
+ next_quiz TIMESTAMP NOT NULL DEFAULT NOW(),
+ quiz_started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ quiz_card_id INTEGER REFERENCES cards ON DELETE SET NULL,
+ quiz_revealed BOOLEAN NOT NULL DEFAULT FALSE,
+ quiz_remaining SMALLINT NOT NULL DEFAULT 0
+);
+CREATE INDEX group_chats_next_quiz_idx ON group_chats (next_quiz);
+
+-- When each card was last quizzed in a group, so quizzes rotate through the deck
+CREATE TABLE group_quiz_cards (
+ chat_id BIGINT REFERENCES group_chats ON DELETE CASCADE,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ quizzed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ PRIMARY KEY (chat_id, card_id)
+);
+
+CREATE TABLE group_answers (
+ chat_id BIGINT REFERENCES group_chats ON DELETE CASCADE,
+ quiz_started_at TIMESTAMP NOT NULL,
+ card_id INTEGER REFERENCES cards ON DELETE CASCADE,
+ user_id INTEGER REFERENCES users ON DELETE CASCADE,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ name TEXT NOT NULL,
+ quality SMALLINT NOT NULL,
+ PRIMARY KEY (chat_id, quiz_started_at, card_id, user_id)
+);
+
+-- Decks as seen by each of their members
+CREATE VIEW member_decks AS
+SELECT
+ d.*,
+ m.user_id AS member_id,
+ m.role,
+ m.scheduled,
+ m.new_cards_per_day,
+ m.max_reviews_per_day,
+ m.learning_steps,
+ m.review_order,
+ m.new_card_position,
+ m.leech_threshold,
+ m.leech_action
+FROM decks d
+INNER JOIN deck_members m ON m.deck_id = d.id;
+
+-- Cards as seen by each member of their deck, with the member's own progress.
+-- Cards that a member has never reviewed get the same defaults as card_progress.
+CREATE VIEW member_cards AS
+SELECT
+ c.id,
+ c.deck_id,
+ c.created_at,
+ c.updated_at,
+ c.front,
+ c.back,
+ m.user_id,
+ COALESCE(p.easiness_factor, 250)::SMALLINT AS easiness_factor,
+ COALESCE(p.previous_interval, 1)::SMALLINT AS previous_interval,
+ COALESCE(p.repetition, 1)::SMALLINT AS repetition,
+ COALESCE(p.repetition_today, 0)::SMALLINT AS repetition_today,
+ COALESCE(p.random_order, c.random_order) AS random_order,
+ COALESCE(p.next_repetition, c.created_at - INTERVAL '7 days') AS next_repetition,
+ COALESCE(p.learning_step, 0)::SMALLINT AS learning_step,
+ COALESCE(FLOOR(EXTRACT(EPOCH FROM NOW() - p.last_review) / 86400), 0)::SMALLINT AS elapsed_days,
+ p.last_review IS NULL AS is_new,
+ COALESCE(p.lapses, 0)::SMALLINT AS lapses,
+ COALESCE(p.leech, FALSE) AS leech,
+ COALESCE(p.suspended, FALSE) AS suspended,
+ p.buried_until
+FROM cards c
+INNER JOIN deck_members m ON m.deck_id = c.deck_id
+LEFT JOIN card_progress p ON p.card_id = c.id AND p.user_id = m.user_id;
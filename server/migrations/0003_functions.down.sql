@@ -0,0 +1,29 @@
+DROP TRIGGER IF EXISTS update_users_updated_at ON users;
+DROP TRIGGER IF EXISTS update_decks_updated_at ON decks;
+DROP TRIGGER IF EXISTS update_cards_updated_at ON cards;
+DROP TRIGGER IF EXISTS update_deck_members_updated_at ON deck_members;
+DROP TRIGGER IF EXISTS update_card_progress_updated_at ON card_progress;
+DROP TRIGGER IF EXISTS update_group_chats_updated_at ON group_chats;
+DROP TRIGGER IF EXISTS schedule_user_rehearsal_on_enable ON users;
+DROP TRIGGER IF EXISTS schedule_group_quiz_on_change ON group_chats;
+
+DROP FUNCTION IF EXISTS scheduled_nudges();
+DROP FUNCTION IF EXISTS scheduled_cards_to_send();
+DROP FUNCTION IF EXISTS scheduled_card_for_user(INTEGER);
+DROP FUNCTION IF EXISTS scheduled_group_quizzes();
+DROP FUNCTION IF EXISTS schedule_group_quiz();
+DROP FUNCTION IF EXISTS next_group_quiz(group_chats);
+DROP FUNCTION IF EXISTS review_order(TEXT, TEXT, BOOLEAN, BIGINT, TIMESTAMP, SMALLINT, SMALLINT, INTEGER);
+DROP FUNCTION IF EXISTS review_group_order(TEXT, BOOLEAN, TIMESTAMP, SMALLINT, INTEGER);
+DROP FUNCTION IF EXISTS review_streak(INTEGER, DATE);
+DROP FUNCTION IF EXISTS scheduled_cards_due(INTEGER);
+DROP VIEW IF EXISTS reviewable_cards;
+DROP VIEW IF EXISTS member_deck_limits;
+DROP FUNCTION IF EXISTS schedule_user_rehearsal();
+DROP FUNCTION IF EXISTS next_rehearsal(users);
+DROP FUNCTION IF EXISTS in_quiet_hours(users, TIME);
+DROP FUNCTION IF EXISTS on_vacation(users, DATE);
+DROP FUNCTION IF EXISTS start_of_day_in_time_zone(DATE, TEXT);
+DROP FUNCTION IF EXISTS date_in_time_zone(users);
+DROP FUNCTION IF EXISTS date_in_time_zone(TEXT);
+DROP FUNCTION IF EXISTS update_updated_at();
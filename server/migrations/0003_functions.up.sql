@@ -0,0 +1,448 @@
+CREATE OR REPLACE FUNCTION update_updated_at()
+RETURNS TRIGGER AS $$
+BEGIN
+  NEW.updated_at = now();
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION date_in_time_zone(tz TEXT)
+RETURNS DATE AS $$
+BEGIN
+  RETURN (NOW() AT TIME ZONE tz)::DATE;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION date_in_time_zone(u users)
+RETURNS DATE AS $$
+BEGIN
+  RETURN date_in_time_zone(u.time_zone);
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION start_of_day_in_time_zone(d DATE, tz TEXT)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN d::TIMESTAMP AT TIME ZONE tz;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION on_vacation(u users, d DATE)
+RETURNS BOOLEAN AS $$
+BEGIN
+  RETURN COALESCE(d BETWEEN u.vacation_start AND u.vacation_end, FALSE);
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION in_quiet_hours(u users, t TIME)
+RETURNS BOOLEAN AS $$
+BEGIN
+  IF u.quiet_start IS NULL OR u.quiet_end IS NULL THEN
+    RETURN FALSE;
+  ELSIF u.quiet_start <= u.quiet_end THEN
+    RETURN t >= u.quiet_start AND t < u.quiet_end;
+  ELSE
+    RETURN t >= u.quiet_start OR t < u.quiet_end;
+  END IF;
+END;
+$$ language 'plpgsql';
+
+-- The first of the user's rehearsal times that is still to come, on one of
+-- their rehearsal days and outside of their quiet hours
+CREATE OR REPLACE FUNCTION next_rehearsal(u users)
+RETURNS TIMESTAMP AS $$
+DECLARE
+  now_local TIMESTAMP;
+  d DATE;
+  t TIME;
+  days_tried INTEGER = 0;
+BEGIN
+  now_local = NOW() AT TIME ZONE u.time_zone;
+  d = now_local::DATE;
+  -- After a week without a slot, all the rehearsal times fall in the quiet hours
+  WHILE days_tried <= 7 LOOP
+    -- Skip over the vacation, so the rehearsal after it is the first one sent
+    IF on_vacation(u, d) THEN
+      d = u.vacation_end + 1;
+    END IF;
+    IF EXTRACT(DOW FROM d) = ANY(u.rehearsal_days) THEN
+      SELECT MIN(x) INTO t
+      FROM unnest(u.rehearsal_times) x
+      WHERE
+        (d > now_local::DATE OR x > now_local::TIME) AND
+        NOT in_quiet_hours(u, x);
+      IF t IS NOT NULL THEN
+        RETURN (d + t) AT TIME ZONE u.time_zone;
+      END IF;
+    END IF;
+    d = d + 1;
+    days_tried = days_tried + 1;
+  END LOOP;
+  RETURN 'infinity';
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION schedule_user_rehearsal()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF ((NEW.scheduled AND NOT OLD.scheduled)
+    OR (NEW.rehearsal_times != OLD.rehearsal_times)
+    OR (NEW.time_zone != OLD.time_zone)
+    OR (NEW.vacation_start IS DISTINCT FROM OLD.vacation_start)
+    OR (NEW.vacation_end IS DISTINCT FROM OLD.vacation_end)
+    OR (NEW.rehearsal_days != OLD.rehearsal_days)
+    OR (NEW.quiet_start IS DISTINCT FROM OLD.quiet_start)
+    OR (NEW.quiet_end IS DISTINCT FROM OLD.quiet_end)) THEN
+    NEW.rehearsal = next_rehearsal(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+-- How many new cards and reviews each member has left today in each of their decks
+CREATE OR REPLACE VIEW member_deck_limits AS
+SELECT
+ m.deck_id,
+ m.user_id,
+ date_in_time_zone(u.time_zone) AS today,
+ m.new_cards_per_day - COALESCE(r.new_cards, 0) AS new_cards_left,
+ m.max_reviews_per_day - COALESCE(r.reviews, 0) AS reviews_left
+FROM deck_members m
+INNER JOIN users u ON u.id = m.user_id
+LEFT JOIN daily_reviews r ON r.user_id = m.user_id AND r.deck_id = m.deck_id AND r.day = date_in_time_zone(u.time_zone);
+
+-- Cards that are due and fit within today's limits. Cards that were failed today
+-- always need to be repeated, so they don't count against the limits.
+CREATE OR REPLACE VIEW reviewable_cards AS
+SELECT
+ c.*
+FROM member_cards c
+INNER JOIN member_deck_limits l ON l.deck_id = c.deck_id AND l.user_id = c.user_id
+WHERE
+ c.next_repetition <= NOW() AND
+ NOT c.suspended AND
+ (c.buried_until IS NULL OR c.buried_until <= NOW()) AND
+ (c.repetition_today > 0 OR CASE WHEN c.is_new THEN l.new_cards_left > 0 ELSE l.reviews_left > 0 END);
+
+-- How many cards are ready to be rehearsed in the scheduled decks of a user
+CREATE OR REPLACE FUNCTION scheduled_cards_due(id INTEGER)
+RETURNS INTEGER AS $$
+  SELECT
+    COUNT(*)::INTEGER
+  FROM reviewable_cards c
+  INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+  WHERE
+   c.user_id=$1 AND
+   m.scheduled;
+$$ LANGUAGE SQL;
+
+-- How many days in a row before the given day the user did any reviews
+CREATE OR REPLACE FUNCTION review_streak(id INTEGER, d DATE)
+RETURNS INTEGER AS $$
+  SELECT
+    COUNT(*)::INTEGER
+  FROM (
+    SELECT day, ROW_NUMBER() OVER (ORDER BY day DESC) AS n
+    FROM (SELECT DISTINCT day FROM daily_reviews WHERE user_id=$1 AND day < $2) days
+  ) x
+  WHERE x.day = $2 - x.n::INTEGER;
+$$ LANGUAGE SQL;
+
+-- Sort key for the order of the cards within the new cards or the reviews of a
+-- deck. New cards always come in random order.
+CREATE OR REPLACE FUNCTION review_group_order(
+  review_order TEXT,
+  is_new BOOLEAN,
+  next_repetition TIMESTAMP,
+  easiness_factor SMALLINT,
+  random_order INTEGER
+)
+RETURNS DOUBLE PRECISION AS $$
+  SELECT CASE
+    WHEN $2 THEN $5
+    WHEN $1 = 'random' THEN $5
+    WHEN $1 = 'ease' THEN $4
+    ELSE EXTRACT(EPOCH FROM $3)
+  END::DOUBLE PRECISION;
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Sort key for the order in which a member reviews the cards of a deck. The
+-- group position is where the card is among the new cards or the reviews by
+-- review_group_order, which is how mixing them takes turns between the two.
+CREATE OR REPLACE FUNCTION review_order(
+  review_order TEXT,
+  new_card_position TEXT,
+  is_new BOOLEAN,
+  group_position BIGINT,
+  next_repetition TIMESTAMP,
+  easiness_factor SMALLINT,
+  repetition_today SMALLINT,
+  random_order INTEGER
+)
+RETURNS DOUBLE PRECISION[] AS $$
+  SELECT ARRAY[
+    CASE $2
+      WHEN 'first' THEN (NOT $3)::INTEGER
+      WHEN 'last' THEN $3::INTEGER
+      ELSE 0
+    END,
+    CASE $2
+      WHEN 'mixed' THEN $4
+      ELSE 0
+    END,
+    -- A review goes before the new card in the same position
+    $3::INTEGER,
+    review_group_order($1, $3, $5, $6, $8),
+    $7,
+    $8
+  ]::DOUBLE PRECISION[];
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION next_group_quiz(g group_chats)
+RETURNS TIMESTAMP AS $$
+BEGIN
+  RETURN ((date_in_time_zone(g.time_zone) + INTERVAL '1 DAY')::TIMESTAMP AT TIME ZONE g.time_zone) + g.quiz_time;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION schedule_group_quiz()
+RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    NEW.next_quiz = next_group_quiz(NEW);
+  ELSIF ((NEW.quiz_time != OLD.quiz_time)
+    OR (NEW.time_zone != OLD.time_zone)) THEN
+    NEW.next_quiz = next_group_quiz(NEW);
+  END IF;
+  RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION scheduled_group_quizzes()
+RETURNS TABLE(chat_id BIGINT) AS $$
+  UPDATE group_chats g
+  SET
+    next_quiz = g.next_group_quiz
+  FROM (
+    SELECT id
+    FROM group_chats
+    WHERE
+      next_quiz <= NOW()
+    LIMIT 20
+    FOR UPDATE SKIP LOCKED
+  ) subset
+  WHERE g.id = subset.id
+  RETURNING g.id;
+$$ LANGUAGE SQL;
+
+CREATE OR REPLACE FUNCTION scheduled_card_for_user(id INTEGER)
+RETURNS SETOF member_cards AS $$
+  SELECT
+    c.*
+  FROM reviewable_cards c
+  INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+  INNER JOIN users u ON c.user_id = u.id
+  LEFT JOIN daily_reviews r ON r.user_id = c.user_id AND r.deck_id = c.deck_id AND r.day = u.date_in_time_zone
+  WHERE
+   c.user_id=$1 AND
+   m.scheduled
+  ORDER BY
+   -- Taking turns means going to the deck with the fewest reviews today
+   CASE WHEN u.round_robin THEN COALESCE(r.new_cards + r.reviews, 0) ELSE 0 END ASC,
+   review_order(
+     m.review_order,
+     m.new_card_position,
+     c.is_new,
+     ROW_NUMBER() OVER (
+       PARTITION BY c.deck_id, c.is_new
+       ORDER BY review_group_order(m.review_order, c.is_new, c.next_repetition, c.easiness_factor, c.random_order), c.repetition_today, c.random_order
+     ),
+     c.next_repetition,
+     c.easiness_factor,
+     c.repetition_today,
+     c.random_order
+   ) ASC
+  LIMIT 1;
+$$ LANGUAGE SQL;
+
+DROP FUNCTION IF EXISTS scheduled_cards_to_send();
+CREATE OR REPLACE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER, back_from_vacation BOOLEAN) AS $$
+DECLARE x RECORD;
+BEGIN
+  -- Users that aren't scheduled don't get a rehearsal to welcome them back with,
+  -- but their vacation is over all the same
+  UPDATE users u
+  SET vacation_start = NULL, vacation_end = NULL
+  WHERE NOT u.scheduled AND u.vacation_end < date_in_time_zone(u.time_zone);
+
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes' AND
+        -- Users in the middle of something, like a study session or writing a
+        -- card, get their rehearsal once they're back at the deck list or in a
+        -- plain rehearsal
+        state IN (0, 1, 2) AND
+        NOT data ? 'ss'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The user gets to spread out their backlog instead of getting a card
+    IF x.vacation_end < date_in_time_zone(x.time_zone) THEN
+      UPDATE users uu SET vacation_start = NULL, vacation_end = NULL WHERE uu.id = x.id;
+      user_id = x.id;
+      card_id = NULL;
+      back_from_vacation = TRUE;
+      RETURN NEXT;
+      CONTINUE;
+    END IF;
+
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu
+      SET
+        state = 1,
+        data = '{}',
+        rehearsal_sent = NOW(),
+        follow_up = CASE WHEN uu.reminders THEN NOW() + INTERVAL '3 hours' END
+      WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+
+  -- Cards that were still being learned when the user finished rehearsing
+  FOR x IN
+    UPDATE users u
+    SET
+      learning_reminder = NULL
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        learning_reminder <= NOW() AND
+        state = 0 AND
+        -- Reminders that come up during the quiet hours wait until they're over
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The cards that were being learned wait for the first rehearsal after the vacation
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+-- Follow-ups for rehearsals that were ignored, and warnings for streaks that are
+-- about to end at midnight. Only users that aren't busy with something else get them.
+CREATE OR REPLACE FUNCTION scheduled_nudges()
+RETURNS TABLE(user_id INTEGER, kind TEXT, due INTEGER, streak INTEGER) AS $$
+DECLARE x RECORD;
+BEGIN
+  FOR x IN
+    UPDATE users u
+    SET
+      follow_up = NULL
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        follow_up <= NOW() AND
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    CONTINUE WHEN NOT x.reminders OR x.state NOT IN (0, 1);
+    -- Anything reviewed since the rehearsal was sent means it wasn't ignored
+    CONTINUE WHEN EXISTS (SELECT 1 FROM card_progress p WHERE p.user_id = x.id AND p.last_review >= x.rehearsal_sent);
+    due = scheduled_cards_due(x.id);
+    CONTINUE WHEN due = 0;
+    user_id = x.id;
+    kind = 'follow_up';
+    streak = review_streak(x.id, date_in_time_zone(x.time_zone));
+    RETURN NEXT;
+  END LOOP;
+
+  FOR x IN
+    UPDATE users u
+    SET
+      streak_warned_on = date_in_time_zone(u.time_zone)
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        reminders AND
+        scheduled AND
+        state IN (0, 1) AND
+        (NOW() AT TIME ZONE time_zone)::TIME >= '21:00' AND
+        streak_warned_on IS DISTINCT FROM date_in_time_zone(time_zone) AND
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME) AND
+        NOT on_vacation(users, date_in_time_zone(time_zone))
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    CONTINUE WHEN EXISTS (SELECT 1 FROM daily_reviews r WHERE r.user_id = x.id AND r.day = date_in_time_zone(x.time_zone));
+    streak = review_streak(x.id, date_in_time_zone(x.time_zone));
+    CONTINUE WHEN streak < 2;
+    due = scheduled_cards_due(x.id);
+    CONTINUE WHEN due = 0;
+    user_id = x.id;
+    kind = 'streak';
+    RETURN NEXT;
+  END LOOP;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS update_users_updated_at ON users;
+CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_decks_updated_at ON decks;
+CREATE TRIGGER update_decks_updated_at BEFORE UPDATE ON decks FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_cards_updated_at ON cards;
+CREATE TRIGGER update_cards_updated_at BEFORE UPDATE ON cards FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_deck_members_updated_at ON deck_members;
+CREATE TRIGGER update_deck_members_updated_at BEFORE UPDATE ON deck_members FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_card_progress_updated_at ON card_progress;
+CREATE TRIGGER update_card_progress_updated_at BEFORE UPDATE ON card_progress FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS update_group_chats_updated_at ON group_chats;
+CREATE TRIGGER update_group_chats_updated_at BEFORE UPDATE ON group_chats FOR EACH ROW EXECUTE PROCEDURE update_updated_at();
+DROP TRIGGER IF EXISTS schedule_user_rehearsal_on_enable ON users;
+CREATE TRIGGER schedule_user_rehearsal_on_enable BEFORE UPDATE ON users FOR EACH ROW EXECUTE PROCEDURE schedule_user_rehearsal();
+DROP TRIGGER IF EXISTS schedule_group_quiz_on_change ON group_chats;
+CREATE TRIGGER schedule_group_quiz_on_change BEFORE INSERT OR UPDATE ON group_chats FOR EACH ROW EXECUTE PROCEDURE schedule_group_quiz();
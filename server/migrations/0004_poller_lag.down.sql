@@ -0,0 +1,99 @@
+DROP FUNCTION scheduled_cards_to_send();
+
+CREATE FUNCTION scheduled_cards_to_send()
+RETURNS TABLE(user_id INTEGER, card_id INTEGER, back_from_vacation BOOLEAN) AS $$
+DECLARE x RECORD;
+BEGIN
+  -- Users that aren't scheduled don't get a rehearsal to welcome them back with,
+  -- but their vacation is over all the same
+  UPDATE users u
+  SET vacation_start = NULL, vacation_end = NULL
+  WHERE NOT u.scheduled AND u.vacation_end < date_in_time_zone(u.time_zone);
+
+  FOR x IN
+    UPDATE users u
+    SET
+      rehearsal = u.next_rehearsal
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        rehearsal <= NOW() AND
+        scheduled AND
+        updated_at < NOW() - INTERVAL '30 minutes' AND
+        -- Users in the middle of something, like a study session or writing a
+        -- card, get their rehearsal once they're back at the deck list or in a
+        -- plain rehearsal
+        state IN (0, 1, 2) AND
+        NOT data ? 'ss'
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The user gets to spread out their backlog instead of getting a card
+    IF x.vacation_end < date_in_time_zone(x.time_zone) THEN
+      UPDATE users uu SET vacation_start = NULL, vacation_end = NULL WHERE uu.id = x.id;
+      user_id = x.id;
+      card_id = NULL;
+      back_from_vacation = TRUE;
+      RETURN NEXT;
+      CONTINUE;
+    END IF;
+
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu
+      SET
+        state = 1,
+        data = '{}',
+        rehearsal_sent = NOW(),
+        follow_up = CASE WHEN uu.reminders THEN NOW() + INTERVAL '3 hours' END
+      WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+
+  -- Cards that were still being learned when the user finished rehearsing
+  FOR x IN
+    UPDATE users u
+    SET
+      learning_reminder = NULL
+    FROM (
+      SELECT id
+      FROM users
+      WHERE
+        learning_reminder <= NOW() AND
+        state = 0 AND
+        -- Reminders that come up during the quiet hours wait until they're over
+        NOT in_quiet_hours(users, (NOW() AT TIME ZONE time_zone)::TIME)
+      LIMIT 20
+      FOR UPDATE SKIP LOCKED
+    ) subset
+    WHERE u.id = subset.id
+    RETURNING u.*
+   LOOP
+    -- The cards that were being learned wait for the first rehearsal after the vacation
+    IF date_in_time_zone(x.time_zone) BETWEEN x.vacation_start AND x.vacation_end THEN
+      CONTINUE;
+    END IF;
+
+    SELECT f.id INTO card_id FROM scheduled_card_for_user(x.id) f;
+
+    IF card_id IS NOT NULL THEN
+      user_id = x.id;
+      back_from_vacation = FALSE;
+      UPDATE users uu SET state = 1, data = '{}' WHERE uu.id = x.id;
+      RETURN NEXT;
+    END IF;
+  END LOOP;
+END;
+$$ language 'plpgsql';
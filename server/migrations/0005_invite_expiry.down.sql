@@ -0,0 +1 @@
+ALTER TABLE deck_invites DROP COLUMN expires_at;
@@ -0,0 +1,3 @@
+-- Invite links stop working after 30 days, so a link that got out can't be
+-- used to join the deck forever. Existing links get 30 days from now.
+ALTER TABLE deck_invites ADD COLUMN expires_at TIMESTAMP NOT NULL DEFAULT NOW() + INTERVAL '30 days';
@@ -0,0 +1 @@
+ALTER TABLE group_chats DROP COLUMN linked_by;
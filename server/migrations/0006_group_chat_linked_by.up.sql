@@ -0,0 +1,3 @@
+-- Who linked the deck to the group, who can change the quiz along with the
+-- admins of the group.
+ALTER TABLE group_chats ADD COLUMN linked_by INTEGER REFERENCES users ON DELETE SET NULL;
@@ -0,0 +1,25 @@
+CREATE OR REPLACE VIEW member_cards AS
+SELECT
+ c.id,
+ c.deck_id,
+ c.created_at,
+ c.updated_at,
+ c.front,
+ c.back,
+ m.user_id,
+ COALESCE(p.easiness_factor, 250)::SMALLINT AS easiness_factor,
+ COALESCE(p.previous_interval, 1)::SMALLINT AS previous_interval,
+ COALESCE(p.repetition, 1)::SMALLINT AS repetition,
+ COALESCE(p.repetition_today, 0)::SMALLINT AS repetition_today,
+ COALESCE(p.random_order, c.random_order) AS random_order,
+ COALESCE(p.next_repetition, c.created_at - INTERVAL '7 days') AS next_repetition,
+ COALESCE(p.learning_step, 0)::SMALLINT AS learning_step,
+ COALESCE(FLOOR(EXTRACT(EPOCH FROM NOW() - p.last_review) / 86400), 0)::SMALLINT AS elapsed_days,
+ p.last_review IS NULL AS is_new,
+ COALESCE(p.lapses, 0)::SMALLINT AS lapses,
+ COALESCE(p.leech, FALSE) AS leech,
+ COALESCE(p.suspended, FALSE) AS suspended,
+ p.buried_until
+FROM cards c
+INNER JOIN deck_members m ON m.deck_id = c.deck_id
+LEFT JOIN card_progress p ON p.card_id = c.id AND p.user_id = m.user_id;
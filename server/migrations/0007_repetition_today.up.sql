@@ -0,0 +1,32 @@
+-- repetition_today only counts the repetitions since midnight in the member's
+-- time zone. A card that was still in learning or failed yesterday is back to
+-- 0, so its first review today counts against the daily limits again.
+CREATE OR REPLACE VIEW member_cards AS
+SELECT
+ c.id,
+ c.deck_id,
+ c.created_at,
+ c.updated_at,
+ c.front,
+ c.back,
+ m.user_id,
+ COALESCE(p.easiness_factor, 250)::SMALLINT AS easiness_factor,
+ COALESCE(p.previous_interval, 1)::SMALLINT AS previous_interval,
+ COALESCE(p.repetition, 1)::SMALLINT AS repetition,
+ (CASE
+  WHEN (p.last_review::TIMESTAMPTZ AT TIME ZONE u.time_zone)::DATE = (NOW() AT TIME ZONE u.time_zone)::DATE THEN p.repetition_today
+  ELSE 0
+ END)::SMALLINT AS repetition_today,
+ COALESCE(p.random_order, c.random_order) AS random_order,
+ COALESCE(p.next_repetition, c.created_at - INTERVAL '7 days') AS next_repetition,
+ COALESCE(p.learning_step, 0)::SMALLINT AS learning_step,
+ COALESCE(FLOOR(EXTRACT(EPOCH FROM NOW() - p.last_review) / 86400), 0)::SMALLINT AS elapsed_days,
+ p.last_review IS NULL AS is_new,
+ COALESCE(p.lapses, 0)::SMALLINT AS lapses,
+ COALESCE(p.leech, FALSE) AS leech,
+ COALESCE(p.suspended, FALSE) AS suspended,
+ p.buried_until
+FROM cards c
+INNER JOIN deck_members m ON m.deck_id = c.deck_id
+INNER JOIN users u ON u.id = m.user_id
+LEFT JOIN card_progress p ON p.card_id = c.id AND p.user_id = m.user_id;
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bouk/memorizationbot/sm"
+)
+
+// A study session ends after a number of cards or an amount of time, whichever
+// the user picked. Its progress is kept in the Data of the user's state.
+
+// InSession is safe to call on the nil Data of states that were set without any.
+func (d *Data) InSession() bool {
+	return d != nil && d.SessionStart != 0
+}
+
+func (d *Data) startSession(goal int, duration time.Duration) {
+	now := time.Now()
+	d.SessionStart = now.Unix()
+	d.SessionGoal = goal
+	if duration > 0 {
+		d.SessionEnd = now.Add(duration).Unix()
+	}
+	d.SessionReviewed = 0
+	d.SessionCorrect = 0
+}
+
+func (d *Data) recordSessionReview(quality int16) {
+	if !d.InSession() {
+		return
+	}
+	d.SessionReviewed++
+	if !sm.SM2Mod.Lapsed(quality) {
+		d.SessionCorrect++
+	}
+}
+
+func (d *Data) sessionOver() bool {
+	if d.SessionGoal > 0 && d.SessionReviewed >= d.SessionGoal {
+		return true
+	}
+	return d.SessionEnd > 0 && time.Now().Unix() >= d.SessionEnd
+}
+
+// sessionProgress describes how far along the session is, like "3/20 cards".
+func (d *Data) sessionProgress() string {
+	if d.SessionGoal > 0 {
+		return fmt.Sprintf("%d/%d cards", d.SessionReviewed, d.SessionGoal)
+	}
+	left := time.Until(time.Unix(d.SessionEnd, 0)).Truncate(time.Minute)
+	if left < time.Minute {
+		return "less than a minute left"
+	}
+	return formatDuration(left) + " left"
+}
+
+// finishSession sends a summary of the session and goes into the next state
+// without the session.
+func finishSession(c *Context, next State, data *Data) error {
+	d := c.data
+	spent := time.Since(time.Unix(d.SessionStart, 0)).Round(time.Second)
+	if d.SessionReviewed == 0 {
+		c.reply("Session over! You didn't review any cards this time.")
+	} else {
+		c.reply("Session over! You reviewed %d cards in %s and got %d%% right.", d.SessionReviewed, formatDuration(spent), d.SessionCorrect*100/d.SessionReviewed)
+	}
+	due, err := c.u.GetNextDue(c.tx, d.DeckID)
+	if err != nil {
+		return err
+	}
+	if due != nil && *due <= 0 {
+		c.reply("There's more cards ready if you want to keep going.")
+	} else if due != nil {
+		c.reply("The next card is due in %s.", formatDue(*due))
+	}
+	return c.u.SetAndShowState(c, next, data)
+}
+
+// parseSessionGoal parses goals like "20 cards" or "10 minutes".
+func parseSessionGoal(s string) (goal int, duration time.Duration, ok bool) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) != 2 {
+		return
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 1 {
+		return
+	}
+	switch strings.TrimSuffix(fields[1], "s") {
+	case "card":
+		return n, 0, true
+	case "minute", "min":
+		return 0, time.Duration(n) * time.Minute, true
+	}
+	return
+}
+
+// formatDue formats how long it takes until a card is due, in days if it's long.
+func formatDue(d time.Duration) string {
+	if days := int(d / (24 * time.Hour)); days > 1 {
+		return fmt.Sprintf("%d days", days)
+	}
+	return formatDuration(d.Truncate(time.Minute))
+}
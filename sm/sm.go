@@ -1,10 +1,15 @@
 package sm
 
-import "fmt"
+import (
+	"fmt"
+	"math/rand"
+)
 
 type algorithm struct {
 	efMapping                   map[int16]int16
 	resetQuality, repeatQuality int16
+	// Cards answered with at least this quality skip the remaining learning steps
+	graduateQuality int16
 }
 
 var (
@@ -17,8 +22,9 @@ var (
 			4: 00,
 			5: 10,
 		},
-		resetQuality:  3,
-		repeatQuality: 4,
+		resetQuality:    3,
+		repeatQuality:   4,
+		graduateQuality: 5,
 	}
 
 	SM2Mod = &algorithm{
@@ -28,8 +34,9 @@ var (
 			2: 00,
 			3: 10,
 		},
-		resetQuality:  2,
-		repeatQuality: 2,
+		resetQuality:    2,
+		repeatQuality:   2,
+		graduateQuality: 3,
 	}
 )
 
@@ -45,6 +52,17 @@ func (a *algorithm) nextEF(q, ef int16) int16 {
 	return ef
 }
 
+// PassQuality is the lowest quality that counts as remembering a card, so
+// everything that only cares about right or wrong agrees with Lapsed.
+func (a *algorithm) PassQuality() int16 {
+	return a.resetQuality
+}
+
+// Lapsed returns whether a card that was already learned got forgotten
+func (a *algorithm) Lapsed(q int16) bool {
+	return q < a.PassQuality()
+}
+
 func (a *algorithm) nextRepetition(q, repetition int16) int16 {
 	if q < a.resetQuality {
 		return 1
@@ -53,28 +71,117 @@ func (a *algorithm) nextRepetition(q, repetition int16) int16 {
 	}
 }
 
-func (a *algorithm) nextInterval(q, ef, repetition, interval int16) int16 {
+// Intervals are capped so they, including fuzz, fit in an int16
+const maxInterval = 30000
+
+// elapsedInterval credits a successful review that happened later than
+// scheduled, since the card was remembered for longer than the interval.
+// Easy recalls get the full elapsed time, others only half of the extra time.
+func (a *algorithm) elapsedInterval(q, interval, elapsed int16) int64 {
+	if elapsed <= interval {
+		return int64(interval)
+	}
+	if q >= a.graduateQuality {
+		return int64(elapsed)
+	}
+	return int64(interval) + int64(elapsed-interval)/2
+}
+
+func (a *algorithm) nextInterval(q, ef, repetition, interval, elapsed int16) int16 {
 	// If q < repeatQuality we need to repeat it today
 	if q < a.repeatQuality {
 		return 0
 	}
 
+	nextInterval := a.elapsedInterval(q, interval, elapsed) * int64(ef)
+	rounded := nextInterval / 100
+	if nextInterval%100 >= 50 {
+		rounded++
+	}
+	if rounded > maxInterval {
+		rounded = maxInterval
+	}
+
 	switch repetition {
 	case 1:
 		return 1
 	case 2:
+		if elapsed > interval && rounded > 6 {
+			return int16(rounded)
+		}
 		return 6
 	default:
-		nextInterval := int64(interval) * int64(ef)
-		interval = int16(nextInterval / 100)
-		if nextInterval%100 >= 50 {
-			interval++
-		}
-		return interval
+		return int16(rounded)
 	}
 }
 
+// elapsed is the amount of days since the card was last reviewed.
 // returns (nextRepetition, nextEF, nextInterval)
-func (a *algorithm) Calc(q, repetition, ef, interval int16) (int16, int16, int16) {
-	return a.nextRepetition(q, repetition), a.nextEF(q, ef), a.nextInterval(q, ef, repetition, interval)
+func (a *algorithm) Calc(q, repetition, ef, interval, elapsed int16) (int16, int16, int16) {
+	return a.nextRepetition(q, repetition), a.nextEF(q, ef), a.nextInterval(q, ef, repetition, interval, elapsed)
+}
+
+// Learning steps are numbered from 1, with 0 meaning the card isn't being learned.
+// returns (nextStep, graduated)
+func (a *algorithm) NextStep(q, step int16, steps int) (int16, bool) {
+	if q < a.repeatQuality {
+		return 1, false
+	}
+	if q >= a.graduateQuality || int(step) >= steps {
+		return 0, true
+	}
+	return step + 1, false
+}
+
+// FuzzRange returns the range of intervals a card can be scheduled in instead of
+// the given interval, without noticeably changing how well it's remembered.
+func FuzzRange(interval int16) (int16, int16) {
+	var fuzz int16
+	switch {
+	case interval < 3:
+		fuzz = 0
+	case interval < 7:
+		fuzz = 1
+	case interval < 30:
+		fuzz = interval * 15 / 100
+		if fuzz < 2 {
+			fuzz = 2
+		}
+	default:
+		// 5%, without going through interval * 5, which overflows for long intervals
+		fuzz = interval / 20
+		if fuzz < 4 {
+			fuzz = 4
+		}
+	}
+	return interval - fuzz, interval + fuzz
+}
+
+// Balance picks an interval in the fuzz range around the given interval, where
+// due maps each interval to the amount of cards that are already due after that
+// many days. Quiet days and days close to the original interval are more likely
+// to be picked, which spreads out cards that would otherwise always be due together.
+func Balance(interval int16, due map[int16]int) int16 {
+	min, max := FuzzRange(interval)
+	weights := make([]float64, 0, max-min+1)
+	total := 0.0
+	for i := min; i <= max; i++ {
+		distance := i - interval
+		if distance < 0 {
+			distance = -distance
+		}
+		load := float64(due[i] + 1)
+		weight := 1 / (load * load * float64(distance+1))
+		weights = append(weights, weight)
+		total += weight
+	}
+
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		pick -= weight
+		if pick < 0 {
+			return min + int16(i)
+		}
+	}
+	return max
 }
@@ -0,0 +1,128 @@
+package sm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNextStep(t *testing.T) {
+	tests := []struct {
+		name      string
+		q, step   int16
+		steps     int
+		next      int16
+		graduated bool
+	}{
+		{"no steps", 2, 1, 0, 0, true},
+		{"single step passed", 2, 1, 1, 0, true},
+		{"single step failed", 1, 1, 1, 1, false},
+		{"single step easy", 3, 1, 1, 0, true},
+		{"first of two passed", 2, 1, 2, 2, false},
+		{"last of two passed", 2, 2, 2, 0, true},
+		{"first of two easy", 3, 1, 2, 0, true},
+		{"last of two failed", 0, 2, 2, 1, false},
+	}
+	for _, test := range tests {
+		next, graduated := SM2Mod.NextStep(test.q, test.step, test.steps)
+		if next != test.next || graduated != test.graduated {
+			t.Errorf("%s: NextStep(%d, %d, %d) = %d, %v, want %d, %v", test.name, test.q, test.step, test.steps, next, graduated, test.next, test.graduated)
+		}
+	}
+}
+
+func TestFuzzRange(t *testing.T) {
+	tests := []struct {
+		interval, min, max int16
+	}{
+		{0, 0, 0},
+		{2, 2, 2},
+		{3, 2, 4},
+		{6, 5, 7},
+		{7, 5, 9},
+		{29, 25, 33},
+		{30, 26, 34},
+		{100, 95, 105},
+		{maxInterval, maxInterval - 1500, maxInterval + 1500},
+	}
+	for _, test := range tests {
+		min, max := FuzzRange(test.interval)
+		if min != test.min || max != test.max {
+			t.Errorf("FuzzRange(%d) = %d, %d, want %d, %d", test.interval, min, max, test.min, test.max)
+		}
+		if max < test.interval || max > math.MaxInt16 {
+			t.Errorf("FuzzRange(%d) goes up to %d", test.interval, max)
+		}
+	}
+}
+
+func TestBalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval int16
+		due      map[int16]int
+		quiet    int16 // The day that should be picked most, if any
+	}{
+		{"no fuzz", 2, map[int16]int{2: 100}, 2},
+		{"nothing due", 20, nil, 20},
+		{"one quiet day", 20, map[int16]int{17: 100, 18: 100, 19: 100, 20: 100, 21: 100, 22: 100}, 23},
+		{"max interval", maxInterval, nil, maxInterval},
+	}
+	for _, test := range tests {
+		min, max := FuzzRange(test.interval)
+		picked := map[int16]int{}
+		for i := 0; i < 1000; i++ {
+			n := Balance(test.interval, test.due)
+			if n < min || n > max {
+				t.Fatalf("%s: Balance(%d) = %d, outside of %d-%d", test.name, test.interval, n, min, max)
+			}
+			picked[n]++
+		}
+		for n, count := range picked {
+			if n != test.quiet && count > picked[test.quiet] {
+				t.Errorf("%s: %d was picked %d times, more than %d with %d", test.name, n, count, test.quiet, picked[test.quiet])
+			}
+		}
+	}
+}
+
+func TestElapsedInterval(t *testing.T) {
+	tests := []struct {
+		name                 string
+		q, interval, elapsed int16
+		want                 int64
+	}{
+		{"early", 2, 10, 5, 10},
+		{"on time", 2, 10, 10, 10},
+		{"late", 2, 10, 20, 15},
+		{"late and easy", 3, 10, 20, 20},
+		{"late at the max interval", 2, maxInterval, math.MaxInt16, maxInterval + (math.MaxInt16-maxInterval)/2},
+		{"late and easy at the max interval", 3, maxInterval, math.MaxInt16, math.MaxInt16},
+	}
+	for _, test := range tests {
+		if got := SM2Mod.elapsedInterval(test.q, test.interval, test.elapsed); got != test.want {
+			t.Errorf("%s: elapsedInterval(%d, %d, %d) = %d, want %d", test.name, test.q, test.interval, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestCalc(t *testing.T) {
+	tests := []struct {
+		name                              string
+		q, repetition, ef, interval, days int16
+		wantRepetition, wantEF, wantDays  int16
+	}{
+		{"failed", 1, 3, 250, 10, 10, 1, 220, 0},
+		{"first repetition", 2, 1, 250, 1, 1, 2, 250, 1},
+		{"second repetition", 2, 2, 250, 1, 1, 3, 250, 6},
+		{"second repetition late", 3, 2, 250, 1, 10, 3, 260, 25},
+		{"third repetition", 2, 3, 250, 6, 6, 4, 250, 15},
+		{"elapsed longer than the interval", 2, 3, 250, 6, 10, 4, 250, 20},
+		{"capped at the max interval", 3, 5, 250, maxInterval, maxInterval, 6, 260, maxInterval},
+	}
+	for _, test := range tests {
+		repetition, ef, days := SM2Mod.Calc(test.q, test.repetition, test.ef, test.interval, test.days)
+		if repetition != test.wantRepetition || ef != test.wantEF || days != test.wantDays {
+			t.Errorf("%s: Calc = %d, %d, %d, want %d, %d, %d", test.name, repetition, ef, days, test.wantRepetition, test.wantEF, test.wantDays)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"gopkg.in/telegram-bot-api.v4"
@@ -10,9 +11,23 @@ import (
 type Data struct {
 	DeckID   int       `json:"d,omitempy"`
 	CardID   int       `json:"c,omitempy"`
+	CramID   int       `json:"cr,omitempty"`
 	Messages []Message `json:"m,omitempy"`
 	Front    []Message `json:"f,omitempy"`
 	Back     []Message `json:"b,omitempy"`
+
+	// Study session, see session.go
+	SessionStart    int64 `json:"ss,omitempty"`
+	SessionEnd      int64 `json:"se,omitempty"`
+	SessionGoal     int   `json:"sg,omitempty"`
+	SessionReviewed int   `json:"sr,omitempty"`
+	SessionCorrect  int   `json:"sc,omitempty"`
+
+	// Picking a time zone from search results, see timeZonePage
+	TimeZoneQuery string `json:"tq,omitempty"`
+	Page          int    `json:"p,omitempty"`
+	// Set while the time zone is picked for the first time
+	Onboarding bool `json:"o,omitempty"`
 }
 
 type State uint
@@ -79,9 +94,113 @@ const (
 
 	SetRehearsalTime
 
+	// Lets the owner of a deck pick the role for an invite code to share
+	DeckShare
+
+	// Takes in the daily limits of a deck
+	DeckNewCardsPerDayEdit
+	DeckMaxReviewsPerDayEdit
+
+	// Takes in the learning steps of a deck, like "1m 10m 1h"
+	DeckLearningStepsEdit
+
+	// Pick the order in which cards of a deck get reviewed
+	DeckOrderEdit
+
+	// Pause rehearsals for a number of days, or end the vacation early
+	VacationEdit
+
+	// Reschedule the reviews that piled up over the next few days
+	BacklogSpread
+
+	// Go through the cards of a deck that keep getting forgotten
+	DeckLeeches
+
+	// Takes in after how many lapses cards become leeches, and what happens to them
+	DeckLeechThresholdEdit
+
+	// Go through the suspended cards of a deck so they can be unsuspended
+	DeckSuspended
+
+	// Toggle the days of the week rehearsals get sent on
+	SetRehearsalDays
+
+	// Takes in the window in which no rehearsals get sent
+	SetQuietHours
+
+	// Pick how many cards or how long to study for, in a deck or in all scheduled decks
+	SessionSetup
+
+	// Pick whether to cram all cards of a deck or only the ones that were forgotten
+	CramSetup
+
+	// Like Rehearsing and RehearsingCardReview, but for a cram which doesn't
+	// affect the schedule
+	Cramming
+	CrammingCardReview
+
+	// Pick a time zone from the ones that matched what the user typed in
+	// SetTimeZone or UserSetup
+	TimeZonePick
+
+	// Shows the time zone that was found for the user's location, which can be
+	// wrong close to a border, so they can type their city instead
+	TimeZoneConfirm
+
 	stateCount
 )
 
+var stateNames = [stateCount]string{
+	DeckList:                 "DeckList",
+	Rehearsing:               "Rehearsing",
+	RehearsingCardReview:     "RehearsingCardReview",
+	DeckCreate:               "DeckCreate",
+	CardSearch:               "CardSearch",
+	DeckDetails:              "DeckDetails",
+	CardCreate:               "CardCreate",
+	CardCreateBack:           "CardCreateBack",
+	CardDelete:               "CardDelete",
+	CardDetails:              "CardDetails",
+	CardReview:               "CardReview",
+	CardUpdate:               "CardUpdate",
+	DeckEdit:                 "DeckEdit",
+	CardEdit:                 "CardEdit",
+	DeckDelete:               "DeckDelete",
+	DeckNameEdit:             "DeckNameEdit",
+	CardEditFront:            "CardEditFront",
+	CardEditBack:             "CardEditBack",
+	SetTimeZone:              "SetTimeZone",
+	Settings:                 "Settings",
+	UserSetup:                "UserSetup",
+	SetRehearsalTime:         "SetRehearsalTime",
+	DeckShare:                "DeckShare",
+	DeckNewCardsPerDayEdit:   "DeckNewCardsPerDayEdit",
+	DeckMaxReviewsPerDayEdit: "DeckMaxReviewsPerDayEdit",
+	DeckLearningStepsEdit:    "DeckLearningStepsEdit",
+	DeckOrderEdit:            "DeckOrderEdit",
+	VacationEdit:             "VacationEdit",
+	BacklogSpread:            "BacklogSpread",
+	DeckLeeches:              "DeckLeeches",
+	DeckLeechThresholdEdit:   "DeckLeechThresholdEdit",
+	DeckSuspended:            "DeckSuspended",
+	SetRehearsalDays:         "SetRehearsalDays",
+	SetQuietHours:            "SetQuietHours",
+	SessionSetup:             "SessionSetup",
+	CramSetup:                "CramSetup",
+	Cramming:                 "Cramming",
+	CrammingCardReview:       "CrammingCardReview",
+	TimeZonePick:             "TimeZonePick",
+	TimeZoneConfirm:          "TimeZoneConfirm",
+}
+
+// String returns the name of the state, like "DeckList", for logs and metrics.
+func (s State) String() string {
+	if s < stateCount && stateNames[s] != "" {
+		return stateNames[s]
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
 func (s State) Show(c *Context) error {
 	u := c.u
 	tx := c.tx
@@ -108,24 +227,40 @@ func (s State) Show(c *Context) error {
 		if len(decks) == 0 {
 			replyMessage = createReply("You're now ready to create your first deck, so press '%s' to get started.", AddDeck)
 		} else {
-			for _, deck := range decks {
+			for _, label := range deckLabels(decks) {
 				keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
-					tgbotapi.NewKeyboardButton(deck.Name),
+					tgbotapi.NewKeyboardButton(label),
 				))
 			}
 			replyMessage = createReply("Select the deck you want to work on.")
 		}
 		keyboard.OneTimeKeyboard = true
 		replyMessage.ReplyMarkup = keyboard
-		Send(replyMessage)
+		c.send(replyMessage)
 	case Rehearsing:
+		if data.InSession() && data.sessionOver() {
+			return finishSession(c, DeckList, nil)
+		}
 		card, err := u.GetScheduledCard(tx)
 		if err != nil {
 			return err
 		}
 
-		if card == nil {
-			reply("Done with rehearsal for today!")
+		if card == nil && data.InSession() {
+			return finishSession(c, DeckList, nil)
+		} else if card == nil {
+			due, err := u.GetNextLearningDue(tx)
+			if err != nil {
+				return err
+			}
+			if due == nil {
+				reply("Done with rehearsal for today!")
+			} else {
+				if err = u.SetLearningReminder(tx, *due); err != nil {
+					return err
+				}
+				reply("Done for now! I'll send you the cards you're still learning in %s.", formatDuration(*due))
+			}
 			return u.SetAndShowState(c, DeckList, nil)
 		} else {
 			keyboard := tgbotapi.NewReplyKeyboard(
@@ -136,51 +271,110 @@ func (s State) Show(c *Context) error {
 					tgbotapi.NewKeyboardButton(EditCard),
 					tgbotapi.NewKeyboardButton(ShowReverseOfCard),
 				),
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(BuryCard),
+					tgbotapi.NewKeyboardButton(SuspendCard),
+				),
 			)
 			keyboard.OneTimeKeyboard = true
-			card.SendFront(u.ID, keyboard)
+			if data.InSession() {
+				reply("%s", data.sessionProgress())
+			}
+			card.SendFront(c.m, c.from, keyboard)
 			return nil
 		}
 	case DeckDetails:
+		if data.InSession() && data.sessionOver() {
+			return finishSession(c, DeckDetails, &Data{DeckID: data.DeckID})
+		}
 		deck, totalCards, cardsLeft, err := u.GetDeckWithStats(tx, data.DeckID)
 		if err != nil {
 			return err
 		}
-		keyboard := tgbotapi.NewReplyKeyboard(
-			tgbotapi.NewKeyboardButtonRow(
-				tgbotapi.NewKeyboardButton(Back),
-				tgbotapi.NewKeyboardButton(EditDeck),
-				tgbotapi.NewKeyboardButton(AddCard),
-			),
+		if cardsLeft == 0 && data.InSession() {
+			return finishSession(c, DeckDetails, &Data{DeckID: data.DeckID})
+		}
+		row := tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(Back),
+			tgbotapi.NewKeyboardButton(EditDeck),
 		)
+		if deck.Role.CanEditCards() {
+			row = append(row, tgbotapi.NewKeyboardButton(AddCard))
+		}
+		keyboard := tgbotapi.NewReplyKeyboard(row)
 		keyboard.OneTimeKeyboard = true
+		leeches, err := deck.CountLeeches(tx)
+		if err != nil {
+			return err
+		}
+		if leeches > 0 {
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(LeechesFormat, leeches)),
+			))
+		}
+		suspended, err := deck.CountSuspended(tx)
+		if err != nil {
+			return err
+		}
+		if suspended > 0 {
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(SuspendedCardsFormat, suspended)),
+			))
+		}
+		if totalCards > 0 {
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(CramDeck),
+			))
+		}
 
-		if totalCards == 0 {
+		if totalCards == 0 && !deck.Role.CanEditCards() {
+			msg := createReply("This deck has no cards yet.")
+			msg.ReplyMarkup = keyboard
+			c.send(msg)
+			return nil
+		} else if totalCards == 0 {
 			msg := createReply("You currently have no cards, so press '%s' to create one.", AddCard)
 			msg.ReplyMarkup = keyboard
-			Send(msg)
+			c.send(msg)
 			return nil
 		} else if cardsLeft == 0 {
-			msg := createReply("No more cards to review today.")
+			due, err := deck.GetNextLearningDue(tx)
+			if err != nil {
+				return err
+			}
+			var msg tgbotapi.MessageConfig
+			if due == nil {
+				msg = createReply("No more cards to review today.")
+			} else {
+				msg = createReply("No more cards to review right now, the next card you're learning is due in %s.", formatDuration(*due))
+			}
 			msg.ReplyMarkup = keyboard
-			Send(msg)
+			c.send(msg)
 			return nil
 		} else {
-			reply("%d/%d cards left to rehearse in '%s'", cardsLeft, totalCards, deck.Name)
+			if data.InSession() {
+				reply("%s, %d cards left to rehearse in '%s'", data.sessionProgress(), cardsLeft, deck.Name)
+			} else {
+				reply("%d/%d cards left to rehearse in '%s'", cardsLeft, totalCards, deck.Name)
+				keyboard.Keyboard[0] = append(keyboard.Keyboard[0], tgbotapi.NewKeyboardButton(StartSession))
+			}
 
 			card, err := deck.GetCardForReview(c)
 			if err != nil {
 				return err
 			}
 
-			keyboard.Keyboard = append(keyboard.Keyboard,
-				tgbotapi.NewKeyboardButtonRow(
-					tgbotapi.NewKeyboardButton(EditCard),
-					tgbotapi.NewKeyboardButton(ShowReverseOfCard),
-				),
-			)
+			row := tgbotapi.NewKeyboardButtonRow()
+			if deck.Role.CanEditCards() {
+				row = append(row, tgbotapi.NewKeyboardButton(EditCard))
+			}
+			row = append(row, tgbotapi.NewKeyboardButton(ShowReverseOfCard))
+			keyboard.Keyboard = append(keyboard.Keyboard, row, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(BuryCard),
+				tgbotapi.NewKeyboardButton(SuspendCard),
+			))
 
-			card.SendFront(u.ID, keyboard)
+			card.SendFront(c.m, c.from, keyboard)
 			return nil
 		}
 	case CardCreate:
@@ -188,34 +382,49 @@ func (s State) Show(c *Context) error {
 	case CardCreateBack:
 		reply("Please send a message to use for the back.")
 	case CardEdit:
+		card, err := GetCard(tx, u.ID, data.CardID)
+		if err != nil {
+			return err
+		}
+		editable, err := u.GetEditableCard(tx, data.CardID)
+		if err != nil {
+			return err
+		}
 		msg := createReply("What would you like to do?")
 		keyboard := tgbotapi.NewReplyKeyboard(
 			tgbotapi.NewKeyboardButtonRow(
 				tgbotapi.NewKeyboardButton(Back),
-				tgbotapi.NewKeyboardButton(DeleteCard),
 			),
-			tgbotapi.NewKeyboardButtonRow(
+		)
+		// Viewers can only change their own progress on the card
+		if editable != nil {
+			keyboard.Keyboard[0] = append(keyboard.Keyboard[0], tgbotapi.NewKeyboardButton(DeleteCard))
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
 				tgbotapi.NewKeyboardButton(EditCardFront),
 				tgbotapi.NewKeyboardButton(EditCardBack),
-			),
-		)
+			))
+		}
+		keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(BuryCard),
+			tgbotapi.NewKeyboardButton(stringTernary(card.Suspended, UnsuspendCard, SuspendCard)),
+		))
 		keyboard.OneTimeKeyboard = true
 		msg.ReplyMarkup = keyboard
-		Send(msg)
+		c.send(msg)
 	case CardEditFront:
-		card, err := GetCard(tx, data.CardID)
+		card, err := GetCard(tx, u.ID, data.CardID)
 		if err != nil {
 			return err
 		}
 		reply("I'm now going to send you the front, please send me back what you want to replace it with.")
-		return card.SendFront(u.ID, nil)
+		return card.SendFront(c.m, c.from, nil)
 	case CardEditBack:
-		card, err := GetCard(tx, data.CardID)
+		card, err := GetCard(tx, u.ID, data.CardID)
 		if err != nil {
 			return err
 		}
 		reply("I'm now going to send you the back, please send me back what you want to replace it with.")
-		return card.SendBack(u.ID, nil)
+		return card.SendBack(c.m, c.from, nil)
 	case DeckCreate:
 		reply("What's the name of the new deck?")
 	case RehearsingCardReview:
@@ -223,7 +432,7 @@ func (s State) Show(c *Context) error {
 		if err != nil {
 			return err
 		}
-		card.SendBack(int(c.from), CardReplyKeyboard)
+		card.SendBack(c.m, c.from, CardReplyKeyboard)
 		return nil
 	case CardReview:
 		deck, err := u.GetDeck(tx, data.DeckID)
@@ -234,16 +443,55 @@ func (s State) Show(c *Context) error {
 		if err != nil {
 			return err
 		}
-		card.SendBack(int(c.from), CardReplyKeyboard)
+		if card == nil {
+			return u.SetAndShowState(c, DeckDetails, data)
+		}
+		card.SendBack(c.m, c.from, CardReplyKeyboard)
 		return nil
 	case SetTimeZone:
-		msg := createReply("Please send me your location, so I can determine your time zone! 🌍")
+		msg := createReply("Please send me your location, so I can determine your time zone! 🌍 You can also type the name of your city or time zone, or your UTC offset like 'UTC+2'.")
 		msg.ReplyMarkup = tgbotapi.NewReplyKeyboard(
 			tgbotapi.NewKeyboardButtonRow(
 				tgbotapi.NewKeyboardButtonLocation("Send location"),
 			),
 		)
-		Send(msg)
+		c.send(msg)
+		return nil
+	case TimeZonePick:
+		ids, more := timeZonePage(SearchTimeZones(data.TimeZoneQuery), data.Page)
+		msg := createReply("Which of these is your time zone? You can also search for another one.")
+		keyboard := tgbotapi.NewReplyKeyboard()
+		now := time.Now()
+		for _, id := range ids {
+			offset, _ := timeZoneOffset(id, now)
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(TimeZoneFormat, id, formatUTCOffset(offset))),
+			))
+		}
+		var pages []tgbotapi.KeyboardButton
+		if data.Page > 0 {
+			pages = append(pages, tgbotapi.NewKeyboardButton(Previous))
+		}
+		if more {
+			pages = append(pages, tgbotapi.NewKeyboardButton(Next))
+		}
+		pages = append(pages, tgbotapi.NewKeyboardButton(Back))
+		keyboard.Keyboard = append(keyboard.Keyboard, pages)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+		return nil
+	case TimeZoneConfirm:
+		offset, _ := timeZoneOffset(u.TimeZone, time.Now())
+		msg := createReply("Your location looks like it's in the '%s' time zone (%s). Not right? Type the name of your city to pick another one.", u.TimeZone, formatUTCOffset(offset))
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(TimeZoneCorrect),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
 		return nil
 	case DeckDelete:
 		_, totalCards, _, err := u.GetDeckWithStats(tx, data.DeckID)
@@ -259,7 +507,7 @@ func (s State) Show(c *Context) error {
 				tgbotapi.NewKeyboardButton(ConfirmDeleteDeck),
 			),
 		)
-		Send(msg)
+		c.send(msg)
 		return nil
 	case DeckEdit:
 		deck, err := u.GetDeck(tx, data.DeckID)
@@ -268,19 +516,52 @@ func (s State) Show(c *Context) error {
 		}
 
 		msg := createReply("What do you want to do with '%s'?", deck.Name)
-		keyboard := tgbotapi.NewReplyKeyboard(
+		var keyboard tgbotapi.ReplyKeyboardMarkup
+		if deck.Role.CanEditDeck() {
+			keyboard = tgbotapi.NewReplyKeyboard(
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(Back),
+					tgbotapi.NewKeyboardButton(DeleteDeck),
+				),
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(stringTernary(deck.Scheduled, DisableScheduling, EnableScheduling)),
+					tgbotapi.NewKeyboardButton(EditName),
+				),
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(ShareDeck),
+				),
+			)
+		} else {
+			keyboard = tgbotapi.NewReplyKeyboard(
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(Back),
+					tgbotapi.NewKeyboardButton(LeaveDeck),
+				),
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(stringTernary(deck.Scheduled, DisableScheduling, EnableScheduling)),
+				),
+			)
+		}
+		keyboard.Keyboard = append(keyboard.Keyboard,
 			tgbotapi.NewKeyboardButtonRow(
-				tgbotapi.NewKeyboardButton(Back),
-				tgbotapi.NewKeyboardButton(DeleteDeck),
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(NewCardsPerDayFormat, deck.NewCardsPerDay)),
 			),
 			tgbotapi.NewKeyboardButtonRow(
-				tgbotapi.NewKeyboardButton(stringTernary(deck.Scheduled, DisableScheduling, EnableScheduling)),
-				tgbotapi.NewKeyboardButton(EditName),
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(MaxReviewsPerDayFormat, deck.MaxReviewsPerDay)),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(LearningStepsFormat, formatSteps(deck.LearningSteps))),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(EditOrder),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(LeechThresholdFormat, deck.LeechThreshold)),
 			),
 		)
 		keyboard.OneTimeKeyboard = true
 		msg.ReplyMarkup = keyboard
-		Send(msg)
+		c.send(msg)
 		return nil
 	case DeckNameEdit:
 		deck, err := u.GetDeck(tx, data.DeckID)
@@ -299,31 +580,382 @@ func (s State) Show(c *Context) error {
 				tgbotapi.NewKeyboardButton(fmt.Sprintf(ChangeLocationFormat, u.TimeZone)),
 			),
 			tgbotapi.NewKeyboardButtonRow(
-				tgbotapi.NewKeyboardButton(fmt.Sprintf(ChangeTimeToRehearseFormat, u.RehearsalTime.Format(TimeFormat))),
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(ChangeTimeToRehearseFormat, formatTimes(u.RehearsalTimes))),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(RehearsalDaysFormat, formatDays(u.RehearsalDays))),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(QuietHoursFormat, formatQuietHours(u.QuietStart, u.QuietEnd))),
 			),
 			tgbotapi.NewKeyboardButtonRow(
 				tgbotapi.NewKeyboardButton(stringTernary(u.Scheduled, DisableScheduling, EnableScheduling)),
 			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(stringTernary(u.RoundRobin, DisableRoundRobin, EnableRoundRobin)),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(stringTernary(u.Reminders, DisableReminders, EnableReminders)),
+			),
 		)
+		if u.VacationEnd.Valid {
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(VacationFormat, u.VacationEnd.Time.Format(DateFormat))),
+			))
+		} else {
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Vacation),
+			))
+		}
 
 		keyboard.OneTimeKeyboard = true
 		msg.ReplyMarkup = keyboard
-		Send(msg)
+		c.send(msg)
 		return nil
 	case UserSetup:
 		reply("Hi there!")
-		time.Sleep(time.Second)
-		HelpUser(int64(u.ID))
-		msg := createReply("Now, to get started please send me your location, so I can determine your time zone! 🌍")
+		pause(time.Second)
+		HelpUser(c.m, int64(u.ID))
+		msg := createReply("Now, to get started please send me your location, so I can determine your time zone! 🌍 If you'd rather not, type the name of your city or time zone, or your UTC offset like 'UTC+2'.")
 		msg.ReplyMarkup = tgbotapi.NewReplyKeyboard(
 			tgbotapi.NewKeyboardButtonRow(
 				tgbotapi.NewKeyboardButtonLocation("Send location"),
 			),
 		)
-		Send(msg)
+		c.send(msg)
+	case DeckShare:
+		deck, err := u.GetDeck(tx, data.DeckID)
+		if err != nil {
+			return err
+		}
+		msg := createReply("Should the people you share '%s' with be able to edit its cards?", deck.Name)
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(ShareReadOnly),
+				tgbotapi.NewKeyboardButton(ShareEditable),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(RevokeInvites),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case DeckNewCardsPerDayEdit:
+		msg := createReply("How many new cards do you want to learn per day? You can also type out the number yourself.")
+		keyboard := numberKeyboard(5, 10, 20, 50, 100)
+		keyboard.Keyboard = append([][]tgbotapi.KeyboardButton{tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(Back),
+		)}, keyboard.Keyboard...)
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case DeckMaxReviewsPerDayEdit:
+		msg := createReply("How many cards do you want to review at most per day? You can also type out the number yourself.")
+		keyboard := numberKeyboard(50, 100, 200, 500, 1000)
+		keyboard.Keyboard = append([][]tgbotapi.KeyboardButton{tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(Back),
+		)}, keyboard.Keyboard...)
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case DeckOrderEdit:
+		deck, err := u.GetDeck(tx, data.DeckID)
+		if err != nil {
+			return err
+		}
+		var order, position string
+		switch deck.ReviewOrder {
+		case OrderRandom:
+			order = "in random order"
+		case OrderEase:
+			order = "hardest first"
+		default:
+			order = "oldest first"
+		}
+		switch deck.NewCardPosition {
+		case NewCardsFirst:
+			position = "before"
+		case NewCardsLast:
+			position = "after"
+		default:
+			position = "mixed in with"
+		}
+		msg := createReply("Cards in '%s' are reviewed %s, with new cards %s the others.", deck.Name, order, position)
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(OrderByDue),
+				tgbotapi.NewKeyboardButton(OrderRandomly),
+				tgbotapi.NewKeyboardButton(OrderByEase),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(NewCardsMixedIn),
+				tgbotapi.NewKeyboardButton(NewCardsBefore),
+				tgbotapi.NewKeyboardButton(NewCardsAfter),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case DeckLearningStepsEdit:
+		msg := createReply("New cards and cards you got wrong are repeated after each of the learning steps before they're scheduled in days. Please send the steps separated by spaces, like '1m 10m 1h', or 'none'.")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(Back)),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("1m 10m")),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("1m 10m 1h")),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("10m")),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("none")),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case VacationEdit:
+		var msg tgbotapi.MessageConfig
+		var keyboard tgbotapi.ReplyKeyboardMarkup
+		if u.VacationEnd.Valid {
+			msg = createReply("You're on vacation from %s until %s, so I won't send you any rehearsals until then.", u.VacationStart.Time.Format(DateFormat), u.VacationEnd.Time.Format(DateFormat))
+			keyboard = tgbotapi.NewReplyKeyboard(
+				tgbotapi.NewKeyboardButtonRow(
+					tgbotapi.NewKeyboardButton(Back),
+					tgbotapi.NewKeyboardButton(EndVacation),
+				),
+			)
+		} else {
+			msg = createReply("How many days will you be away? You can also send me the first and the last day, like '%s %s'.", u.Today().Format(DateFormat), u.Today().AddDate(0, 0, 6).Format(DateFormat))
+			keyboard = numberKeyboard(3, 7, 14, 30)
+			keyboard.Keyboard = append([][]tgbotapi.KeyboardButton{tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			)}, keyboard.Keyboard...)
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(SpreadBacklog),
+			))
+		}
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case BacklogSpread:
+		backlog, err := u.GetBacklog(tx)
+		if err != nil {
+			return err
+		}
+		if backlog == 0 {
+			reply("You're all caught up, there's no cards waiting for you.")
+			return u.SetAndShowState(c, DeckList, nil)
+		}
+		msg := createReply("%d cards are waiting to be reviewed. Over how many days do you want to catch up on them?", backlog)
+		keyboard := numberKeyboard(1, 3, 7, 14)
+		keyboard.Keyboard = append([][]tgbotapi.KeyboardButton{tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(Back),
+		)}, keyboard.Keyboard...)
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case DeckLeeches:
+		deck, err := u.GetDeck(tx, data.DeckID)
+		if err != nil {
+			return err
+		}
+		card, err := deck.GetLeech(tx, data.CardID)
+		if err != nil {
+			return err
+		}
+		if card == nil && data.CardID > 0 {
+			// Start over from the first leech
+			card, err = deck.GetLeech(tx, 0)
+			if err != nil {
+				return err
+			}
+		}
+		if card == nil {
+			reply("There are no leeches in '%s'.", deck.Name)
+			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+		}
+		if card.ID != data.CardID {
+			data.CardID = card.ID
+			if err = u.SetState(tx, DeckLeeches, data); err != nil {
+				return err
+			}
+		}
+		reply("You forgot this card %d times%s.", card.Lapses, stringTernary(card.Suspended, " so it's suspended", ""))
+		row := tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(Back),
+		)
+		if deck.Role.CanEditCards() {
+			row = append(row, tgbotapi.NewKeyboardButton(EditCard))
+		}
+		keyboard := tgbotapi.NewReplyKeyboard(
+			row,
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(NotALeech),
+				tgbotapi.NewKeyboardButton(Next),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		if err = card.SendFront(c.m, c.from, nil); err != nil {
+			return err
+		}
+		return card.SendBack(c.m, c.from, keyboard)
+	case DeckSuspended:
+		deck, err := u.GetDeck(tx, data.DeckID)
+		if err != nil {
+			return err
+		}
+		card, err := deck.GetSuspended(tx, data.CardID)
+		if err != nil {
+			return err
+		}
+		if card == nil && data.CardID > 0 {
+			card, err = deck.GetSuspended(tx, 0)
+			if err != nil {
+				return err
+			}
+		}
+		if card == nil {
+			reply("There are no suspended cards in '%s'.", deck.Name)
+			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: deck.ID})
+		}
+		if card.ID != data.CardID {
+			data.CardID = card.ID
+			if err = u.SetState(tx, DeckSuspended, data); err != nil {
+				return err
+			}
+		}
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(UnsuspendCard),
+				tgbotapi.NewKeyboardButton(Next),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		return card.SendFront(c.m, c.from, keyboard)
+	case DeckLeechThresholdEdit:
+		deck, err := u.GetDeck(tx, data.DeckID)
+		if err != nil {
+			return err
+		}
+		msg := createReply("Cards become leeches after you forget them %d times, and then they're %s. After how many times should that be? You can also type out the number yourself.", deck.LeechThreshold, stringTernary(deck.LeechAction == LeechSuspend, "suspended", "only tagged"))
+		keyboard := numberKeyboard(4, 8, 12, 16)
+		keyboard.Keyboard = append([][]tgbotapi.KeyboardButton{tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(Back),
+			tgbotapi.NewKeyboardButton(stringTernary(deck.LeechAction == LeechSuspend, TagLeeches, SuspendLeeches)),
+		)}, keyboard.Keyboard...)
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case SessionSetup:
+		msg := createReply("How much do you want to study? You can also type it out yourself, like '30 cards' or '15 minutes'.")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton("10 cards"),
+				tgbotapi.NewKeyboardButton("20 cards"),
+				tgbotapi.NewKeyboardButton("50 cards"),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton("5 minutes"),
+				tgbotapi.NewKeyboardButton("10 minutes"),
+				tgbotapi.NewKeyboardButton("20 minutes"),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case CramSetup:
+		msg := createReply("Cramming goes through the cards until you know all of them, without changing when they're due. Which cards do you want to cram?")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(CramAll),
+				tgbotapi.NewKeyboardButton(CramFailed),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case Cramming:
+		cram, err := GetCram(tx, u.ID, data.CramID)
+		if err != nil {
+			return err
+		}
+		if cram == nil {
+			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: data.DeckID})
+		}
+		card, err := cram.GetCard(tx)
+		if err != nil {
+			return err
+		}
+		if card == nil {
+			cards, firstTry, err := cram.Stats(tx)
+			if err != nil {
+				return err
+			}
+			if cards == 0 {
+				reply("There were no cards to cram.")
+			} else {
+				reply("Done cramming! You went through %d cards and got %d%% right the first time.", cards, firstTry*100/cards)
+			}
+			return u.SetAndShowState(c, DeckDetails, &Data{DeckID: cram.DeckID})
+		}
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+				tgbotapi.NewKeyboardButton(ShowReverseOfCard),
+			),
+		)
+		keyboard.OneTimeKeyboard = true
+		if card.ID != data.CardID {
+			data.CardID = card.ID
+			if err = u.SetState(tx, Cramming, data); err != nil {
+				return err
+			}
+		}
+		return card.SendFront(c.m, c.from, keyboard)
+	case CrammingCardReview:
+		card, err := GetCard(tx, u.ID, data.CardID)
+		if err != nil {
+			return err
+		}
+		return card.SendBack(c.m, c.from, CardReplyKeyboard)
+	case SetRehearsalDays:
+		msg := createReply("On which days of the week do you want me to send you rehearsals? Press a day to turn it on or off.")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(Back),
+			),
+		)
+		for _, d := range weekdays {
+			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(fmt.Sprintf(stringTernary(hasDay(u.RehearsalDays, d), DayEnabledFormat, DayDisabledFormat), d)),
+			))
+		}
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
+	case SetQuietHours:
+		msg := createReply("During your quiet hours I won't send you any rehearsals or reminders. Please send me when they start and end, like '22:00 08:00', or 'off'.")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(Back)),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("22:00 08:00")),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("21:00 09:00")),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("off")),
+		)
+		keyboard.OneTimeKeyboard = true
+		msg.ReplyMarkup = keyboard
+		c.send(msg)
 	case SetRehearsalTime:
-		msg := createReply("Please select your preferred time of day to rehearse. You can also type out the time yourself.")
-		keyboard := tgbotapi.NewReplyKeyboard()
+		msg := createReply("Please select your preferred time of day to rehearse. You can also type out several times yourself, like '08:00 13:00 20:00', and I'll remind you at each of them if there's still cards left.")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("08:00 13:00 20:00")),
+			tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("09:00 18:00")),
+		)
 		for i := 0; i < 18; i++ {
 			keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
 				tgbotapi.NewKeyboardButton(time.Date(2000, time.January, 1, 5+i, 0, 0, 0, time.UTC).Format(TimeFormat)),
@@ -331,11 +963,22 @@ func (s State) Show(c *Context) error {
 		}
 		keyboard.OneTimeKeyboard = true
 		msg.ReplyMarkup = keyboard
-		Send(msg)
+		c.send(msg)
 	}
 	return nil
 }
 
+func numberKeyboard(numbers ...int) tgbotapi.ReplyKeyboardMarkup {
+	keyboard := tgbotapi.NewReplyKeyboard()
+	for _, n := range numbers {
+		keyboard.Keyboard = append(keyboard.Keyboard, tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(strconv.Itoa(n)),
+		))
+	}
+	keyboard.OneTimeKeyboard = true
+	return keyboard
+}
+
 func stringTernary(x bool, a string, b string) string {
 	if x {
 		return a
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStateString(t *testing.T) {
+	for s := DeckList; s < stateCount; s++ {
+		if stateNames[s] == "" {
+			t.Errorf("state %d has no name", s)
+		}
+	}
+	if got := TimeZoneConfirm.String(); got != "TimeZoneConfirm" {
+		t.Errorf("TimeZoneConfirm.String() = %q", got)
+	}
+	if got, want := stateCount.String(), fmt.Sprintf("State(%d)", int(stateCount)); got != want {
+		t.Errorf("stateCount.String() = %q, want %q", got, want)
+	}
+}
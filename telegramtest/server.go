@@ -0,0 +1,252 @@
+// Package telegramtest runs a local server that acts like the Telegram Bot API,
+// so whole conversations with the bot can be tested without talking to Telegram.
+//
+// Point the bot at it with NewBotAPI, feed it updates with PostUpdate and look
+// at what it sent back with Requests or Texts. The bot still needs a database,
+// for example a local Postgres set up with "memorizationbot migrate up".
+package telegramtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Request is a call the bot made to the Bot API.
+type Request struct {
+	// Like "sendMessage"
+	Method string
+	Params url.Values
+}
+
+func (r Request) ChatID() int64 {
+	id, _ := strconv.ParseInt(r.Params.Get("chat_id"), 10, 64)
+	return id
+}
+
+func (r Request) Text() string {
+	return r.Params.Get("text")
+}
+
+type Server struct {
+	// The bot as returned by getMe
+	Bot tgbotapi.User
+
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []Request
+	lastID   int
+}
+
+// NewServer starts a fake Bot API server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Bot: tgbotapi.User{
+			ID:        1,
+			FirstName: "Memorization Bot",
+			UserName:  "memorizationbot",
+		},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// URL is the address of the fake server.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Client returns an HTTP client that sends requests for the Bot API to the fake
+// server instead.
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.server.URL)
+	return &http.Client{
+		Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			redirected := new(http.Request)
+			*redirected = *r
+			u := *r.URL
+			u.Scheme = target.Scheme
+			u.Host = target.Host
+			redirected.URL = &u
+			redirected.Host = target.Host
+			return http.DefaultTransport.RoundTrip(redirected)
+		}),
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// NewBotAPI creates a bot that talks to the fake server.
+func (s *Server) NewBotAPI(token string) (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithClient(token, s.Client())
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// Paths look like /bot<token>/<method>
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "bot") {
+		http.NotFound(w, r)
+		return
+	}
+	method := parts[1]
+
+	if err := r.ParseMultipartForm(32 << 20); err == http.ErrNotMultipart {
+		r.ParseForm()
+	}
+	params := url.Values{}
+	for key, values := range r.Form {
+		params[key] = values
+	}
+	if r.MultipartForm != nil {
+		for key := range r.MultipartForm.File {
+			params.Set(key, "(file)")
+		}
+	}
+
+	var result interface{}
+	switch method {
+	case "getMe":
+		result = s.Bot
+	case "getUpdates":
+		result = []tgbotapi.Update{}
+	case "getWebhookInfo":
+		result = tgbotapi.WebhookInfo{}
+	case "setWebhook", "deleteWebhook", "answerCallbackQuery", "sendChatAction", "deleteMessage":
+		s.record(method, params)
+		result = true
+	default:
+		if !strings.HasPrefix(method, "send") && !strings.HasPrefix(method, "edit") && method != "forwardMessage" {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"ok":          false,
+				"error_code":  http.StatusNotFound,
+				"description": "Not Found: method " + method + " is not faked",
+			})
+			return
+		}
+		id := s.record(method, params)
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		result = tgbotapi.Message{
+			MessageID: id,
+			From:      &s.Bot,
+			Date:      int(time.Now().Unix()),
+			Chat:      &tgbotapi.Chat{ID: chatID},
+			Text:      params.Get("text"),
+		}
+	}
+
+	raw, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tgbotapi.APIResponse{Ok: true, Result: raw})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// record keeps a request and returns the ID of the message it would've created.
+func (s *Server) record(method string, params url.Values) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{method, params})
+	s.lastID++
+	return s.lastID
+}
+
+// Requests returns the calls the bot made so far, apart from getMe and getUpdates.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Texts returns the text of every message sent to the chat so far.
+func (s *Server) Texts(chatID int64) []string {
+	texts := []string{}
+	for _, r := range s.Requests() {
+		if r.Method == "sendMessage" && r.ChatID() == chatID {
+			texts = append(texts, r.Text())
+		}
+	}
+	return texts
+}
+
+// Reset forgets the requests so far, so the next step of a conversation can be
+// checked on its own.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// WaitForRequests waits until the bot made at least n requests, since updates are
+// handled in the background. It returns false if that didn't happen in time.
+func (s *Server) WaitForRequests(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		count := len(s.requests)
+		s.mu.Unlock()
+		if count >= n {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitForIdle waits until the bot hasn't made any requests for the given time, so
+// everything it's going to send for an update has been sent.
+func (s *Server) WaitForIdle(quiet time.Duration, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	last := len(s.requests)
+	s.mu.Unlock()
+	lastChange := time.Now()
+	for time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		count := len(s.requests)
+		s.mu.Unlock()
+		if count != last {
+			last = count
+			lastChange = time.Now()
+		} else if time.Since(lastChange) >= quiet {
+			return true
+		}
+	}
+	return false
+}
+
+// PostUpdate sends the update to a webhook handler the way Telegram would.
+func PostUpdate(handler http.Handler, path string, update tgbotapi.Update) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(update)
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
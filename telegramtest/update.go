@@ -0,0 +1,87 @@
+package telegramtest
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+var lastUpdateID int64
+
+func nextUpdateID() int {
+	return int(atomic.AddInt64(&lastUpdateID, 1))
+}
+
+// User returns a user to send updates from.
+func User(id int) *tgbotapi.User {
+	return &tgbotapi.User{
+		ID:        id,
+		FirstName: "User " + strconv.Itoa(id),
+		UserName:  "user" + strconv.Itoa(id),
+	}
+}
+
+// NewMessage is an update with a text message from a user in a private chat.
+// Text starting with a slash is sent as a command.
+func NewMessage(from *tgbotapi.User, text string) tgbotapi.Update {
+	message := &tgbotapi.Message{
+		MessageID: nextUpdateID(),
+		From:      from,
+		Date:      int(time.Now().Unix()),
+		Chat:      &tgbotapi.Chat{ID: int64(from.ID), Type: "private"},
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		command := strings.Fields(text)[0]
+		message.Entities = &[]tgbotapi.MessageEntity{
+			{Type: "bot_command", Offset: 0, Length: len(command)},
+		}
+	}
+	return tgbotapi.Update{UpdateID: nextUpdateID(), Message: message}
+}
+
+// NewGroupMessage is like NewMessage, but sent in a group chat.
+func NewGroupMessage(from *tgbotapi.User, chatID int64, text string) tgbotapi.Update {
+	update := NewMessage(from, text)
+	update.Message.Chat = &tgbotapi.Chat{ID: chatID, Type: "group", Title: "Group " + strconv.FormatInt(chatID, 10)}
+	return update
+}
+
+// NewLocation is an update with a location sent by a user in a private chat.
+func NewLocation(from *tgbotapi.User, latitude, longitude float64) tgbotapi.Update {
+	update := NewMessage(from, "")
+	update.Message.Location = &tgbotapi.Location{
+		Latitude:  latitude,
+		Longitude: longitude,
+	}
+	return update
+}
+
+// NewCallbackQuery is an update for a user pressing an inline button with the
+// given data on a message in a chat.
+func NewCallbackQuery(from *tgbotapi.User, chatID int64, messageID int, data string) tgbotapi.Update {
+	return tgbotapi.Update{
+		UpdateID: nextUpdateID(),
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   strconv.Itoa(nextUpdateID()),
+			From: from,
+			Message: &tgbotapi.Message{
+				MessageID: messageID,
+				Chat:      &tgbotapi.Chat{ID: chatID, Type: stringTernary(chatID == int64(from.ID), "private", "group")},
+			},
+			ChatInstance: strconv.FormatInt(chatID, 10),
+			Data:         data,
+		},
+	}
+}
+
+func stringTernary(x bool, a string, b string) string {
+	if x {
+		return a
+	} else {
+		return b
+	}
+}
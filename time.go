@@ -1,3 +1,208 @@
 package main
 
-const TimeFormat = "15:04"
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	TimeFormat = "15:04"
+	DateFormat = "2006-01-02"
+)
+
+// formatDuration formats short durations like "1m" or "1h30m", leaving off zero units.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	s := ""
+	if h := d / time.Hour; h > 0 {
+		s += fmt.Sprintf("%dh", h)
+	}
+	if m := d % time.Hour / time.Minute; m > 0 {
+		s += fmt.Sprintf("%dm", m)
+	}
+	if sec := d % time.Minute / time.Second; sec > 0 || s == "" {
+		s += fmt.Sprintf("%ds", sec)
+	}
+	return s
+}
+
+// formatSteps formats learning steps, which are stored in seconds.
+func formatSteps(steps pq.Int64Array) string {
+	if len(steps) == 0 {
+		return "none"
+	}
+	formatted := make([]string, len(steps))
+	for i, step := range steps {
+		formatted[i] = formatDuration(time.Duration(step) * time.Second)
+	}
+	return strings.Join(formatted, " ")
+}
+
+// parseSteps parses learning steps like "1m 10m 1h" into seconds. "none" means no
+// steps, anything else has to have at least one.
+func parseSteps(s string) (pq.Int64Array, error) {
+	steps := pq.Int64Array{}
+	if strings.TrimSpace(strings.ToLower(s)) == "none" {
+		return steps, nil
+	}
+	for _, field := range strings.Fields(s) {
+		d, err := time.ParseDuration(field)
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Second || d >= 24*time.Hour {
+			return nil, fmt.Errorf("learning steps must be between 1s and 24h, not %s", field)
+		}
+		steps = append(steps, int64(d/time.Second))
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no learning steps in %q", s)
+	}
+	return steps, nil
+}
+
+// formatTimes formats times of day as they come out of the database, like "08:00:00".
+func formatTimes(times pq.StringArray) string {
+	formatted := make([]string, len(times))
+	for i, s := range times {
+		t, err := time.Parse("15:04:05", s)
+		if err != nil {
+			formatted[i] = s
+		} else {
+			formatted[i] = t.Format(TimeFormat)
+		}
+	}
+	return strings.Join(formatted, " ")
+}
+
+// parseTimes parses times of day separated by spaces or commas, like "08:00 13:00 20:00".
+func parseTimes(s string) (pq.StringArray, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n'
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no times given")
+	}
+	seen := make(map[string]bool, len(fields))
+	times := pq.StringArray{}
+	for _, field := range fields {
+		t, err := time.Parse(TimeFormat, field)
+		if err != nil {
+			return nil, err
+		}
+		formatted := t.Format(TimeFormat)
+		if !seen[formatted] {
+			seen[formatted] = true
+			times = append(times, formatted)
+		}
+	}
+	sort.Strings(times)
+	return times, nil
+}
+
+// formatQuietHours formats the quiet hours of a user like "22:00-08:00", or "off".
+func formatQuietHours(start, end sql.NullString) string {
+	if !start.Valid || !end.Valid {
+		return "off"
+	}
+	return formatTimes(pq.StringArray{start.String}) + "-" + formatTimes(pq.StringArray{end.String})
+}
+
+// parseQuietHours parses a start and end time like "22:00 08:00". "off" turns the quiet hours off.
+func parseQuietHours(s string) (start, end sql.NullString, err error) {
+	if strings.TrimSpace(strings.ToLower(s)) == "off" {
+		return
+	}
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '-' || r == ' '
+	})
+	if len(fields) != 2 {
+		err = fmt.Errorf("quiet hours need a start and an end")
+		return
+	}
+	var t time.Time
+	if t, err = time.Parse(TimeFormat, fields[0]); err != nil {
+		return
+	}
+	start = sql.NullString{String: t.Format(TimeFormat), Valid: true}
+	if t, err = time.Parse(TimeFormat, fields[1]); err != nil {
+		return
+	}
+	end = sql.NullString{String: t.Format(TimeFormat), Valid: true}
+	if start.String == end.String {
+		err = fmt.Errorf("quiet hours can't start and end at the same time")
+	}
+	return
+}
+
+// formatDays formats days of the week like "Mon Wed Fri", 0 being Sunday.
+func formatDays(days pq.Int64Array) string {
+	if len(days) == 7 {
+		return "every day"
+	}
+	formatted := make([]string, 0, len(days))
+	for _, d := range weekdays {
+		if hasDay(days, d) {
+			formatted = append(formatted, d.String()[:3])
+		}
+	}
+	return strings.Join(formatted, " ")
+}
+
+// The days of the week in the order they're shown in
+var weekdays = []time.Weekday{
+	time.Monday,
+	time.Tuesday,
+	time.Wednesday,
+	time.Thursday,
+	time.Friday,
+	time.Saturday,
+	time.Sunday,
+}
+
+func hasDay(days pq.Int64Array, d time.Weekday) bool {
+	for _, day := range days {
+		if day == int64(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// clock returns the hours and minutes of a time of day, whether it's formatted
+// like "08:00" or comes out of the database like "08:00:00".
+func clock(s string) string {
+	if len(s) > len(TimeFormat) {
+		return s[:len(TimeFormat)]
+	}
+	return s
+}
+
+// inQuietHours is in_quiet_hours from the database: whether the time of day
+// falls in the quiet hours from start to end, which may wrap around midnight.
+func inQuietHours(t string, start, end sql.NullString) bool {
+	if !start.Valid || !end.Valid {
+		return false
+	}
+	t, s, e := clock(t), clock(start.String), clock(end.String)
+	if s <= e {
+		return t >= s && t < e
+	}
+	return t >= s || t < e
+}
+
+// alwaysQuiet reports whether all of the rehearsal times fall in the quiet
+// hours, which would leave no time to ever send a rehearsal.
+func alwaysQuiet(times pq.StringArray, start, end sql.NullString) bool {
+	for _, t := range times {
+		if !inQuietHours(t, start, end) {
+			return false
+		}
+	}
+	return true
+}
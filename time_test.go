@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestAlwaysQuiet(t *testing.T) {
+	tests := []struct {
+		name       string
+		times      pq.StringArray
+		start, end string // empty for no quiet hours
+		want       bool
+	}{
+		{"no quiet hours", pq.StringArray{"12:00:00"}, "", "", false},
+		{"noon with quiet nights", pq.StringArray{"12:00:00"}, "22:00:00", "08:00:00", false},
+		{"morning with quiet nights", pq.StringArray{"07:00:00"}, "22:00:00", "08:00:00", true},
+		{"at the end of the night", pq.StringArray{"08:00"}, "22:00", "08:00", false},
+		{"at the start of the night", pq.StringArray{"22:00"}, "22:00", "08:00", true},
+		{"one of several outside", pq.StringArray{"07:00:00", "12:00:00", "23:00:00"}, "22:00:00", "08:00:00", false},
+		{"all of several inside", pq.StringArray{"07:00:00", "23:00:00"}, "22:00:00", "08:00:00", true},
+		{"in quiet hours during the day", pq.StringArray{"12:00"}, "09:00", "17:00", true},
+		{"after quiet hours during the day", pq.StringArray{"17:00"}, "09:00", "17:00", false},
+	}
+	for _, test := range tests {
+		start := sql.NullString{String: test.start, Valid: test.start != ""}
+		end := sql.NullString{String: test.end, Valid: test.end != ""}
+		if got := alwaysQuiet(test.times, start, end); got != test.want {
+			t.Errorf("%s: alwaysQuiet = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseSteps(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string // empty if it's invalid
+	}{
+		{"1m 10m 1h", "{60,600,3600}"},
+		{" 10m ", "{600}"},
+		{"none", "{}"},
+		{"None", "{}"},
+		{"", ""},
+		{"  \n", ""},
+		{"10", ""},
+		{"0s", ""},
+		{"24h", ""},
+	}
+	for _, test := range tests {
+		steps, err := parseSteps(test.s)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("parseSteps(%q) = %v, want an error", test.s, steps)
+			}
+			continue
+		}
+		got, _ := steps.Value()
+		if err != nil || got != test.want {
+			t.Errorf("parseSteps(%q) = %v, %v, want %s", test.s, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"googlemaps.github.io/maps"
+)
+
+// TimeZoneResolver finds the IANA time zone at a location.
+type TimeZoneResolver interface {
+	TimeZone(lat, lng float64) (string, error)
+}
+
+// TimeZones is set up by connect, depending on the time_zone_resolver config.
+var TimeZones TimeZoneResolver = OfflineTimeZones{}
+
+// OfflineTimeZones picks the zone of the closest reference point in the embedded
+// zone.tab from the tz database, which has one for every zone in every country.
+// That's right away from borders between zones, which is where most people are,
+// but can be wrong close to them, so users get to correct it. Out at sea it falls
+// back to the nautical zone for the longitude.
+type OfflineTimeZones struct{}
+
+//go:generate file2const --package=main data/zone.tab:zoneTab data/cities.tab:citiesTab zone_tab.go
+
+// Farther than this from any reference point counts as being at sea
+const maxZoneDistance = 1500 // km
+
+type zonePoint struct {
+	id       string
+	lat, lng float64
+	// Which part of the country the zone is for, like "Eastern (most areas)"
+	comments string
+}
+
+// zoneCity is a city from the embedded cities.tab, for searching zones by the
+// cities that aren't in their name.
+type zoneCity struct {
+	name, id string
+}
+
+var (
+	zonePoints     []zonePoint
+	zonePointsOnce sync.Once
+	zoneCities     []zoneCity
+	zoneCitiesOnce sync.Once
+)
+
+func loadZonePoints() []zonePoint {
+	zonePointsOnce.Do(func() {
+		zonePoints = parseZoneTab(zoneTab)
+	})
+	return zonePoints
+}
+
+func loadZoneCities() []zoneCity {
+	zoneCitiesOnce.Do(func() {
+		zoneCities = parseCitiesTab(citiesTab)
+	})
+	return zoneCities
+}
+
+func (OfflineTimeZones) TimeZone(lat, lng float64) (string, error) {
+	best := ""
+	bestDistance := math.Inf(1)
+	for _, p := range loadZonePoints() {
+		if d := distance(lat, lng, p.lat, p.lng); d < bestDistance {
+			best, bestDistance = p.id, d
+		}
+	}
+	if bestDistance > maxZoneDistance {
+		best = nauticalZone(lng)
+	}
+	if _, err := time.LoadLocation(best); err != nil {
+		return "", err
+	}
+	return best, nil
+}
+
+// parseZoneTab reads the coordinates, zone and comments of every line, skipping
+// the comment lines.
+func parseZoneTab(tab string) []zonePoint {
+	var points []zonePoint
+	for _, line := range strings.Split(tab, "\n") {
+		fields := strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#") || len(fields) < 3 {
+			continue
+		}
+		lat, lng, ok := parseISO6709(fields[1])
+		if !ok {
+			continue
+		}
+		point := zonePoint{id: fields[2], lat: lat, lng: lng}
+		if len(fields) > 3 {
+			point.comments = fields[3]
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// parseCitiesTab reads the city and zone of every line, skipping the comments.
+func parseCitiesTab(tab string) []zoneCity {
+	var cities []zoneCity
+	for _, line := range strings.Split(tab, "\n") {
+		fields := strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#") || len(fields) != 2 {
+			continue
+		}
+		cities = append(cities, zoneCity{fields[0], fields[1]})
+	}
+	return cities
+}
+
+// parseISO6709 parses coordinates like +4230+00131 or -332521+1510821, in degrees,
+// minutes and optionally seconds.
+func parseISO6709(s string) (lat, lng float64, ok bool) {
+	split := strings.LastIndexAny(s, "+-")
+	if split <= 0 {
+		return
+	}
+	lat, ok = parseDegrees(s[:split], 2)
+	if !ok {
+		return
+	}
+	lng, ok = parseDegrees(s[split:], 3)
+	return
+}
+
+func parseDegrees(s string, degreeDigits int) (float64, bool) {
+	if len(s) != 1+degreeDigits+2 && len(s) != 1+degreeDigits+4 {
+		return 0, false
+	}
+	value := 0.0
+	unit := 1.0
+	for i := 1 + degreeDigits; i <= len(s); i += 2 {
+		start := i - 2
+		if unit == 1 {
+			start = 1
+		}
+		n, err := strconv.Atoi(s[start:i])
+		if err != nil {
+			return 0, false
+		}
+		value += float64(n) / unit
+		unit *= 60
+	}
+	if s[0] == '-' {
+		value = -value
+	}
+	return value, true
+}
+
+// distance is the great-circle distance between two points in km.
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadius = 6371
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// nauticalZone returns the Etc zone for the longitude. Their signs are the wrong
+// way around on purpose, Etc/GMT-1 is an hour ahead of UTC.
+func nauticalZone(lng float64) string {
+	offset := int(math.Floor((lng + 7.5) / 15))
+	if offset == 0 {
+		return "Etc/GMT"
+	}
+	return fmt.Sprintf("Etc/GMT%+d", -offset)
+}
+
+// SearchTimeZones finds the zones for a UTC offset like "UTC+2" or "-3:30", or
+// else the zones whose name, city or part of the country looks like the query,
+// including bigger cities that aren't in any zone's name. Exact matches of a
+// zone or city come back on their own, the rest best match first.
+func SearchTimeZones(query string) []string {
+	if offset, ok := parseUTCOffset(query); ok {
+		return timeZonesWithOffset(offset, time.Now())
+	}
+	q := normalizeZoneName(query)
+	if q == "" {
+		return nil
+	}
+	// The best score of each zone that matches, lower is better
+	scores := map[string]int{}
+	match := func(id string, score int) {
+		if best, ok := scores[id]; !ok || score < best {
+			scores[id] = score
+		}
+	}
+	for _, p := range loadZonePoints() {
+		name := normalizeZoneName(p.id)
+		city := name[strings.LastIndex(name, "/")+1:]
+		switch {
+		case name == q:
+			return []string{p.id}
+		case city == q:
+			match(p.id, 0)
+		case strings.HasPrefix(city, q):
+			match(p.id, 1)
+		case strings.Contains(name, q):
+			match(p.id, 2)
+		case len(q) >= 3 && strings.Contains(normalizeZoneName(p.comments), q):
+			match(p.id, 2)
+		case len(q) >= 3 && isSubsequence(q, city):
+			match(p.id, 3)
+		}
+	}
+	for _, c := range loadZoneCities() {
+		city := normalizeZoneName(c.name)
+		switch {
+		case city == q:
+			match(c.id, 0)
+		case strings.HasPrefix(city, q):
+			match(c.id, 1)
+		case len(q) >= 3 && isSubsequence(q, city):
+			match(c.id, 3)
+		}
+	}
+
+	type scored struct {
+		id    string
+		score int
+	}
+	matches := make([]scored, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, scored{id, score})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+		return matches[i].id < matches[j].id
+	})
+	var ids []string
+	for _, m := range matches {
+		if m.score > 0 && len(ids) > 0 && matches[0].score == 0 {
+			break
+		}
+		ids = append(ids, m.id)
+	}
+	return ids
+}
+
+// normalizeZoneName lowercases names and treats spaces, underscores and dashes
+// the same and leaves out dots and apostrophes, so "new york" finds
+// America/New_York and "st. john's" finds America/St_Johns.
+func normalizeZoneName(s string) string {
+	s = zoneNameReplacer.Replace(strings.ToLower(s))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var zoneNameReplacer = strings.NewReplacer("_", " ", "-", " ", ".", "", "'", "")
+
+// isSubsequence reports whether all characters of sub appear in s in order, so
+// small typos like "amstrdam" still match.
+func isSubsequence(sub, s string) bool {
+	for _, r := range s {
+		if len(sub) == 0 {
+			break
+		}
+		if strings.HasPrefix(sub, string(r)) {
+			sub = sub[len(string(r)):]
+		}
+	}
+	return len(sub) == 0
+}
+
+// parseUTCOffset parses offsets like "UTC+2", "GMT-03:30", "+0545" or just "UTC",
+// into seconds east of UTC.
+func parseUTCOffset(s string) (int, bool) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	if strings.HasPrefix(s, "UTC") || strings.HasPrefix(s, "GMT") {
+		s = s[3:]
+		if s == "" {
+			return 0, true
+		}
+	}
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	hours, minutes := s[1:], "0"
+	if i := strings.Index(hours, ":"); i >= 0 {
+		hours, minutes = hours[:i], hours[i+1:]
+	} else if len(hours) > 2 {
+		hours, minutes = hours[:len(hours)-2], hours[len(hours)-2:]
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h > 14 {
+		return 0, false
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m >= 60 {
+		return 0, false
+	}
+	offset := h*3600 + m*60
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return offset, true
+}
+
+// formatUTCOffset formats seconds east of UTC like "UTC+5:30".
+func formatUTCOffset(offset int) string {
+	if offset == 0 {
+		return "UTC"
+	}
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	if offset%3600 == 0 {
+		return fmt.Sprintf("UTC%s%d", sign, offset/3600)
+	}
+	return fmt.Sprintf("UTC%s%d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// timeZoneOffset returns the offset of the zone at the time in seconds east of UTC.
+func timeZoneOffset(id string, t time.Time) (int, bool) {
+	location, err := time.LoadLocation(id)
+	if err != nil {
+		return 0, false
+	}
+	_, offset := t.In(location).Zone()
+	return offset, true
+}
+
+// timeZonesWithOffset returns the zones that are at the offset at the time, with
+// the nautical zone for it at the end if there is one.
+func timeZonesWithOffset(offset int, t time.Time) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, p := range loadZonePoints() {
+		if seen[p.id] {
+			continue
+		}
+		seen[p.id] = true
+		if o, ok := timeZoneOffset(p.id, t); ok && o == offset {
+			ids = append(ids, p.id)
+		}
+	}
+	sort.Strings(ids)
+	if offset%3600 == 0 && offset >= -12*3600 && offset <= 14*3600 {
+		ids = append(ids, nauticalZone(float64(offset/3600*15)))
+	}
+	return ids
+}
+
+// MapsTimeZones looks up time zones with the Google Maps Time Zone API, which
+// knows the actual borders.
+type MapsTimeZones struct {
+	Client *maps.Client
+}
+
+func (m MapsTimeZones) TimeZone(lat, lng float64) (string, error) {
+	resp, err := m.Client.Timezone(context.TODO(), &maps.TimezoneRequest{
+		Location: &maps.LatLng{
+			Lat: lat,
+			Lng: lng,
+		},
+		Timestamp: time.Now(),
+		Language:  "en",
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.TimeZoneID, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestParseISO6709(t *testing.T) {
+	tests := []struct {
+		s        string
+		lat, lng float64
+		ok       bool
+	}{
+		{"+4230+00131", 42.5, 1 + 31.0/60, true},
+		{"+5222+00454", 52 + 22.0/60, 4 + 54.0/60, true},
+		{"-332521+1510821", -(33 + 25.0/60 + 21.0/3600), 151 + 8.0/60 + 21.0/3600, true},
+		{"+6448-14751", 64 + 48.0/60, -(147 + 51.0/60), true},
+		{"-1757+17827", -(17 + 57.0/60), 178 + 27.0/60, true},
+		{"+4230", 0, 0, false},
+		{"4230+00131", 0, 0, false},
+		{"+423+00131", 0, 0, false},
+		{"+4230+0013", 0, 0, false},
+		{"+42x0+00131", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		lat, lng, ok := parseISO6709(test.s)
+		if ok != test.ok {
+			t.Errorf("parseISO6709(%q) ok = %v, want %v", test.s, ok, test.ok)
+			continue
+		}
+		if ok && (math.Abs(lat-test.lat) > 1e-9 || math.Abs(lng-test.lng) > 1e-9) {
+			t.Errorf("parseISO6709(%q) = %v, %v, want %v, %v", test.s, lat, lng, test.lat, test.lng)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lng1, lat2, lng2 float64
+		want                   float64 // km, within 1%
+	}{
+		{"same point", 52.37, 4.89, 52.37, 4.89, 0},
+		{"Amsterdam to New York", 52.37, 4.89, 40.71, -74.01, 5860},
+		{"across the antimeridian", 0, 179, 0, -179, 222},
+		{"pole to pole", 90, 0, -90, 0, 20015},
+		{"antipodes", 0, 0, 0, 180, 20015},
+	}
+	for _, test := range tests {
+		got := distance(test.lat1, test.lng1, test.lat2, test.lng2)
+		if math.Abs(got-test.want) > test.want/100+0.001 {
+			t.Errorf("%s: distance = %.1f km, want %.0f km", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNauticalZone(t *testing.T) {
+	tests := []struct {
+		lng  float64
+		want string
+	}{
+		{0, "Etc/GMT"},
+		{7.4, "Etc/GMT"},
+		{-7.4, "Etc/GMT"},
+		// East of Greenwich is ahead of UTC, which the Etc zones write with a minus
+		{7.5, "Etc/GMT-1"},
+		{15, "Etc/GMT-1"},
+		{-7.6, "Etc/GMT+1"},
+		{-15, "Etc/GMT+1"},
+		{172.4, "Etc/GMT-11"},
+		{172.5, "Etc/GMT-12"},
+		{180, "Etc/GMT-12"},
+		{-172.4, "Etc/GMT+11"},
+		{-172.6, "Etc/GMT+12"},
+		{-180, "Etc/GMT+12"},
+	}
+	for _, test := range tests {
+		if got := nauticalZone(test.lng); got != test.want {
+			t.Errorf("nauticalZone(%v) = %s, want %s", test.lng, got, test.want)
+		}
+	}
+}
+
+func TestOfflineTimeZones(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lng float64
+		want     string
+	}{
+		{"Amsterdam", 52.37, 4.89, "Europe/Amsterdam"},
+		{"New York", 40.71, -74.01, "America/New_York"},
+		{"Sydney", -33.87, 151.21, "Australia/Sydney"},
+		{"Fiji", -18.14, 178.44, "Pacific/Fiji"},
+		{"South Atlantic", -45, -20, "Etc/GMT+1"},
+		{"Chatham Islands from across the antimeridian", -44, 179.5, "Pacific/Chatham"},
+		{"South Pacific near the antimeridian", -60, -175, "Etc/GMT+12"},
+	}
+	for _, test := range tests {
+		id, err := OfflineTimeZones{}.TimeZone(test.lat, test.lng)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if id != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, id, test.want)
+		}
+	}
+}
+
+func TestParseUTCOffset(t *testing.T) {
+	tests := []struct {
+		s      string
+		offset int
+		ok     bool
+	}{
+		{"UTC", 0, true},
+		{"gmt", 0, true},
+		{"UTC+2", 2 * 3600, true},
+		{"UTC + 2", 2 * 3600, true},
+		{"+0545", 5*3600 + 45*60, true},
+		{"GMT-03:30", -(3*3600 + 30*60), true},
+		{"-12", -12 * 3600, true},
+		{"+14", 14 * 3600, true},
+		{"+15", 0, false},
+		{"+5:60", 0, false},
+		{"UTC+", 0, false},
+		{"2", 0, false},
+		{"+ab", 0, false},
+		{"Amsterdam", 0, false},
+	}
+	for _, test := range tests {
+		offset, ok := parseUTCOffset(test.s)
+		if ok != test.ok || offset != test.offset {
+			t.Errorf("parseUTCOffset(%q) = %d, %v, want %d, %v", test.s, offset, ok, test.offset, test.ok)
+		}
+	}
+}
+
+func TestIsSubsequence(t *testing.T) {
+	tests := []struct {
+		sub, s string
+		want   bool
+	}{
+		{"amstrdam", "amsterdam", true},
+		{"amsterdam", "amsterdam", true},
+		{"", "amsterdam", true},
+		{"", "", true},
+		{"zrich", "zürich", true},
+		{"zürich", "zurich", false},
+		{"madirm", "madrid", false},
+		{"amsterdams", "amsterdam", false},
+		{"ams", "", false},
+	}
+	for _, test := range tests {
+		if got := isSubsequence(test.sub, test.s); got != test.want {
+			t.Errorf("isSubsequence(%q, %q) = %v, want %v", test.sub, test.s, got, test.want)
+		}
+	}
+}
+
+func TestTimeZonePage(t *testing.T) {
+	ids := func(n int) []string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprint("Zone/", i)
+		}
+		return ids
+	}
+	tests := []struct {
+		ids   int
+		page  int
+		first string
+		n     int
+		more  bool
+	}{
+		{0, 0, "", 0, false},
+		{1, 0, "Zone/0", 1, false},
+		{timeZonePageSize, 0, "Zone/0", timeZonePageSize, false},
+		{timeZonePageSize, 1, "", 0, false},
+		{timeZonePageSize + 1, 0, "Zone/0", timeZonePageSize, true},
+		{timeZonePageSize + 1, 1, fmt.Sprint("Zone/", timeZonePageSize), 1, false},
+		{2 * timeZonePageSize, 1, fmt.Sprint("Zone/", timeZonePageSize), timeZonePageSize, false},
+		{3 * timeZonePageSize, 1, fmt.Sprint("Zone/", timeZonePageSize), timeZonePageSize, true},
+		{timeZonePageSize + 1, 5, "", 0, false},
+		{timeZonePageSize + 1, -1, "", 0, false},
+	}
+	for _, test := range tests {
+		page, more := timeZonePage(ids(test.ids), test.page)
+		first := ""
+		if len(page) > 0 {
+			first = page[0]
+		}
+		if len(page) != test.n || first != test.first || more != test.more {
+			t.Errorf("page %d of %d zones starts at %q with %d zones and more %v, want %q, %d and %v", test.page, test.ids, first, len(page), more, test.first, test.n, test.more)
+		}
+	}
+}
+
+func TestSearchTimeZones(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"Amsterdam", []string{"Europe/Amsterdam"}},
+		{"america/new_york", []string{"America/New_York"}},
+		{"Boston", []string{"America/New_York"}},
+		{"Munich", []string{"Europe/Berlin"}},
+		{"san francisco", []string{"America/Los_Angeles"}},
+		{"San Jose", []string{"America/Costa_Rica", "America/Los_Angeles"}},
+		{"St. John's", []string{"America/St_Johns"}},
+		{"Rostov on Don", []string{"Europe/Moscow"}},
+		{"xyzzy", nil},
+	}
+	for _, test := range tests {
+		got := SearchTimeZones(test.query)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("SearchTimeZones(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	// Parts of the country from the comments in zone.tab
+	found := false
+	for _, id := range SearchTimeZones("germany") {
+		found = found || id == "Europe/Berlin"
+	}
+	if !found {
+		t.Error("searching for germany doesn't find Europe/Berlin")
+	}
+}
+
+func TestZoneCities(t *testing.T) {
+	zones := map[string]bool{}
+	for _, p := range loadZonePoints() {
+		zones[p.id] = true
+	}
+	cities := loadZoneCities()
+	if len(cities) < 100 {
+		t.Fatalf("only %d cities", len(cities))
+	}
+	for _, c := range cities {
+		if !zones[c.id] {
+			t.Errorf("%s is in %s, which isn't in zone.tab", c.name, c.id)
+		}
+	}
+}
@@ -3,28 +3,47 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"fmt"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
 type User struct {
-	ID            int            `db:"id"`
-	CreatedAt     time.Time      `db:"created_at"`
-	UpdatedAt     time.Time      `db:"updated_at"`
-	NextRehearsal time.Time      `db:"rehearsal"`
-	RehearsalTime time.Time      `db:"rehearsal_time"`
-	State         State          `db:"state"`
-	TimeZone      string         `db:"time_zone"`
-	Data          types.JSONText `db:"data"`
-	Scheduled     bool           `db:"scheduled"`
+	ID             int            `db:"id"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+	NextRehearsal  time.Time      `db:"rehearsal"`
+	RehearsalTimes pq.StringArray `db:"rehearsal_times"`
+	State          State          `db:"state"`
+	TimeZone       string         `db:"time_zone"`
+	Data           types.JSONText `db:"data"`
+	Scheduled      bool           `db:"scheduled"`
+	// When to send the cards that were still being learned at the end of a rehearsal
+	LearningReminder pq.NullTime `db:"learning_reminder"`
+	// Take turns between decks during rehearsal instead of going by due date
+	RoundRobin bool `db:"round_robin"`
+	// No rehearsals get sent between these dates
+	VacationStart pq.NullTime `db:"vacation_start"`
+	VacationEnd   pq.NullTime `db:"vacation_end"`
+	// Days of the week to send rehearsals on, 0 is Sunday
+	RehearsalDays pq.Int64Array `db:"rehearsal_days"`
+	// No rehearsals get sent in between these times of day
+	QuietStart sql.NullString `db:"quiet_start"`
+	QuietEnd   sql.NullString `db:"quiet_end"`
+	// Follow up on ignored rehearsals and warn about streaks that are about to end
+	Reminders      bool        `db:"reminders"`
+	RehearsalSent  pq.NullTime `db:"rehearsal_sent"`
+	FollowUp       pq.NullTime `db:"follow_up"`
+	StreakWarnedOn pq.NullTime `db:"streak_warned_on"`
 }
 
 func (u *User) GetDecks(tx *sqlx.Tx) ([]Deck, error) {
 	decks := []Deck{}
-	err := tx.Select(&decks, "SELECT * FROM decks WHERE user_id=$1 ORDER BY name ASC", u.ID)
+	err := tx.Select(&decks, "SELECT * FROM member_decks WHERE member_id=$1 ORDER BY name ASC, id ASC", u.ID)
 	return decks, err
 }
 
@@ -36,7 +55,7 @@ func (u *User) HasDeckWithName(tx *sqlx.Tx, name string) (exists bool, err error
 // return deck, total_cards, cards_left
 func (u *User) GetDeck(tx *sqlx.Tx, id int) (*Deck, error) {
 	var deck Deck
-	err := tx.Get(&deck, `SELECT * FROM decks WHERE user_id=$1 AND id=$2 LIMIT 1`, u.ID, id)
+	err := tx.Get(&deck, `SELECT * FROM member_decks WHERE member_id=$1 AND id=$2 LIMIT 1`, u.ID, id)
 	return &deck, err
 }
 
@@ -47,20 +66,30 @@ func (u *User) GetDeckWithStats(tx *sqlx.Tx, id int) (*Deck, int, int, error) {
 		TotalCards int `db:"total_cards"`
 		CardsLeft  int `db:"cards_left"`
 	}
-	err := tx.Get(&result, `WITH deck AS (SELECT * FROM cards WHERE deck_id=$3)
+	err := tx.Get(&result, `WITH deck AS (SELECT * FROM member_cards WHERE user_id=$1 AND deck_id=$2),
+ limits AS (SELECT * FROM member_deck_limits WHERE user_id=$1 AND deck_id=$2)
  SELECT
  (SELECT COUNT(*) FROM deck) AS total_cards,
- (SELECT COUNT(CASE WHEN next_repetition <= date_in_time_zone($1) THEN TRUE END) FROM deck) AS cards_left,
+ (SELECT
+  COUNT(CASE WHEN repetition_today > 0 THEN TRUE END) +
+  LEAST(COUNT(CASE WHEN repetition_today = 0 AND is_new THEN TRUE END), GREATEST(MAX(new_cards_left), 0)) +
+  LEAST(COUNT(CASE WHEN repetition_today = 0 AND NOT is_new THEN TRUE END), GREATEST(MAX(reviews_left), 0))
+  FROM deck, limits
+  WHERE
+   next_repetition <= NOW() AND
+   NOT suspended AND
+   (buried_until IS NULL OR buried_until <= NOW())
+  ) AS cards_left,
  *
- FROM decks
- WHERE user_id=$2 AND id=$3
- LIMIT 1`, u.TimeZone, u.ID, id)
+ FROM member_decks
+ WHERE member_id=$1 AND id=$2
+ LIMIT 1`, u.ID, id)
 	return &result.Deck, result.TotalCards, result.CardsLeft, err
 }
 
 func (u *User) GetDeckByOffset(tx *sqlx.Tx, offset int) (*Deck, error) {
 	var deck Deck
-	err := tx.Get(&deck, "SELECT * FROM decks WHERE user_id=$1 ORDER BY name ASC LIMIT 1 OFFSET $2", u.ID, offset)
+	err := tx.Get(&deck, "SELECT * FROM member_decks WHERE member_id=$1 ORDER BY name ASC LIMIT 1 OFFSET $2", u.ID, offset)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else {
@@ -68,14 +97,38 @@ func (u *User) GetDeckByOffset(tx *sqlx.Tx, offset int) (*Deck, error) {
 	}
 }
 
-func (u *User) GetDeckByName(tx *sqlx.Tx, name string) (*Deck, error) {
-	var deck Deck
-	err := tx.Get(&deck, "SELECT * FROM decks WHERE user_id=$1 AND name=$2 LIMIT 1", u.ID, name)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	} else {
-		return &deck, err
+// GetDeckByLabel returns the deck with the given button text in the deck list,
+// or nil if there's none.
+func (u *User) GetDeckByLabel(tx *sqlx.Tx, label string) (*Deck, error) {
+	decks, err := u.GetDecks(tx)
+	if err != nil {
+		return nil, err
 	}
+	for i, l := range deckLabels(decks) {
+		if l == label {
+			return &decks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// deckLabels returns the button text of each of the decks. Decks can share a
+// name, like a shared deck and one of the member's own, so those get their id
+// added to tell them apart.
+func deckLabels(decks []Deck) []string {
+	names := make(map[string]int, len(decks))
+	for _, deck := range decks {
+		names[deck.Name]++
+	}
+	labels := make([]string, len(decks))
+	for i, deck := range decks {
+		if names[deck.Name] > 1 {
+			labels[i] = fmt.Sprintf("%s (#%d)", deck.Name, deck.ID)
+		} else {
+			labels[i] = deck.Name
+		}
+	}
+	return labels
 }
 
 func (u *User) SetState(tx *sqlx.Tx, state State, data *Data) error {
@@ -111,15 +164,138 @@ func (u *User) SetScheduled(tx *sqlx.Tx, scheduled bool) (err error) {
 	return
 }
 
-func (u *User) SetRehearsalTime(tx *sqlx.Tx, t time.Time) (err error) {
-	err = tx.Get(u, "UPDATE users SET rehearsal_time=$1 WHERE id=$2 RETURNING *", t.Format(TimeFormat), u.ID)
+func (u *User) SetReminders(tx *sqlx.Tx, reminders bool) (err error) {
+	err = tx.Get(u, "UPDATE users SET reminders=$1, follow_up=NULL WHERE id=$2 RETURNING *", reminders, u.ID)
+	return
+}
+
+func (u *User) SetRoundRobin(tx *sqlx.Tx, roundRobin bool) (err error) {
+	err = tx.Get(u, "UPDATE users SET round_robin=$1 WHERE id=$2 RETURNING *", roundRobin, u.ID)
+	return
+}
+
+func (u *User) SetVacation(tx *sqlx.Tx, start, end time.Time) (err error) {
+	err = tx.Get(u, "UPDATE users SET vacation_start=$1, vacation_end=$2 WHERE id=$3 RETURNING *", start.Format(DateFormat), end.Format(DateFormat), u.ID)
+	return
+}
+
+func (u *User) EndVacation(tx *sqlx.Tx) (err error) {
+	err = tx.Get(u, "UPDATE users SET vacation_start=NULL, vacation_end=NULL WHERE id=$1 RETURNING *", u.ID)
+	return
+}
+
+// Today returns the current date in the time zone of the user
+func (u *User) Today() time.Time {
+	location, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+	now := time.Now().In(location)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// GetBacklog returns the amount of reviews that are due
+func (u *User) GetBacklog(tx *sqlx.Tx) (backlog int, err error) {
+	err = tx.Get(&backlog, "SELECT COUNT(*) FROM card_progress WHERE user_id=$1 AND learning_step = 0 AND last_review IS NOT NULL AND NOT suspended AND next_repetition <= NOW()", u.ID)
+	return
+}
+
+// SpreadBacklog reschedules the reviews that are due evenly over the next days,
+// starting with the ones that have been due the longest.
+func (u *User) SpreadBacklog(tx *sqlx.Tx, days int) (int64, error) {
+	result, err := tx.Exec(`WITH backlog AS (
+ SELECT
+  card_id,
+  ROW_NUMBER() OVER (ORDER BY next_repetition ASC, random_order ASC) - 1 AS i,
+  COUNT(*) OVER () AS n
+ FROM card_progress
+ WHERE
+  user_id=$1 AND
+  learning_step = 0 AND
+  last_review IS NOT NULL AND
+  NOT suspended AND
+  next_repetition <= NOW()
+)
+UPDATE card_progress p
+SET next_repetition=start_of_day_in_time_zone(date_in_time_zone($2) + (b.i * $3 / b.n)::INTEGER, $2)
+FROM backlog b
+WHERE p.user_id=$1 AND p.card_id=b.card_id`, u.ID, u.TimeZone, days)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (u *User) SetRehearsalTimes(tx *sqlx.Tx, times pq.StringArray) (err error) {
+	err = tx.Get(u, "UPDATE users SET rehearsal_times=$1 WHERE id=$2 RETURNING *", times, u.ID)
+	return
+}
+
+func (u *User) SetRehearsalDays(tx *sqlx.Tx, days pq.Int64Array) (err error) {
+	err = tx.Get(u, "UPDATE users SET rehearsal_days=$1 WHERE id=$2 RETURNING *", days, u.ID)
+	return
+}
+
+// SetQuietHours sets the window in which no rehearsals get sent, or turns it off
+// when start and end are NULL.
+func (u *User) SetQuietHours(tx *sqlx.Tx, start, end sql.NullString) (err error) {
+	err = tx.Get(u, "UPDATE users SET quiet_start=$1, quiet_end=$2 WHERE id=$3 RETURNING *", start, end, u.ID)
 	return
 }
 
 func (u *User) CreateDeck(tx *sqlx.Tx, name string) (*Deck, error) {
-	var deck Deck
-	err := tx.Get(&deck, "INSERT INTO decks (user_id, name) VALUES ($1, $2) RETURNING *", u.ID, name)
-	return &deck, err
+	var deckID int
+	err := tx.Get(&deckID, `WITH d AS (
+ INSERT INTO decks (user_id, name) VALUES ($1, $2) RETURNING id
+)
+INSERT INTO deck_members (deck_id, user_id, role) SELECT id, $1, $3 FROM d RETURNING deck_id`, u.ID, name, Owner)
+	if err != nil {
+		return nil, err
+	}
+	return u.GetDeck(tx, deckID)
+}
+
+// JoinDeck makes the user a member of the deck the invite code belongs to.
+// Returns nil if the code doesn't exist or has expired. Existing members keep
+// their role.
+func (u *User) JoinDeck(tx *sqlx.Tx, code string) (*Deck, error) {
+	var deckID int
+	_, err := tx.Exec(`INSERT INTO deck_members (deck_id, user_id, role)
+ SELECT deck_id, $1, role FROM deck_invites WHERE code=$2 AND expires_at > NOW()
+ ON CONFLICT DO NOTHING`, u.ID, code)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Get(&deckID, "SELECT deck_id FROM deck_invites WHERE code=$1 AND expires_at > NOW()", code)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return u.GetDeck(tx, deckID)
+}
+
+// GetCard returns nil if the card isn't in one of the user's decks.
+func (u *User) GetCard(tx *sqlx.Tx, id int) (*Card, error) {
+	card, err := GetCard(tx, u.ID, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return card, err
+}
+
+// GetEditableCard returns nil if the card is in a deck the user can't edit.
+func (u *User) GetEditableCard(tx *sqlx.Tx, id int) (*Card, error) {
+	var card Card
+	err := tx.Get(&card, `SELECT c.*
+ FROM member_cards c
+ INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+ WHERE c.user_id=$1 AND c.id=$2 AND m.role IN ($3, $4)`, u.ID, id, Owner, Editor)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else {
+		return &card, err
+	}
 }
 
 func (u *User) GetScheduledCard(tx *sqlx.Tx) (*Card, error) {
@@ -133,15 +309,77 @@ func (u *User) GetScheduledCard(tx *sqlx.Tx) (*Card, error) {
 	}
 }
 
-func WithUser(ID int, f func(*User, *sqlx.Tx) error) error {
+// GetNextLearningDue returns how long it takes until the first card that is being
+// learned in a scheduled deck is due, if it's still due today.
+func (u *User) GetNextLearningDue(tx *sqlx.Tx) (*time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := tx.Get(&seconds, `SELECT EXTRACT(EPOCH FROM MIN(c.next_repetition) - NOW())
+ FROM member_cards c
+ INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+ WHERE
+  c.user_id=$1 AND
+  m.scheduled AND
+  c.learning_step > 0 AND
+  c.next_repetition < start_of_day_in_time_zone(date_in_time_zone($2) + 1, $2)`, u.ID, u.TimeZone)
+	if err != nil || !seconds.Valid {
+		return nil, err
+	}
+	due := time.Duration(seconds.Float64 * float64(time.Second))
+	return &due, nil
+}
+
+// GetNextDue returns how long it takes until the next card is due in the deck, or
+// in any of the scheduled decks if deckID is 0. It's negative if cards are due
+// already, and nil if there are no cards. Like reviewable_cards, buried cards
+// are due once they're unburied, and cards that don't fit in today's limits
+// are due tomorrow.
+func (u *User) GetNextDue(tx *sqlx.Tx, deckID int) (*time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := tx.Get(&seconds, `SELECT EXTRACT(EPOCH FROM MIN(GREATEST(
+ c.next_repetition,
+ c.buried_until,
+ CASE WHEN c.repetition_today = 0 AND CASE WHEN c.is_new THEN l.new_cards_left <= 0 ELSE l.reviews_left <= 0 END
+  THEN start_of_day_in_time_zone(l.today + 1, $3)
+ END
+)) - NOW())
+FROM member_cards c
+INNER JOIN deck_members m ON c.deck_id = m.deck_id AND c.user_id = m.user_id
+INNER JOIN member_deck_limits l ON l.deck_id = c.deck_id AND l.user_id = c.user_id
+WHERE
+ c.user_id=$1 AND
+ NOT c.suspended AND
+ CASE WHEN $2 = 0 THEN m.scheduled ELSE c.deck_id = $2 END`, u.ID, deckID, u.TimeZone)
+	if err != nil || !seconds.Valid {
+		return nil, err
+	}
+	due := time.Duration(seconds.Float64 * float64(time.Second))
+	return &due, nil
+}
+
+func (u *User) SetLearningReminder(tx *sqlx.Tx, after time.Duration) (err error) {
+	err = tx.Get(u, "UPDATE users SET learning_reminder=NOW() + $1::INTEGER * INTERVAL '1 second' WHERE id=$2 RETURNING *", int64(after/time.Second), u.ID)
+	return
+}
+
+func WithUser(log *logrus.Entry, ID int, f func(*User, *sqlx.Tx) error) (err error) {
+	start := time.Now()
+	defer func() {
+		entry := log.WithFields(logrus.Fields{"user_id": ID, "duration": time.Since(start)})
+		result := "commit"
+		if err != nil {
+			entry = entry.WithError(err)
+			result = "rollback"
+		}
+		entry.Debug("user transaction")
+		userTransactionDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
 	tx, err := DB.Beginx()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	log.Printf("getting state %d", ID)
-
 	var user User
 	err = tx.Get(&user, "SELECT * FROM users WHERE id=$1 FOR UPDATE", ID)
 	if err == sql.ErrNoRows {
@@ -157,8 +395,6 @@ func WithUser(ID int, f func(*User, *sqlx.Tx) error) error {
 	} else if err != nil {
 		return err
 	}
-	log.Printf("state=%+v", user)
-
 	err = f(&user, tx)
 	if err != nil {
 		return err